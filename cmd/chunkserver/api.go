@@ -33,6 +33,10 @@ func (a *API) CreateChunk(args *rpc.CreateChunkRequest, reply *rpc.CreateChunkRe
 // DeleteChunk ...
 func (a *API) DeleteChunk(args *rpc.DeleteChunkRequest, _ *rpc.DeleteChunkReply) error {
 	log.Infow("rpc", "event", "ChunkServerAPI.DeleteChunk", "args", args)
+	if args.Version > 0 {
+		return a.server.DeleteStaleChunk(args.ChunkID, args.Version)
+	}
+
 	return a.server.DeleteChunk(args.ChunkID)
 }
 
@@ -40,7 +44,7 @@ func (a *API) DeleteChunk(args *rpc.DeleteChunkRequest, _ *rpc.DeleteChunkReply)
 func (a *API) GrantLease(args *rpc.GrantLeaseArgs, _ *rpc.GrantLeaseReply) error {
 	log.Infow("rpc", "event", "ChunkServerAPI.GrantLease", "args", args)
 
-	err := a.server.GrantLease(args.ChunkID, args.ValidUntil)
+	err := a.server.GrantLease(args.ChunkID, args.ValidFor, args.Epoch)
 	if err != nil {
 		return err
 	}
@@ -48,6 +52,14 @@ func (a *API) GrantLease(args *rpc.GrantLeaseArgs, _ *rpc.GrantLeaseReply) error
 	return nil
 }
 
+// RevokeLease ...
+func (a *API) RevokeLease(args *rpc.RevokeLeaseArgs, _ *rpc.RevokeLeaseReply) error {
+	log.Infow("rpc", "event", "ChunkServerAPI.RevokeLease", "args", args)
+
+	a.server.RevokeLease(args.ChunkID, args.Epoch)
+	return nil
+}
+
 // IncrementChunkVersion ...
 func (a *API) IncrementChunkVersion(args *rpc.IncrementChunkVersionArgs, _ *rpc.IncrementChunkVersionReply) error {
 	log.Infow("rpc", "event", "ChunkServerAPI.IncrementChunkVersion", "args", args)
@@ -82,7 +94,11 @@ func (a *API) WriteChunk(args *rpc.WriteChunkArgs, reply *rpc.WriteChunkReply) e
 func (a *API) ApplyMigration(args *rpc.ApplyMigrationArgs, reply *rpc.ApplyMigrationReply) error {
 	log.Infow("rpc", "event", "ChunkServerAPI.ApplyMigration", "args", args)
 
-	bytesWritten, err := a.server.ApplyMigration(args.ChunkID, args.CheckSum, args.Offset, args.Version)
+	if args.Padding {
+		return a.server.PadChunk(args.ChunkID, args.Offset, args.Version, args.Epoch)
+	}
+
+	bytesWritten, err := a.server.ApplyMigration(args.ChunkID, args.CheckSum, args.Offset, args.Version, args.Epoch)
 	if err != nil {
 		return err
 	}
@@ -102,3 +118,51 @@ func (a *API) ReplicateChunk(args *rpc.ReplicateChunkArgs, reply *rpc.ReplicateC
 
 	return nil
 }
+
+func (a *API) ReadChunk(args *rpc.ReadChunkArgs, reply *rpc.ReadChunkReply) error {
+	log.Infow("rpc", "event", "ChunkServerAPI.ReadChunk", "chunkID", args.ChunkID, "offset", args.Offset, "length", args.Length)
+
+	data, version, err := a.server.ReadChunk(args.ChunkID, args.Offset, args.Length, args.Version)
+	if err != nil {
+		return err
+	}
+
+	reply.Data = data
+	reply.Version = version
+
+	return nil
+}
+
+func (a *API) RecordAppend(args *rpc.RecordAppendArgs, reply *rpc.RecordAppendReply) error {
+	log.Infow("rpc", "event", "ChunkServerAPI.RecordAppend", "args", args)
+
+	offset, chunkFull, err := a.server.RecordAppend(args.ChunkID, args.CheckSum, args.Version, args.ChunkServers)
+	if err != nil {
+		return err
+	}
+
+	reply.Offset = offset
+	reply.ChunkFull = chunkFull
+
+	return nil
+}
+
+func (a *API) CloneChunk(args *rpc.CloneChunkArgs, reply *rpc.CloneChunkReply) error {
+	log.Infow("rpc", "event", "ChunkServerAPI.CloneChunk", "args", args)
+
+	_, err := a.server.CloneChunk(args.ChunkID, args.NewChunkID, args.FilePath, args.ChunkIndex, args.Version)
+	return err
+}
+
+func (a *API) RebuildStripe(args *rpc.RebuildStripeArgs, reply *rpc.RebuildStripeReply) error {
+	log.Infow("rpc", "event", "ChunkServerAPI.RebuildStripe", "filePath", args.FilePath, "members", args.Members)
+
+	lengths, err := a.server.RebuildStripe(args.DataShards, args.ParityShards, args.ChunkSize, args.FilePath, args.Members)
+	if err != nil {
+		return err
+	}
+
+	reply.Lengths = lengths
+
+	return nil
+}
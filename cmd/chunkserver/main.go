@@ -33,9 +33,16 @@ func run() error {
 	}
 
 	chunkServer := chunkserver.NewChunkServer(cfg)
+
+	// Rebuild chunk inventory so that first health report contains chunks stored before restart
+	err = chunkServer.LoadChunks()
+	if err != nil {
+		log.Errorw("startup", "error", "failed to load chunks from disk")
+		return err
+	}
 	chunkServerAPI := NewChunkServerAPI(chunkServer)
 
-	err = rpc.Register(chunkServerAPI)
+	err = rpc.RegisterName("ChunkServerAPI", chunkServerAPI)
 	if err != nil {
 		log.Errorw("startup", "error", "failed to register rpc api")
 		return err
@@ -68,6 +75,9 @@ func run() error {
 	// Start reporting health to master
 	go chunkServer.StartHealthReport(ctx)
 
+	// Start verifying checksums of stored chunks in background
+	go chunkServer.StartScrubber(ctx)
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 	<-shutdown
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/client"
 	"github.com/pyropy/dfs/core/model"
+	"github.com/pyropy/dfs/rpc/master"
 	"github.com/urfave/cli/v2"
 )
 
@@ -26,14 +31,25 @@ var writeCmd = &cli.Command{
 			Required: true,
 			Usage:    "Path where you want to store your file on dfs",
 		},
+		&cli.IntFlag{
+			Name:  "replication",
+			Usage: "Number of replicas kept of the file, default replication factor is used if not set",
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "Size of file chunks in bytes, cluster default chunk size is used if not set",
+		},
+		&cli.StringFlag{
+			Name:  "erasure-coding",
+			Usage: "Store file erasure coded with given policy (e.g. RS-6-3) instead of replicated once it is written",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		filePath := cctx.String("file-path")
 		dfsPath := cctx.String("dfs-path")
-		storePath := cctx.String("store")
 		rpcUrl := cctx.String("rpc-url")
 
-		c, err := client.NewClient(rpcUrl, storePath)
+		c, err := client.NewClient(rpcUrl)
 		if err != nil {
 			return err
 		}
@@ -43,20 +59,13 @@ var writeCmd = &cli.Command{
 			return err
 		}
 
-		newFileReply, err := c.CreateNewFile(dfsPath, int(fi.Size()))
+		newFileReply, err := c.CreateNewFile(dfsPath, int(fi.Size()), cctx.Int("replication"), cctx.Int("chunk-size"))
 		if err != nil {
 			return err
 		}
 
 		ctx := context.Background()
 
-		metadata := model.NewFileMetadata(dfsPath)
-		metadata.Chunks = newFileReply.Chunks
-		err = c.AddNewFileMetadata(ctx, dfsPath, metadata)
-		if err != nil {
-			return err
-		}
-
 		log.Infow("Created new file", "chunks", newFileReply.Chunks, "chunkServers", newFileReply.ChunkServerIDs)
 
 		content, err := os.ReadFile(filePath)
@@ -74,6 +83,16 @@ var writeCmd = &cli.Command{
 		}
 
 		log.Infow("Bytes written", "bytes", bw, "offset", 0)
+
+		if policy := cctx.String("erasure-coding"); policy != "" {
+			err = c.SetErasureCoding(dfsPath, policy)
+			if err != nil {
+				return err
+			}
+
+			log.Infow("File erasure coded", "policy", policy)
+		}
+
 		return nil
 	},
 }
@@ -82,28 +101,446 @@ var listCmd = &cli.Command{
 	Name:  "list",
 	Usage: "List all files",
 	Action: func(ctx *cli.Context) error {
-		storePath := ctx.String("store")
 		rpcUrl := ctx.String("rpc-url")
 
-		c, err := client.NewClient(rpcUrl, storePath)
+		c, err := client.NewClient(rpcUrl)
+		if err != nil {
+			return err
+		}
+
+		return c.ListDirectory(model.RootPath, true, func(entry master.FileStatus) error {
+			if !entry.IsDir {
+				fmt.Println(entry.Path)
+			}
+
+			return nil
+		})
+	},
+}
+
+var readCmd = &cli.Command{
+	Name:    "read",
+	Aliases: []string{"cat"},
+	Usage:   "Read file from dfs to stdout or local path",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "dfs-path",
+			Required: true,
+			Usage:    "Path of the file on dfs you want to read",
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "Local path to write file to, stdout is used if not set",
+		},
+		&cli.IntFlag{
+			Name:  "offset",
+			Value: 0,
+			Usage: "Offset in bytes to start reading from",
+		},
+		&cli.IntFlag{
+			Name:  "length",
+			Value: -1,
+			Usage: "Number of bytes to read, whole file is read if not set",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		dfsPath := cctx.String("dfs-path")
+		outPath := cctx.String("out")
+		offset := cctx.Int("offset")
+		length := cctx.Int("length")
+		rpcUrl := cctx.String("rpc-url")
+
+		c, err := client.NewClient(rpcUrl)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		fileInfo, err := c.GetFileInfo(dfsPath)
+		if err != nil {
+			return err
+		}
+
+		// appended data can extend past file size known to master, reading stops at the end of written data
+		chunkSize := fileInfo.ChunkSize
+		end := len(fileInfo.Chunks) * chunkSize
+		if length != -1 && offset+length < end {
+			end = offset + length
+		}
+
+		var out io.Writer = os.Stdout
+		if outPath != "" {
+			f, err := os.Create(outPath)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+			out = f
+		}
+
+		// stream file chunk by chunk so that whole file is never held in memory
+		for pos := offset; pos < end; {
+			n := end - pos
+			if maxRead := chunkSize - pos%chunkSize; n > maxRead {
+				n = maxRead
+			}
+
+			data, err := c.ReadFileAt(ctx, fileInfo, pos, n)
+			if err != nil {
+				return err
+			}
+
+			_, err = out.Write(data)
+			if err != nil {
+				return err
+			}
+
+			if len(data) < n {
+				break
+			}
+
+			pos += n
+		}
+
+		return nil
+	},
+}
+
+var appendCmd = &cli.Command{
+	Name:  "append",
+	Usage: "Atomically append record to the end of file on dfs",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "dfs-path",
+			Required: true,
+			Usage:    "Path of the file on dfs you want to append to",
+		},
+		&cli.StringFlag{
+			Name:  "file-path",
+			Usage: "Path to file holding the record, stdin is used if not set",
+		},
+		&cli.BoolFlag{
+			Name:  "create",
+			Usage: "Create file if it does not exist",
+		},
+		&cli.IntFlag{
+			Name:  "replication",
+			Usage: "Number of replicas kept of created file, default replication factor is used if not set",
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "Size of created file chunks in bytes, cluster default chunk size is used if not set",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		dfsPath := cctx.String("dfs-path")
+		filePath := cctx.String("file-path")
+		rpcUrl := cctx.String("rpc-url")
+
+		c, err := client.NewClient(rpcUrl)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		if _, err := c.Stat(dfsPath); err != nil && cctx.Bool("create") {
+			_, err = c.CreateNewFile(dfsPath, 0, cctx.Int("replication"), cctx.Int("chunk-size"))
+			if err != nil {
+				return err
+			}
+		}
+
+		var in io.Reader = os.Stdin
+		if filePath != "" {
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+			in = f
+		}
+
+		record, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+
+		offset, err := c.AppendRecord(ctx, dfsPath, record)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(offset)
+		return nil
+	},
+}
+
+var snapshotCmd = &cli.Command{
+	Name:      "snapshot",
+	Usage:     "Create copy-on-write snapshot of file or directory",
+	ArgsUsage: "<src> <dst>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 2 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		return c.Snapshot(context.Background(), cctx.Args().Get(0), cctx.Args().Get(1))
+	},
+}
+
+var mkdirCmd = &cli.Command{
+	Name:      "mkdir",
+	Usage:     "Create directory",
+	ArgsUsage: "<path>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "parents",
+			Aliases: []string{"p"},
+			Usage:   "Create parent directories as needed",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		return c.Mkdir(cctx.Args().First(), cctx.Bool("parents"))
+	},
+}
+
+var lsCmd = &cli.Command{
+	Name:      "ls",
+	Usage:     "List directory contents",
+	ArgsUsage: "[path]",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "List subdirectories recursively",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		path := model.RootPath
+		if cctx.NArg() > 0 {
+			path = cctx.Args().First()
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		return c.ListDirectory(path, cctx.Bool("recursive"), func(entry master.FileStatus) error {
+			printFileStatus(entry)
+			return nil
+		})
+	},
+}
+
+var statCmd = &cli.Command{
+	Name:      "stat",
+	Usage:     "Show file or directory status",
+	ArgsUsage: "<path>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		status, err := c.Stat(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		fileType := "file"
+		if status.IsDir {
+			fileType = "directory"
+		}
+
+		fmt.Printf("Path:       %s\n", status.Path)
+		fmt.Printf("Type:       %s\n", fileType)
+		fmt.Printf("Size:       %d\n", status.Size)
+		fmt.Printf("Chunks:     %d\n", status.NumChunks)
+		if !status.IsDir {
+			if status.ErasureCoding != "" {
+				fmt.Printf("Erasure:    %s\n", status.ErasureCoding)
+			} else {
+				fmt.Printf("Replicas:   %d\n", status.ReplicationFactor)
+			}
+			fmt.Printf("Chunk size: %d\n", status.ChunkSize)
+		}
+		fmt.Printf("Created:    %s\n", status.CreatedAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+var setrepCmd = &cli.Command{
+	Name:      "setrep",
+	Usage:     "Set replication factor of file or of all files under directory",
+	ArgsUsage: "<replication> <path>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 2 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		replicationFactor, err := strconv.Atoi(cctx.Args().Get(0))
+		if err != nil {
+			return err
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
 		if err != nil {
 			return err
 		}
 
-		cctx := context.Background()
+		files, err := c.SetReplication(cctx.Args().Get(1), replicationFactor)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Replication set to %d for %d files\n", replicationFactor, files)
+		return nil
+	},
+}
 
-		files, err := c.FileMetadataStore.All(cctx)
+var erasureCodeCmd = &cli.Command{
+	Name:      "erasure-code",
+	Usage:     "Convert replicated file into erasure coded file, e.g. erasure-code RS-6-3 /archive/logs",
+	ArgsUsage: "<policy> <path>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 2 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
 		if err != nil {
 			return err
 		}
 
-		for _, file := range files {
-			fmt.Println(file)
+		err = c.SetErasureCoding(cctx.Args().Get(1), cctx.Args().Get(0))
+		if err != nil {
+			return err
 		}
 
+		fmt.Printf("File %s erasure coded with %s\n", cctx.Args().Get(1), cctx.Args().Get(0))
 		return nil
 	},
 }
 
+func printFileStatus(entry master.FileStatus) {
+	fileType := "-"
+	if entry.IsDir {
+		fileType = "d"
+	}
+
+	fmt.Printf("%s %12d %s %s\n", fileType, entry.Size, entry.CreatedAt.Format(time.RFC3339), entry.Path)
+}
+
+var rmCmd = &cli.Command{
+	Name:      "rm",
+	Usage:     "Delete file or directory, deleted files can be restored from trash",
+	ArgsUsage: "<path>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Delete directory together with its contents",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		return c.DeleteFile(cctx.Args().First(), cctx.Bool("recursive"))
+	},
+}
 
-// TODO: Add delete command
+var trashCmd = &cli.Command{
+	Name:  "trash",
+	Usage: "Manage deleted files",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List deleted files that can be restored",
+			Action: func(cctx *cli.Context) error {
+				c, err := client.NewClient(cctx.String("rpc-url"))
+				if err != nil {
+					return err
+				}
+
+				files, err := c.ListTrash()
+				if err != nil {
+					return err
+				}
+
+				for _, f := range files {
+					fmt.Printf("%s %12d %s %s %s\n", f.ID, f.Size, f.DeletedAt.Format(time.RFC3339), f.ExpiresAt.Format(time.RFC3339), f.Path)
+				}
+
+				return nil
+			},
+		},
+	},
+}
+
+var restoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "Restore deleted file from trash",
+	ArgsUsage: "<path>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "id",
+			Usage: "ID of deleted file to restore, most recently deleted file from path is restored if not set",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		var id uuid.UUID
+		if cctx.IsSet("id") {
+			parsed, err := uuid.Parse(cctx.String("id"))
+			if err != nil {
+				return err
+			}
+
+			id = parsed
+		} else if cctx.NArg() != 1 {
+			return cli.ShowSubcommandHelp(cctx)
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		reply, err := c.Undelete(cctx.Args().First(), id)
+		if err != nil {
+			return err
+		}
+
+		log.Infow("Restored file", "path", reply.Path, "id", reply.ID)
+		return nil
+	},
+}
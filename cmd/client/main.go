@@ -12,6 +12,17 @@ func main() {
     local := []*cli.Command{
         writeCmd,
         listCmd,
+        readCmd,
+        appendCmd,
+        mkdirCmd,
+        lsCmd,
+        statCmd,
+        rmCmd,
+        trashCmd,
+        restoreCmd,
+        snapshotCmd,
+        setrepCmd,
+        erasureCodeCmd,
     }
 
 	app := &cli.App{
@@ -24,11 +35,6 @@ func main() {
                 Name: "rpc-url",
                 Value: "localhost:1234",
                 Usage: "Master rpc address",
-            },
-            &cli.StringFlag{
-                Name: "store",
-                Value: ".client",
-                Usage: "Path where chunk metadata is persisted at",
             },
 		},
 	}
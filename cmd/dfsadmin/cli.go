@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/client"
+	"github.com/pyropy/dfs/rpc/master"
+	"github.com/urfave/cli/v2"
+)
+
+var balanceCmd = &cli.Command{
+	Name:  "balance",
+	Usage: "Move chunks from overfull to underused chunk servers",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "start",
+			Usage: "Start rebalancer",
+			Action: func(cctx *cli.Context) error {
+				return balance(cctx, master.BalanceStart)
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "Stop rebalancer, moves in progress are finished",
+			Action: func(cctx *cli.Context) error {
+				return balance(cctx, master.BalanceStop)
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Show whether rebalancer is running",
+			Action: func(cctx *cli.Context) error {
+				return balance(cctx, master.BalanceStatus)
+			},
+		},
+	},
+}
+
+func balance(cctx *cli.Context, action master.BalanceAction) error {
+	c, err := client.NewClient(cctx.String("rpc-url"))
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.Balance(action)
+	if err != nil {
+		return err
+	}
+
+	state := "stopped"
+	if reply.Running {
+		state = "running"
+	}
+
+	fmt.Printf("Rebalancer: %s\nMoved:      %d chunks\n", state, reply.MovedChunks)
+	return nil
+}
+
+var decommissionCmd = &cli.Command{
+	Name:      "decommission",
+	Usage:     "Drain chunk server so that it can be retired",
+	ArgsUsage: "<chunk-server-id>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return fmt.Errorf("expected chunk server ID")
+		}
+
+		chunkServerID, err := uuid.Parse(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		c, err := client.NewClient(cctx.String("rpc-url"))
+		if err != nil {
+			return err
+		}
+
+		progress, err := c.Decommission(chunkServerID)
+		if err != nil {
+			return err
+		}
+
+		printDecommissionProgress([]master.DecommissionProgress{*progress})
+		return nil
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "status",
+			Usage:     "Show decommissioning progress of chunk server or of all chunk servers",
+			ArgsUsage: "[chunk-server-id]",
+			Action: func(cctx *cli.Context) error {
+				chunkServerID := uuid.Nil
+				if cctx.NArg() > 0 {
+					var err error
+					chunkServerID, err = uuid.Parse(cctx.Args().First())
+					if err != nil {
+						return err
+					}
+				}
+
+				c, err := client.NewClient(cctx.String("rpc-url"))
+				if err != nil {
+					return err
+				}
+
+				chunkServers, err := c.DecommissionStatus(chunkServerID)
+				if err != nil {
+					return err
+				}
+
+				printDecommissionProgress(chunkServers)
+				return nil
+			},
+		},
+	},
+}
+
+func printDecommissionProgress(chunkServers []master.DecommissionProgress) {
+	fmt.Printf("%-36s  %-21s  %-14s  %8s  %8s\n", "ID", "ADDRESS", "STATE", "CHUNKS", "PENDING")
+	for _, cs := range chunkServers {
+		state := "in service"
+		switch {
+		case cs.Decommissioned:
+			state = "decommissioned"
+		case cs.Draining:
+			state = "draining"
+		case !cs.Active:
+			state = "inactive"
+		}
+
+		fmt.Printf("%-36s  %-21s  %-14s  %8d  %8d\n", cs.ChunkServerID, cs.Address, state, cs.Chunks, cs.PendingChunks)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pyropy/dfs/lib/logger"
+	"github.com/urfave/cli/v2"
+)
+
+var log, _ = logger.New("dfsadmin")
+
+func main() {
+	app := &cli.App{
+		Name:    "dfsadmin",
+		Usage:   "Cluster administration",
+		Version: "0.0.1",
+		Commands: []*cli.Command{
+			balanceCmd,
+			decommissionCmd,
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "rpc-url",
+				Value: "localhost:1234",
+				Usage: "Master rpc address",
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+		return
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/constants"
 	core "github.com/pyropy/dfs/core/master"
 	"github.com/pyropy/dfs/core/model"
@@ -19,17 +20,28 @@ func NewMasterAPI(master *core.Master) *API {
 
 func (a *API) RegisterChunkServer(args *rpc.RegisterArgs, reply *rpc.RegisterReply) error {
 	log.Infow("rpc", "event", "RegisterChunkServer", "args", args)
-	chunkServer := a.server.RegisterNewChunkServer(args.Address)
+	topology := core.Topology{Zone: args.Zone, Rack: args.Rack}
+	chunkServer, err := a.server.RegisterChunkServer(args.ClusterID, args.ChunkServerID, args.Address, topology)
+	if err != nil {
+		return err
+	}
+
 	reply.ID = chunkServer.ID
+	reply.ClusterID = a.server.ClusterID()
 
-	log.Infow("rpc", "status", "registered new chunk server", "id", chunkServer.ID, "address", chunkServer.Address)
+	log.Infow("rpc", "status", "registered chunk server", "id", chunkServer.ID, "address", chunkServer.Address)
 
 	return nil
 }
 
 func (a *API) CreateNewFile(args *rpc.CreateNewFileArgs, reply *rpc.CreateNewFileReply) error {
 	log.Infow("rpc", "event", "CreateNewFile", "args", args)
-	file, chunkServerIds, err := a.server.CreateNewFile(args.Path, args.Size, constants.REPLICATION_FACTOR, constants.CHUNK_SIZE_BYTES)
+	replicationFactor := args.ReplicationFactor
+	if replicationFactor == 0 {
+		replicationFactor = constants.REPLICATION_FACTOR
+	}
+
+	file, chunkServerIds, err := a.server.CreateNewFile(args.Path, args.Size, replicationFactor, args.ChunkSize)
 	if err != nil {
 		return err
 	}
@@ -41,6 +53,37 @@ func (a *API) CreateNewFile(args *rpc.CreateNewFileArgs, reply *rpc.CreateNewFil
 
 func (a *API) DeleteFile(args *rpc.DeleteFileArgs, reply *rpc.DeleteFileReply) error {
 	log.Infow("rpc", "event", "DeleteFile", "args", args)
+	return a.server.DeleteFile(args.Path, args.Recursive)
+}
+
+func (a *API) Undelete(args *rpc.UndeleteArgs, reply *rpc.UndeleteReply) error {
+	log.Infow("rpc", "event", "Undelete", "args", args)
+	file, err := a.server.Undelete(args.Path, args.ID)
+	if err != nil {
+		return err
+	}
+
+	reply.Path = file.Path
+	reply.ID = file.ID
+	return nil
+}
+
+func (a *API) ListTrash(args *rpc.ListTrashArgs, reply *rpc.ListTrashReply) error {
+	log.Infow("rpc", "event", "ListTrash", "args", args)
+	files := a.server.ListTrash()
+
+	reply.Files = make([]rpc.TrashedFile, 0, len(files))
+	for _, f := range files {
+		trashedFile := rpc.TrashedFile{
+			ID:        f.ID,
+			Path:      f.Path,
+			Size:      f.Size,
+			DeletedAt: f.DeletedAt,
+			ExpiresAt: f.DeletedAt.Add(core.FileDeletionThreshold),
+		}
+		reply.Files = append(reply.Files, trashedFile)
+	}
+
 	return nil
 }
 
@@ -57,20 +100,135 @@ func (a *API) RequestLeaseRenewal(args *rpc.RequestLeaseRenewalArgs, reply *rpc.
 
 	reply.Granted = true
 	reply.ChunkID = lease.ChunkID
-	reply.ValidUntil = lease.ValidUntil
+	reply.ValidFor = core.ChunkServerLeaseDuration(lease)
+	reply.Epoch = lease.Epoch
 	return nil
 }
 
 func (a *API) RequestWrite(args *rpc.RequestWriteArgs, reply *rpc.RequestWriteReply) error {
 	log.Infow("rpc", "event", "RequestWrite", "args", args)
-	var chunkServers []rpc.ChunkServer
-	chunkID, lease, chunkHolders, chunkVersion, err := a.server.RequestWrite(args.ChunkID)
+	chunkID, lease, chunkHolders, chunkVersion, err := a.server.RequestWrite(args.Path, args.ChunkID)
 	if err != nil {
 		return err
 	}
 
 	log.Infow("request write", "chunkID", chunkID, "lease", lease, "chunkHolders", chunkHolders, "chunkVersion", chunkVersion, "err", err)
 
+	fillRequestWriteReply(reply, chunkID, lease, chunkHolders, chunkVersion)
+
+	return nil
+}
+
+func (a *API) RequestRecordAppend(args *rpc.RequestRecordAppendArgs, reply *rpc.RequestRecordAppendReply) error {
+	log.Infow("rpc", "event", "RequestRecordAppend", "args", args)
+	chunk, chunkID, lease, chunkHolders, chunkVersion, err := a.server.RequestRecordAppend(args.Path)
+	if err != nil {
+		return err
+	}
+
+	fillRequestWriteReply(&reply.RequestWriteReply, chunkID, lease, chunkHolders, chunkVersion)
+	reply.ChunkIndex = chunk.Index
+	reply.ChunkSize = chunk.Size
+
+	return nil
+}
+
+func (a *API) AllocateChunk(args *rpc.AllocateChunkArgs, reply *rpc.AllocateChunkReply) error {
+	log.Infow("rpc", "event", "AllocateChunk", "args", args)
+	chunk, err := a.server.AllocateChunk(args.Path, args.ChunkIndex)
+	if err != nil {
+		return err
+	}
+
+	reply.ChunkID = chunk.ID
+	reply.ChunkIndex = chunk.Index
+
+	return nil
+}
+
+func (a *API) Snapshot(args *rpc.SnapshotArgs, reply *rpc.SnapshotReply) error {
+	log.Infow("rpc", "event", "Snapshot", "args", args)
+	return a.server.Snapshot(args.SrcPath, args.DstPath)
+}
+
+func (a *API) SetReplication(args *rpc.SetReplicationArgs, reply *rpc.SetReplicationReply) error {
+	log.Infow("rpc", "event", "SetReplication", "args", args)
+	files, err := a.server.SetReplication(args.Path, args.ReplicationFactor)
+	if err != nil {
+		return err
+	}
+
+	reply.Files = files
+	return nil
+}
+
+func (a *API) SetErasureCoding(args *rpc.SetErasureCodingArgs, _ *rpc.SetErasureCodingReply) error {
+	log.Infow("rpc", "event", "SetErasureCoding", "args", args)
+	ec, err := model.ParseErasureCoding(args.Policy)
+	if err != nil {
+		return err
+	}
+
+	return a.server.SetErasureCoding(args.Path, ec)
+}
+
+func (a *API) Balance(args *rpc.BalanceArgs, reply *rpc.BalanceReply) error {
+	log.Infow("rpc", "event", "Balance", "args", args)
+	switch args.Action {
+	case rpc.BalanceStart:
+		a.server.StartBalancing()
+	case rpc.BalanceStop:
+		a.server.StopBalancing()
+	}
+
+	reply.Running, reply.MovedChunks = a.server.BalancingStatus()
+	return nil
+}
+
+func (a *API) Decommission(args *rpc.DecommissionArgs, reply *rpc.DecommissionReply) error {
+	log.Infow("rpc", "event", "Decommission", "args", args)
+	progress, err := a.server.Decommission(args.ChunkServerID)
+	if err != nil {
+		return err
+	}
+
+	reply.Progress = toDecommissionProgress(progress)
+	return nil
+}
+
+func (a *API) DecommissionStatus(args *rpc.DecommissionStatusArgs, reply *rpc.DecommissionStatusReply) error {
+	log.Infow("rpc", "event", "DecommissionStatus", "args", args)
+	if args.ChunkServerID == uuid.Nil {
+		for _, progress := range a.server.DecommissionStatuses() {
+			reply.ChunkServers = append(reply.ChunkServers, toDecommissionProgress(&progress))
+		}
+
+		return nil
+	}
+
+	progress, err := a.server.DecommissionStatus(args.ChunkServerID)
+	if err != nil {
+		return err
+	}
+
+	reply.ChunkServers = []rpc.DecommissionProgress{toDecommissionProgress(progress)}
+	return nil
+}
+
+func toDecommissionProgress(progress *core.DecommissionProgress) rpc.DecommissionProgress {
+	return rpc.DecommissionProgress{
+		ChunkServerID:  progress.ChunkServer.ID,
+		Address:        progress.ChunkServer.Address,
+		Active:         progress.ChunkServer.Active,
+		Draining:       progress.ChunkServer.Draining,
+		Decommissioned: progress.ChunkServer.Decommissioned,
+		Chunks:         progress.Chunks,
+		PendingChunks:  progress.PendingChunks,
+	}
+}
+
+func fillRequestWriteReply(reply *rpc.RequestWriteReply, chunkID uuid.UUID, lease *model.Lease, chunkHolders []*core.ChunkServerMetadata, chunkVersion int) {
+	var chunkServers []rpc.ChunkServer
 	for _, chunkHolder := range chunkHolders {
 		chunkServer := rpc.ChunkServer{
 			ID:      chunkHolder.ID,
@@ -84,11 +242,76 @@ func (a *API) RequestWrite(args *rpc.RequestWriteArgs, reply *rpc.RequestWriteRe
 	reply.ValidUntil = lease.ValidUntil
 	reply.ChunkServers = chunkServers
 	reply.Version = chunkVersion
+}
+
+func (a *API) GetFileInfo(args *rpc.GetFileInfoArgs, reply *rpc.GetFileInfoReply) error {
+	log.Infow("rpc", "event", "GetFileInfo", "args", args)
+	file, locations, err := a.server.GetFileInfo(args.Path)
+	if err != nil {
+		return err
+	}
+
+	reply.ID = file.ID
+	reply.Path = file.Path
+	reply.Size = file.Size
+	reply.ChunkSize = file.ChunkSizeBytes()
+	reply.CreatedAt = file.CreatedAt
+	reply.Chunks = toChunkLocations(locations)
+
+	if file.ErasureCoding.Enabled() {
+		stripes, err := a.server.GetStripeLocations(file)
+		if err != nil {
+			return err
+		}
+
+		reply.DataShards = file.ErasureCoding.DataShards
+		reply.ParityShards = file.ErasureCoding.ParityShards
+		for _, stripe := range stripes {
+			reply.Stripes = append(reply.Stripes, rpc.StripeLocation{
+				Chunks:  toChunkLocations(stripe.Chunks),
+				Lengths: stripe.Lengths,
+			})
+		}
+	}
 
 	return nil
 }
 
-// TODO: Catch stale chunks
+func (a *API) GetChunkLocations(args *rpc.GetChunkLocationsArgs, reply *rpc.GetChunkLocationsReply) error {
+	log.Infow("rpc", "event", "GetChunkLocations", "args", args)
+	locations, err := a.server.GetChunkLocations(args.ChunkIDs)
+	if err != nil {
+		return err
+	}
+
+	reply.Chunks = toChunkLocations(locations)
+
+	return nil
+}
+
+func toChunkLocations(locations []core.ChunkLocation) []rpc.ChunkLocation {
+	chunks := make([]rpc.ChunkLocation, 0, len(locations))
+	for _, location := range locations {
+		chunkServers := make([]rpc.ChunkServer, 0, len(location.Holders))
+		for _, chunkHolder := range location.Holders {
+			chunkServer := rpc.ChunkServer{
+				ID:      chunkHolder.ID,
+				Address: chunkHolder.Address,
+			}
+			chunkServers = append(chunkServers, chunkServer)
+		}
+
+		chunks = append(chunks, rpc.ChunkLocation{
+			ChunkID:      location.Chunk.ID,
+			Index:        location.Chunk.Index,
+			Version:      location.Chunk.Version,
+			ChunkServers: chunkServers,
+		})
+	}
+
+	return chunks
+}
+
 func (a *API) ReportHealth(args *rpc.ReportHealthArgs, _ *rpc.ReportHealthReply) error {
 	log.Infow("rpc", "event", "ReportHealth", "args", args)
 	var chunks []model.ChunkMetadata
@@ -105,8 +328,51 @@ func (a *API) ReportHealth(args *rpc.ReportHealthArgs, _ *rpc.ReportHealthReply)
 		chunks = append(chunks, metadata)
 	}
 
-	a.server.MarkHealthy(args.ChunkServerID)
-	a.server.UpdateChunksLocation(args.ChunkServerID, chunks)
+	// Chunk server registered with previous master instance has to register again
+	chunkServer := a.server.MarkHealthy(args.ChunkServerID)
+	if chunkServer == nil {
+		return rpc.ErrChunkServerNotRegistered
+	}
+
+	a.server.UpdateUsage(args.ChunkServerID, core.Usage(args.Usage))
+	a.server.ReportChunks(args.ChunkServerID, chunks)
+
+	return nil
+}
+
+func (a *API) ReportBadChunk(args *rpc.ReportBadChunkArgs, _ *rpc.ReportBadChunkReply) error {
+	log.Infow("rpc", "event", "ReportBadChunk", "args", args)
+	return a.server.ReportBadChunk(args.ChunkServerID, args.ChunkID)
+}
+
+func (a *API) Mkdir(args *rpc.MkdirArgs, _ *rpc.MkdirReply) error {
+	log.Infow("rpc", "event", "Mkdir", "args", args)
+	return a.server.Mkdir(args.Path, args.Parents)
+}
+
+func (a *API) ListDirectory(args *rpc.ListDirectoryArgs, reply *rpc.ListDirectoryReply) error {
+	log.Infow("rpc", "event", "ListDirectory", "args", args)
+	entries, hasMore, err := a.server.ListDirectory(args.Path, args.StartAfter, args.Limit, args.Recursive)
+	if err != nil {
+		return err
+	}
+
+	reply.Entries = make([]rpc.FileStatus, 0, len(entries))
+	for _, entry := range entries {
+		reply.Entries = append(reply.Entries, rpc.FileStatus(entry))
+	}
+
+	reply.HasMore = hasMore
+	return nil
+}
+
+func (a *API) Stat(args *rpc.StatArgs, reply *rpc.StatReply) error {
+	log.Infow("rpc", "event", "Stat", "args", args)
+	status, err := a.server.Stat(args.Path)
+	if err != nil {
+		return err
+	}
 
+	reply.FileStatus = rpc.FileStatus(*status)
 	return nil
 }
@@ -24,10 +24,23 @@ func run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	master := masterCore.NewMaster()
+	cfg, err := masterCore.GetConfig()
+	if err != nil {
+		log.Errorw("startup", "error", "config error")
+		return err
+	}
+
+	master, err := masterCore.NewMaster(cfg)
+	if err != nil {
+		log.Errorw("startup", "error", "failed to recover master state")
+		return err
+	}
+
+	defer master.Close()
+
 	masterAPI := NewMasterAPI(master)
 
-	err := rpc.Register(masterAPI)
+	err = rpc.RegisterName("MasterAPI", masterAPI)
 	if err != nil {
 		log.Errorw("startup", "error", "failed to register rpc api")
 		return err
@@ -53,9 +66,21 @@ func run() error {
 	log.Infow("startup", "status", "starting replication monitor")
 	go master.StartReplicationMonitor(ctx)
 
+	log.Infow("startup", "status", "starting rebalancer")
+	go master.StartRebalancer(ctx)
+
+	log.Infow("startup", "status", "starting stripe repairer")
+	go master.StartStripeRepairer(ctx)
+
+	log.Infow("startup", "status", "starting decommissioner")
+	go master.StartDecommissioner(ctx)
+
 	log.Infow("startup", "status", "starting garbage collection")
 	go master.StartGC(ctx)
 
+	log.Infow("startup", "status", "starting checkpointer")
+	go master.StartCheckpointer(ctx)
+
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 	<-shutdown
@@ -0,0 +1,199 @@
+package chunkserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+	rpcChunkServer "github.com/pyropy/dfs/rpc/chunkserver"
+)
+
+const (
+	// ChecksumBlockSize is size of the chunk block covered by single checksum
+	ChecksumBlockSize = 64 << 10
+
+	chunkSuffix    = ".chunk"
+	checksumSuffix = ".crc"
+	checksumSize   = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkCorruptionError is returned when chunk block does not match its stored checksum
+// or when checksums of the chunk are missing
+type ChunkCorruptionError struct {
+	ChunkID uuid.UUID
+	Block   int // -1 if checksums are missing
+}
+
+func (e *ChunkCorruptionError) Error() string {
+	if e.Block < 0 {
+		return fmt.Sprintf("%s: chunk %s checksums missing", rpcChunkServer.ErrChunkCorrupted, e.ChunkID)
+	}
+
+	return fmt.Sprintf("%s: chunk %s block %d", rpcChunkServer.ErrChunkCorrupted, e.ChunkID, e.Block)
+}
+
+func (e *ChunkCorruptionError) Is(target error) bool {
+	return target == rpcChunkServer.ErrChunkCorrupted
+}
+
+// GetChecksumPath returns path of the sidecar file holding block checksums of the chunk
+func GetChecksumPath(chunkPath string) string {
+	return strings.TrimSuffix(chunkPath, chunkSuffix) + checksumSuffix
+}
+
+// blockRange returns indexes of the first and the last block covering given byte range
+func blockRange(offset, length int64) (int64, int64) {
+	return offset / ChecksumBlockSize, (offset + length - 1) / ChecksumBlockSize
+}
+
+// chunkBlocks returns number of blocks chunk has once it is full
+func chunkBlocks(chunk *model.Chunk) int64 {
+	return (int64(chunk.Size) + ChecksumBlockSize - 1) / ChecksumBlockSize
+}
+
+// loadChecksums reads block checksums of the chunk. Data of chunk whose checksums are lost
+// can not be trusted, so missing checksums are reported as corruption.
+func loadChecksums(chunk *model.Chunk) ([]uint32, error) {
+	b, err := os.ReadFile(GetChecksumPath(chunk.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &ChunkCorruptionError{ChunkID: chunk.ID, Block: -1}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := make([]uint32, len(b)/checksumSize)
+	for i := range checksums {
+		checksums[i] = binary.BigEndian.Uint32(b[i*checksumSize:])
+	}
+
+	return checksums, nil
+}
+
+// updateChecksums recomputes checksums of chunk blocks from fromBlock up to, not including, toBlock.
+// Checksums of other blocks are kept, except checksums of blocks past the end of the chunk which are dropped.
+func updateChecksums(chunk *model.Chunk, f *os.File, fromBlock, toBlock int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	sf, err := os.OpenFile(GetChecksumPath(chunk.Path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer sf.Close()
+
+	numBlocks := (fi.Size() + ChecksumBlockSize - 1) / ChecksumBlockSize
+	if toBlock > numBlocks {
+		toBlock = numBlocks
+	}
+
+	block := make([]byte, ChecksumBlockSize)
+	sums := make([]byte, 0)
+
+	for i := fromBlock; i < toBlock; i++ {
+		n, err := f.ReadAt(block, i*ChecksumBlockSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		sum := make([]byte, checksumSize)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum(block[:n], castagnoli))
+		sums = append(sums, sum...)
+	}
+
+	_, err = sf.WriteAt(sums, fromBlock*checksumSize)
+	if err != nil {
+		return err
+	}
+
+	err = sf.Truncate(numBlocks * checksumSize)
+	if err != nil {
+		return err
+	}
+
+	return sf.Sync()
+}
+
+// readVerified reads length bytes of the chunk starting at offset, verifying checksum of every block read.
+// Reading past the end of chunk data returns only the bytes available.
+func readVerified(chunk *model.Chunk, f *os.File, offset, length int64) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	end := offset + length
+	if end > fi.Size() {
+		end = fi.Size()
+	}
+
+	if offset >= end {
+		return []byte{}, nil
+	}
+
+	checksums, err := loadChecksums(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	firstBlock, lastBlock := blockRange(offset, end-offset)
+	start := firstBlock * ChecksumBlockSize
+	data := make([]byte, (lastBlock-firstBlock+1)*ChecksumBlockSize)
+	n, err := f.ReadAt(data, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	data = data[:n]
+	for i := firstBlock; i <= lastBlock; i++ {
+		blockStart := (i - firstBlock) * ChecksumBlockSize
+		blockEnd := blockStart + ChecksumBlockSize
+		if blockEnd > int64(len(data)) {
+			blockEnd = int64(len(data))
+		}
+
+		if i >= int64(len(checksums)) || crc32.Checksum(data[blockStart:blockEnd], castagnoli) != checksums[i] {
+			return nil, &ChunkCorruptionError{ChunkID: chunk.ID, Block: int(i)}
+		}
+	}
+
+	return data[offset-start : end-start], nil
+}
+
+// verifyEdgeBlocks verifies blocks that are only partially overwritten by write of given range,
+// so that corruption of the rest of the block is not hidden by recomputed checksum
+func verifyEdgeBlocks(chunk *model.Chunk, f *os.File, offset, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	firstBlock, lastBlock := blockRange(offset, length)
+	endsWithinBlock := (offset+length)%ChecksumBlockSize != 0
+	if offset%ChecksumBlockSize != 0 || (firstBlock == lastBlock && endsWithinBlock) {
+		_, err := readVerified(chunk, f, firstBlock*ChecksumBlockSize, ChecksumBlockSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if lastBlock != firstBlock && endsWithinBlock {
+		_, err := readVerified(chunk, f, lastBlock*ChecksumBlockSize, ChecksumBlockSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
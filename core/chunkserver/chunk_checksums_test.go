@@ -0,0 +1,262 @@
+package chunkserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+	rpcChunkServer "github.com/pyropy/dfs/rpc/chunkserver"
+)
+
+const (
+	testChunkBlocks  = 4
+	testChunkSize    = testChunkBlocks * ChecksumBlockSize
+	testChunkVersion = 1
+)
+
+// newTestChunk creates empty chunk in chunk service storing chunks in temporary directory
+func newTestChunk(t *testing.T) (*ChunkService, *model.Chunk) {
+	t.Helper()
+
+	cfg := &Config{}
+	cfg.Chunks.Path = t.TempDir()
+	service := NewChunkService(cfg)
+
+	chunk, err := service.CreateChunk(uuid.New(), "/file", 0, testChunkVersion, testChunkSize)
+	if err != nil {
+		t.Fatalf("create chunk: %v", err)
+	}
+
+	return service, chunk
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rng.Read(data)
+	return data
+}
+
+func writeChunk(t *testing.T, service *ChunkService, chunkID uuid.UUID, data []byte, offset int) {
+	t.Helper()
+
+	n, err := service.WriteChunkBytes(chunkID, data, offset, testChunkVersion)
+	if err != nil {
+		t.Fatalf("write %d bytes at %d: %v", len(data), offset, err)
+	}
+
+	if n != len(data) {
+		t.Fatalf("wrote %d bytes at %d, want %d", n, offset, len(data))
+	}
+}
+
+// checkChecksums compares checksums stored on disk with checksums of blocks of expected chunk data
+func checkChecksums(t *testing.T, chunk *model.Chunk, want []byte) {
+	t.Helper()
+
+	b, err := os.ReadFile(GetChecksumPath(chunk.Path))
+	if err != nil {
+		t.Fatalf("read checksums: %v", err)
+	}
+
+	blocks := (len(want) + ChecksumBlockSize - 1) / ChecksumBlockSize
+	if len(b) != blocks*checksumSize {
+		t.Fatalf("checksums hold %d blocks, want %d", len(b)/checksumSize, blocks)
+	}
+
+	for i := 0; i < blocks; i++ {
+		end := (i + 1) * ChecksumBlockSize
+		if end > len(want) {
+			end = len(want)
+		}
+
+		sum := crc32.Checksum(want[i*ChecksumBlockSize:end], castagnoli)
+		if got := binary.BigEndian.Uint32(b[i*checksumSize:]); got != sum {
+			t.Fatalf("checksum of block %d is %x, want %x", i, got, sum)
+		}
+	}
+}
+
+// flipChunkByte inverts byte of chunk data on disk without updating its checksum
+func flipChunkByte(t *testing.T, chunk *model.Chunk, offset int64) {
+	t.Helper()
+
+	f, err := os.OpenFile(chunk.Path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("open chunk: %v", err)
+	}
+
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	if err == nil {
+		b[0] ^= 0xff
+		_, err = f.WriteAt(b, offset)
+	}
+
+	if err != nil {
+		t.Fatalf("flip byte at %d: %v", offset, err)
+	}
+}
+
+func corruptedBlock(t *testing.T, err error) int {
+	t.Helper()
+
+	var corruption *ChunkCorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("got %v, want chunk corruption error", err)
+	}
+
+	if !errors.Is(err, rpcChunkServer.ErrChunkCorrupted) {
+		t.Fatalf("corruption error %v does not match %v", err, rpcChunkServer.ErrChunkCorrupted)
+	}
+
+	return corruption.Block
+}
+
+func TestUnalignedWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		length int
+	}{
+		{"within first block", 100, 1000},
+		{"up to block edge", ChecksumBlockSize - 10, 10},
+		{"across block edge", ChecksumBlockSize - 10, 20},
+		{"across several blocks", ChecksumBlockSize/2 + 1, 2 * ChecksumBlockSize},
+		{"aligned single block", ChecksumBlockSize, ChecksumBlockSize},
+		{"past the end leaving gap", 3*ChecksumBlockSize + 7, 100},
+		{"single byte at block start", 2 * ChecksumBlockSize, 1},
+		{"into last block from previous", 3*ChecksumBlockSize - 1, 2},
+	}
+
+	service, chunk := newTestChunk(t)
+	rng := rand.New(rand.NewSource(1))
+	want := make([]byte, 0)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(rng, tt.length)
+			writeChunk(t, service, chunk.ID, data, tt.offset)
+
+			if end := tt.offset + tt.length; end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+
+			copy(want[tt.offset:], data)
+			checkChecksums(t, chunk, want)
+
+			got, err := service.ReadChunk(chunk.ID, 0, -1)
+			if err != nil {
+				t.Fatalf("read chunk: %v", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Fatalf("chunk data differs from written data")
+			}
+
+			got, err = service.ReadChunk(chunk.ID, tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("read written range: %v", err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("written range differs from written data")
+			}
+		})
+	}
+}
+
+func TestReadPastEnd(t *testing.T) {
+	service, chunk := newTestChunk(t)
+	data := randomBytes(rand.New(rand.NewSource(2)), ChecksumBlockSize+10)
+	writeChunk(t, service, chunk.ID, data, 0)
+
+	got, err := service.ReadChunk(chunk.ID, ChecksumBlockSize, ChecksumBlockSize)
+	if err != nil {
+		t.Fatalf("read past end: %v", err)
+	}
+
+	if !bytes.Equal(got, data[ChecksumBlockSize:]) {
+		t.Fatalf("read past end returned %d bytes, want %d", len(got), 10)
+	}
+
+	got, err = service.ReadChunk(chunk.ID, len(data)+1, 10)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("read after end: got %d bytes and %v, want no bytes", len(got), err)
+	}
+}
+
+func TestFlippedByteIsReportedWithBlock(t *testing.T) {
+	service, chunk := newTestChunk(t)
+	data := randomBytes(rand.New(rand.NewSource(3)), 3*ChecksumBlockSize+100)
+	writeChunk(t, service, chunk.ID, data, 0)
+
+	flipChunkByte(t, chunk, 2*ChecksumBlockSize+123)
+
+	_, err := service.ReadChunk(chunk.ID, 0, -1)
+	if block := corruptedBlock(t, err); block != 2 {
+		t.Fatalf("corrupted block %d, want 2", block)
+	}
+
+	// blocks other than the corrupted one are still readable
+	got, err := service.ReadChunk(chunk.ID, 10, 2*ChecksumBlockSize-20)
+	if err != nil {
+		t.Fatalf("read intact blocks: %v", err)
+	}
+
+	if !bytes.Equal(got, data[10:2*ChecksumBlockSize-10]) {
+		t.Fatalf("intact blocks differ from written data")
+	}
+
+	got, err = service.ReadChunk(chunk.ID, 3*ChecksumBlockSize, 100)
+	if err != nil || !bytes.Equal(got, data[3*ChecksumBlockSize:]) {
+		t.Fatalf("read block after corrupted one: %v", err)
+	}
+
+	// partial overwrite would hide corruption of the rest of the block under new checksum
+	_, err = service.WriteChunkBytes(chunk.ID, []byte("abc"), 2*ChecksumBlockSize+10, testChunkVersion)
+	if block := corruptedBlock(t, err); block != 2 {
+		t.Fatalf("corrupted block %d on partial overwrite, want 2", block)
+	}
+
+	// overwrite of the whole block replaces corrupted data
+	block := randomBytes(rand.New(rand.NewSource(4)), ChecksumBlockSize)
+	writeChunk(t, service, chunk.ID, block, 2*ChecksumBlockSize)
+	copy(data[2*ChecksumBlockSize:], block)
+
+	got, err = service.ReadChunk(chunk.ID, 0, -1)
+	if err != nil {
+		t.Fatalf("read overwritten chunk: %v", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("overwritten chunk differs from written data")
+	}
+}
+
+func TestMissingChecksums(t *testing.T) {
+	service, chunk := newTestChunk(t)
+	writeChunk(t, service, chunk.ID, randomBytes(rand.New(rand.NewSource(5)), 1000), 0)
+
+	err := os.Remove(GetChecksumPath(chunk.Path))
+	if err != nil {
+		t.Fatalf("remove checksums: %v", err)
+	}
+
+	_, err = service.ReadChunk(chunk.ID, 0, -1)
+	if block := corruptedBlock(t, err); block != -1 {
+		t.Fatalf("corrupted block %d, want -1", block)
+	}
+
+	_, err = service.WriteChunkBytes(chunk.ID, []byte("abc"), 10, testChunkVersion)
+	if block := corruptedBlock(t, err); block != -1 {
+		t.Fatalf("corrupted block %d on partial overwrite, want -1", block)
+	}
+}
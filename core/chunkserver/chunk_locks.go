@@ -0,0 +1,63 @@
+package chunkserver
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type chunkLock struct {
+	sync.Mutex
+	refs int
+}
+
+// ChunkLocks manages per chunk locks, so that mutations of one chunk are serialized
+// without blocking mutations of other chunks
+type ChunkLocks struct {
+	lock  sync.Mutex
+	locks map[uuid.UUID]*chunkLock
+}
+
+func NewChunkLocks() *ChunkLocks {
+	return &ChunkLocks{
+		locks: make(map[uuid.UUID]*chunkLock),
+	}
+}
+
+// Lock acquires lock of given chunk. Returned function releases it.
+func (cl *ChunkLocks) Lock(chunkID uuid.UUID) func() {
+	l := cl.acquire(chunkID)
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+		cl.release(chunkID)
+	}
+}
+
+// acquire returns lock for given chunk registering interest in it
+func (cl *ChunkLocks) acquire(chunkID uuid.UUID) *chunkLock {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	l, exists := cl.locks[chunkID]
+	if !exists {
+		l = &chunkLock{}
+		cl.locks[chunkID] = l
+	}
+
+	l.refs++
+	return l
+}
+
+// release drops interest in chunk lock removing it once nobody uses it
+func (cl *ChunkLocks) release(chunkID uuid.UUID) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	l := cl.locks[chunkID]
+	l.refs--
+	if l.refs == 0 {
+		delete(cl.locks, chunkID)
+	}
+}
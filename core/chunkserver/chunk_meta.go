@@ -0,0 +1,78 @@
+package chunkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	fp "path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/constants"
+	"github.com/pyropy/dfs/core/model"
+)
+
+const metaSuffix = ".meta"
+
+// chunkMeta holds chunk attributes that are not encoded in chunk filename
+type chunkMeta struct {
+	Size int
+}
+
+// GetChunkMetaPath returns path of the sidecar file holding attributes of the chunk.
+// Sidecar is shared by all versions of the chunk so it is not renamed when version changes.
+func GetChunkMetaPath(chunkPath string, chunkID uuid.UUID) string {
+	return fp.Join(fp.Dir(chunkPath), chunkID.String()+metaSuffix)
+}
+
+// writeChunkMeta durably writes attributes of the chunk next to chunk file
+func writeChunkMeta(chunk *model.Chunk) error {
+	data, err := json.Marshal(chunkMeta{Size: chunk.Size})
+	if err != nil {
+		return err
+	}
+
+	path := GetChunkMetaPath(chunk.Path, chunk.ID)
+	tmpPath := path + tmpSuffix
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// readChunkMeta reads attributes of the chunk. Chunks created before attributes were
+// stored are of the size used for all chunks at the time.
+func readChunkMeta(chunkPath string, chunkID uuid.UUID) (*chunkMeta, error) {
+	data, err := os.ReadFile(GetChunkMetaPath(chunkPath, chunkID))
+	if errors.Is(err, os.ErrNotExist) {
+		return &chunkMeta{Size: constants.LEGACY_CHUNK_SIZE_BYTES}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var meta chunkMeta
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
@@ -0,0 +1,145 @@
+package chunkserver
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	fp "path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+)
+
+const tmpSuffix = ".tmp"
+
+var ErrInvalidChunkFilename = errors.New("invalid chunk filename")
+
+// ParseChunkFilename parses chunk ID, index and version from filename created by GetChunkFilename
+func ParseChunkFilename(filename string) (uuid.UUID, int, int, error) {
+	name := strings.TrimSuffix(filename, chunkSuffix)
+	// uuid contains dashes itself, index and version are the last two parts
+	parts := strings.Split(name, "-")
+	if name == filename || len(parts) < 3 {
+		return uuid.UUID{}, 0, 0, ErrInvalidChunkFilename
+	}
+
+	id, err := uuid.Parse(strings.Join(parts[:len(parts)-2], "-"))
+	if err != nil {
+		return uuid.UUID{}, 0, 0, ErrInvalidChunkFilename
+	}
+
+	index, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return uuid.UUID{}, 0, 0, ErrInvalidChunkFilename
+	}
+
+	version, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return uuid.UUID{}, 0, 0, ErrInvalidChunkFilename
+	}
+
+	return id, index, version, nil
+}
+
+// LoadChunks rebuilds chunk inventory from chunk files found under chunks path, so that chunk server
+// reports chunks it holds after restart. When multiple versions of the same chunk are found only the
+// newest one is kept and older ones are deleted. Chunks whose attributes cannot be read are quarantined
+// and the scan goes on, so that they are re-replicated by master. Leftover temporary files are logged.
+func (c *ChunkService) LoadChunks() error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	root := c.Cfg.Chunks.Path
+	err := os.MkdirAll(root, 0750)
+	if err != nil {
+		return err
+	}
+
+	chunks := make(map[uuid.UUID]model.Chunk)
+	err = fp.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == QuarantineDir && fp.Dir(path) == root {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		name := d.Name()
+		switch {
+		case strings.HasSuffix(name, tmpSuffix):
+			log.Println("warn", "chunkService", "leftover temporary file", path)
+			return nil
+		case strings.HasSuffix(name, checksumSuffix) || strings.HasSuffix(name, metaSuffix) || name == identityFilename:
+			return nil
+		case !strings.HasSuffix(name, chunkSuffix):
+			log.Println("warn", "chunkService", "unknown file in chunks path", path)
+			return nil
+		}
+
+		id, index, version, err := ParseChunkFilename(name)
+		if err != nil {
+			log.Println("warn", "chunkService", "unknown file in chunks path", path)
+			return nil
+		}
+
+		rel, err := fp.Rel(root, fp.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		meta, err := readChunkMeta(path, id)
+		if err != nil {
+			log.Println("error", "chunkService", "failed to read chunk attributes, quarantining chunk", path, err)
+			err = c.quarantineChunkFiles(&model.Chunk{ID: id, Path: path})
+			if err != nil {
+				log.Println("error", "chunkService", "failed to quarantine chunk", path, err)
+			}
+
+			return nil
+		}
+
+		chunk := model.Chunk{
+			ID:       id,
+			Version:  version,
+			Path:     path,
+			FilePath: fp.ToSlash(fp.Join(string(fp.Separator), rel)),
+			Index:    index,
+			Size:     meta.Size,
+		}
+
+		existing, exists := chunks[id]
+		if exists {
+			stale := chunk
+			if chunk.Version > existing.Version {
+				stale = existing
+				chunks[id] = chunk
+			}
+
+			log.Println("warn", "chunkService", "removing older chunk version", stale.Path)
+			return c.removeChunkFiles(&stale)
+		}
+
+		chunks[id] = chunk
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		c.AddChunk(chunk)
+	}
+
+	log.Println("info", "chunkService", "loaded chunks from disk", len(chunks))
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pyropy/dfs/core/model"
@@ -22,35 +23,48 @@ type ChunkServer struct {
 	*LeaseStore
 	*HealthMonitor
 	*LeaseMonitor
+	*Scrubber
+	*Registration
 
-	Cfg           *Config
-	LRU           *cache.LRU
-	MasterAddr    string
-	ChunkServerID uuid.UUID
+	Cfg         *Config
+	LRU         *cache.LRU
+	appendLocks *ChunkLocks
 }
 
 var (
 	ErrChunkAlreadyExists   = errors.New("chunk already exists")
-	ErrChunkVersionMismatch = errors.New("chunk version mismatch")
+	ErrChunkVersionMismatch = rpcChunkServer.ErrChunkVersionMismatch
 	ErrChunkLeaseNotGranted = errors.New("chunk lease not granted")
 	ErrDataNotFoundInCache  = errors.New("data not found in cache")
 	ErrChunkLeaseNotFound   = errors.New("chunk server does not have active lease on chunk")
 	ErrChecksumNotMatching  = errors.New("given checksum does not match calculated checksum")
+	ErrRecordTooLarge       = errors.New("record exceeds maximum record size")
+	ErrRecordAppendFailed   = errors.New("record append failed on one or more replicas")
 )
 
 func NewChunkServer(cfg *Config) *ChunkServer {
 	leaseExpChan := make(chan model.Lease)
 	leaseStore := NewLeaseStore()
 	chunkService := NewChunkService(cfg)
+	registration := NewRegistration()
 
-	return &ChunkServer{
+	chunkServer := &ChunkServer{
 		Cfg:           cfg,
 		LeaseStore:    leaseStore,
 		ChunkService:  chunkService,
+		Registration:  registration,
 		LRU:           cache.NewLRU(100),
-		HealthMonitor: NewHealthMonitor(chunkService),
-		LeaseMonitor:  NewLeaseMonitor(leaseStore, leaseExpChan),
+		appendLocks:   NewChunkLocks(),
+		HealthMonitor: NewHealthMonitor(chunkService, registration),
+		LeaseMonitor:  NewLeaseMonitor(leaseStore, leaseExpChan, registration),
+		Scrubber:      NewScrubber(chunkService, leaseStore, registration, cfg.Scrubber.BytesPerSecond, cfg.Scrubber.Interval),
 	}
+
+	chunkServer.HealthMonitor.register = func() error {
+		return chunkServer.RegisterChunkServer(registration.MasterAddr(), registration.Address())
+	}
+
+	return chunkServer
 }
 
 func (c *ChunkServer) CreateChunk(id uuid.UUID, filePath string, index, version, size int) (*model.Chunk, error) {
@@ -59,6 +73,14 @@ func (c *ChunkServer) CreateChunk(id uuid.UUID, filePath string, index, version,
 		return nil, ErrChunkAlreadyExists
 	}
 
+	// replica with other version is stale and gets replaced
+	if exists {
+		err := c.ChunkService.DeleteChunk(id)
+		if err != nil && !errors.Is(err, ErrChunkDoesNotExist) {
+			return nil, err
+		}
+	}
+
 	chunk, err := c.ChunkService.CreateChunk(id, filePath, index, version, size)
 	if err != nil {
 		return nil, err
@@ -67,12 +89,15 @@ func (c *ChunkServer) CreateChunk(id uuid.UUID, filePath string, index, version,
 	return chunk, nil
 }
 
+// WriteChunk writes data to the chunk as primary and instructs other chunk holders to apply the same
+// mutation. Mutations are sent with epoch of the lease so that secondaries can fence superseded primary.
 func (c *ChunkServer) WriteChunk(chunkID uuid.UUID, checksum int, offset int, version int, chunkHolders []rpcChunkServer.ChunkServer) (int, error) {
-	if !c.HasLease(chunkID) {
+	lease, held := c.GetLease(chunkID)
+	if !held {
 		return 0, ErrChunkLeaseNotFound
 	}
 
-	bytesWritten, err := c.ApplyMigration(chunkID, checksum, offset, version)
+	bytesWritten, err := c.ApplyMigration(chunkID, checksum, offset, version, lease.Epoch)
 	if err != nil {
 		return 0, err
 	}
@@ -81,7 +106,7 @@ func (c *ChunkServer) WriteChunk(chunkID uuid.UUID, checksum int, offset int, ve
 	var wg sync.WaitGroup
 	for _, ch := range chunkHolders {
 		// don't send migration to self
-		if ch.ID == c.ChunkServerID {
+		if ch.ID == c.ChunkServerID() {
 			continue
 		}
 
@@ -89,7 +114,7 @@ func (c *ChunkServer) WriteChunk(chunkID uuid.UUID, checksum int, offset int, ve
 		go func(chunkServer rpcChunkServer.ChunkServer) {
 			defer wg.Done()
 
-			err = c.SendApplyMigration(chunkID, checksum, offset, version, chunkServer.Address)
+			err = c.SendApplyMigration(chunkID, checksum, offset, version, lease.Epoch, chunkServer.Address)
 			if err != nil {
 				log.Println("error", "chunkServer", "failed to send apply migration", err)
 			}
@@ -100,12 +125,119 @@ func (c *ChunkServer) WriteChunk(chunkID uuid.UUID, checksum int, offset int, ve
 	return bytesWritten, nil
 }
 
-func (c *ChunkServer) ApplyMigration(chunkID uuid.UUID, checksum int, offset int, version int) (int, error) {
+// RecordAppend appends record at the end of the chunk at offset chosen by this chunk server as primary
+// and instructs other chunk holders to apply the record at the same offset. If record does not fit
+// into the chunk, chunk is padded on all replicas and client is told to retry on the next chunk.
+func (c *ChunkServer) RecordAppend(chunkID uuid.UUID, checksum int, version int, chunkHolders []rpcChunkServer.ChunkServer) (int, bool, error) {
+	lease, held := c.GetLease(chunkID)
+	if !held {
+		return 0, false, ErrChunkLeaseNotFound
+	}
+
+	chunk, exists := c.ChunkService.GetChunk(chunkID)
+	if !exists {
+		return 0, false, ErrChunkDoesNotExist
+	}
+
+	data, exists := c.LRU.Get(checksum)
+	if !exists {
+		return 0, false, ErrDataNotFoundInCache
+	}
+
+	if len(data) > MaxRecordSize(chunk.Size) {
+		return 0, false, ErrRecordTooLarge
+	}
+
+	// appends to the chunk are serialized so that each of them gets its own offset
+	unlock := c.appendLocks.Lock(chunkID)
+	defer unlock()
+
+	offset, err := c.ChunkService.ChunkLength(chunkID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if offset+len(data) > chunk.Size {
+		err = c.ChunkService.PadChunk(chunkID, offset, version)
+		if err != nil {
+			return 0, false, err
+		}
+
+		err = c.sendToSecondaries(chunkHolders, func(address string) error {
+			return c.SendPadChunk(chunkID, offset, version, lease.Epoch, address)
+		})
+
+		return 0, true, err
+	}
+
+	_, err = c.WriteChunkBytes(chunkID, data, offset, version)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = c.sendToSecondaries(chunkHolders, func(address string) error {
+		return c.SendApplyMigration(chunkID, checksum, offset, version, lease.Epoch, address)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return offset, false, nil
+}
+
+// MaxRecordSize returns maximum size of record that can be appended to chunk of given size.
+// Keeping records small bounds the space wasted on padding.
+func MaxRecordSize(chunkSize int) int {
+	return chunkSize / 4
+}
+
+// sendToSecondaries calls send for each chunk holder other than this chunk server in parallel
+// and reports failure if any of them failed
+func (c *ChunkServer) sendToSecondaries(chunkHolders []rpcChunkServer.ChunkServer, send func(address string) error) error {
+	var wg sync.WaitGroup
+	var failed int32
+
+	for _, ch := range chunkHolders {
+		if ch.ID == c.ChunkServerID() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(chunkServer rpcChunkServer.ChunkServer) {
+			defer wg.Done()
+
+			err := send(chunkServer.Address)
+			if err != nil {
+				log.Println("error", "chunkServer", "failed to send mutation to secondary", chunkServer.Address, err)
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(ch)
+	}
+
+	wg.Wait()
+	if failed != 0 {
+		return ErrRecordAppendFailed
+	}
+
+	return nil
+}
+
+// ApplyMigration writes data received before to the chunk. Mutation sent by primary holding lease with epoch
+// older than highest epoch seen for the chunk is rejected. Copies of chunks written to newly created chunks
+// are not made under lease and are sent without epoch.
+func (c *ChunkServer) ApplyMigration(chunkID uuid.UUID, checksum int, offset int, version int, epoch int) (int, error) {
 	_, chunkExists := c.ChunkService.GetChunk(chunkID)
 	if !chunkExists {
 		return 0, ErrChunkDoesNotExist
 	}
 
+	if epoch > 0 {
+		err := c.ObserveEpoch(chunkID, epoch)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	data, exists := c.LRU.Get(checksum)
 	if !exists {
 		return 0, ErrDataNotFoundInCache
@@ -119,20 +251,56 @@ func (c *ChunkServer) ApplyMigration(chunkID uuid.UUID, checksum int, offset int
 	return bytesWritten, nil
 }
 
+// ReadChunk reads length bytes of chunk starting at offset. Read is rejected if local
+// chunk version does not match version known to the client.
+func (c *ChunkServer) ReadChunk(chunkID uuid.UUID, offset, length, version int) ([]byte, int, error) {
+	chunk, exists := c.ChunkService.GetChunk(chunkID)
+	if !exists {
+		return nil, 0, ErrChunkDoesNotExist
+	}
+
+	if chunk.Version != version {
+		return nil, chunk.Version, ErrChunkVersionMismatch
+	}
+
+	data, err := c.ChunkService.ReadChunk(chunkID, offset, length)
+	if err != nil {
+		return nil, chunk.Version, err
+	}
+
+	return data, chunk.Version, nil
+}
+
+// PadChunk pads chunk as instructed by primary holding lease with given epoch
+func (c *ChunkServer) PadChunk(chunkID uuid.UUID, offset int, version int, epoch int) error {
+	err := c.ObserveEpoch(chunkID, epoch)
+	if err != nil {
+		return err
+	}
+
+	return c.ChunkService.PadChunk(chunkID, offset, version)
+}
+
 func (c *ChunkServer) DeleteChunk(chunkID uuid.UUID) error {
 	c.LeaseStore.RemoveLease(chunkID)
+	c.LeaseStore.ForgetEpoch(chunkID)
 	return c.ChunkService.DeleteChunk(chunkID)
 }
 
-func (c *ChunkServer) GrantLease(chunkID uuid.UUID, validUntil time.Time) error {
+// GrantLease grants lease over chunk for given duration counted from now, so that it does not
+// depend on clocks of master and chunk server being in sync
+func (c *ChunkServer) GrantLease(chunkID uuid.UUID, validFor time.Duration, epoch int) error {
 	_, exists := c.GetChunk(chunkID)
 	if !exists {
 		return ErrChunkDoesNotExist
 	}
 
-	c.LeaseStore.GrantLease(chunkID, validUntil)
+	return c.LeaseStore.GrantLease(chunkID, time.Now().Add(validFor), epoch)
+}
 
-	return nil
+// RevokeLease gives up lease over chunk so that master can grant it to another chunk holder
+func (c *ChunkServer) RevokeLease(chunkID uuid.UUID, epoch int) {
+	c.LeaseStore.RevokeLease(chunkID, epoch)
 }
 
 func (c *ChunkServer) ReceiveBytes(data []byte, inChecksum int) error {
@@ -148,7 +316,15 @@ func (c *ChunkServer) ReceiveBytes(data []byte, inChecksum int) error {
 // IncrementChunkVersion increments chunk version number but also checks if
 // there is a mismatch between version given by master and local chunk version
 func (c *ChunkServer) IncrementChunkVersion(chunkID uuid.UUID, version int) error {
-	return c.ChunkService.IncrementChunkVersion(chunkID, version)
+	err := c.ChunkService.IncrementChunkVersion(chunkID, version)
+	if err != nil {
+		return err
+	}
+
+	// version is incremented before each new lease is granted and becomes its epoch,
+	// so primary of any older lease is fenced off from now on
+	_ = c.ObserveEpoch(chunkID, version)
+	return nil
 }
 
 func (c *ChunkServer) StartLeaseMonitor(ctx context.Context) {
@@ -159,6 +335,10 @@ func (c *ChunkServer) StartHealthReport(ctx context.Context) {
 	c.HealthMonitor.Start(ctx)
 }
 
+func (c *ChunkServer) StartScrubber(ctx context.Context) {
+	c.Scrubber.Start(ctx)
+}
+
 // RegisterChunkServer registers chunk server instance with Master API
 func (c *ChunkServer) RegisterChunkServer(masterAddr, addr string) error {
 	client, err := rpc.DialHTTP("tcp", masterAddr)
@@ -167,31 +347,43 @@ func (c *ChunkServer) RegisterChunkServer(masterAddr, addr string) error {
 		return err
 	}
 
-	c.SetMasterAddress(masterAddr)
+	defer client.Close()
+
+	identity, err := LoadIdentity(c.Cfg.Chunks.Path)
+	if err != nil {
+		return err
+	}
+
+	c.Registration.setAddresses(masterAddr, addr)
 	var reply master.RegisterReply
-	args := &master.RegisterArgs{Address: addr}
+	args := &master.RegisterArgs{
+		Address:       addr,
+		ChunkServerID: identity.ChunkServerID,
+		ClusterID:     identity.ClusterID,
+		Zone:          c.Cfg.Topology.Zone,
+		Rack:          c.Cfg.Topology.Rack,
+	}
+
 	err = client.Call("MasterAPI.RegisterChunkServer", args, &reply)
 	if err != nil {
 		return err
 	}
 
-	c.SetChunkServerID(reply.ID)
-	return nil
-}
-
-func (c *ChunkServer) SetMasterAddress(addr string) {
-	c.MasterAddr = addr
-	c.HealthMonitor.masterAddr = addr
-	c.LeaseMonitor.masterAddr = addr
-}
+	// identity is stored on first registration so that chunk server keeps its ID after restart
+	if identity.ChunkServerID != reply.ID || identity.ClusterID != reply.ClusterID {
+		identity.ChunkServerID = reply.ID
+		identity.ClusterID = reply.ClusterID
+		err = identity.Save(c.Cfg.Chunks.Path)
+		if err != nil {
+			return err
+		}
+	}
 
-func (c *ChunkServer) SetChunkServerID(id uuid.UUID) {
-	c.ChunkServerID = id
-	c.HealthMonitor.chunkServerID = id
-	c.LeaseMonitor.chunkServerID = id
+	c.Registration.setChunkServerID(reply.ID)
+	return nil
 }
 
-func (c *ChunkServer) SendApplyMigration(chunkID uuid.UUID, checksum int, offset int, version int, address string) error {
+func (c *ChunkServer) SendApplyMigration(chunkID uuid.UUID, checksum int, offset int, version int, epoch int, address string) error {
 	client, err := rpc.DialHTTP("tcp", address)
 	if err != nil {
 		log.Println("error", "unreachable")
@@ -206,6 +398,7 @@ func (c *ChunkServer) SendApplyMigration(chunkID uuid.UUID, checksum int, offset
 		CheckSum: checksum,
 		Offset:   offset,
 		Version:  version,
+		Epoch:    epoch,
 	}
 
 	err = client.Call("ChunkServerAPI.ApplyMigration", args, &reply)
@@ -216,8 +409,29 @@ func (c *ChunkServer) SendApplyMigration(chunkID uuid.UUID, checksum int, offset
 	return nil
 }
 
-// TODO: Refactor
-// ReplicateChunk replicates chunk with chunkID to list of provided chunkServers
+func (c *ChunkServer) SendPadChunk(chunkID uuid.UUID, offset int, version int, epoch int, address string) error {
+	client, err := rpc.DialHTTP("tcp", address)
+	if err != nil {
+		log.Println("error", "unreachable")
+		return err
+	}
+
+	defer client.Close()
+
+	var reply rpcChunkServer.ApplyMigrationReply
+	args := &rpcChunkServer.ApplyMigrationArgs{
+		ChunkID: chunkID,
+		Offset:  offset,
+		Version: version,
+		Epoch:   epoch,
+		Padding: true,
+	}
+
+	return client.Call("ChunkServerAPI.ApplyMigration", args, &reply)
+}
+
+// ReplicateChunk replicates chunk with chunkID to list of provided chunkServers.
+// Error is returned if replication to any of them fails.
 func (c *ChunkServer) ReplicateChunk(chunkID uuid.UUID, chunkServers []rpcChunkServer.ChunkServer) error {
 	chunk, exists := c.ChunkService.GetChunk(chunkID)
 	if !exists {
@@ -231,72 +445,37 @@ func (c *ChunkServer) ReplicateChunk(chunkID uuid.UUID, chunkServers []rpcChunkS
 	}
 
 	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var replicationErr error
 
 	// create chunks
 	for _, chunkServer := range chunkServers {
 		wg.Add(1)
-		go func(chunkServer rpcChunkServer.ChunkServer) error {
+		go func(chunkServer rpcChunkServer.ChunkServer) {
 			defer wg.Done()
 
-			conn, err := rpc.DialHTTP("tcp", chunkServer.Address)
-			if err != nil {
-				return err
-			}
-
-			defer conn.Close()
-
-			// create chunk
-			createChunkArgs := rpcChunkServer.CreateChunkRequest{
-				ChunkID:      chunk.ID,
-				ChunkVersion: chunk.Version,
-				ChunkIndex:   chunk.Index,
-				FilePath:     chunk.FilePath,
-			}
-
-			var createChunkReply rpcChunkServer.CreateChunkReply
-
-			err = conn.Call("ChunkServerAPI.CreateChunk", createChunkArgs, &createChunkReply)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-
-			checkSum := checksum.CalculateCheckSum(data)
-
-			// transfer data
-			transferDataArgs := rpcChunkServer.TransferDataArgs{
-				Data:     data,
-				CheckSum: checkSum,
-			}
-
-			var transferDataReply rpcChunkServer.TransferDataReply
-
-			err = conn.Call("ChunkServerAPI.TransferData", transferDataArgs, &transferDataReply)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-
-			// Apply migration
-			applyMigrationArgs := rpcChunkServer.ApplyMigrationArgs{
-				ChunkID:  chunk.ID,
-				CheckSum: checkSum,
-				Offset:   0,
-				Version:  chunk.Version,
-			}
-
-			var applyMigrationReply rpcChunkServer.ApplyMigrationReply
-
-			err = conn.Call("ChunkServerAPI.ApplyMigration", applyMigrationArgs, &applyMigrationReply)
+			err := c.replicateTo(chunk, data, chunkServer)
 			if err != nil {
-				log.Println(err)
-				return err
+				log.Println("error", "chunkServer", "failed to replicate chunk", chunk.ID, chunkServer.Address, err)
+				errLock.Lock()
+				replicationErr = err
+				errLock.Unlock()
 			}
-
-			return nil
 		}(chunkServer)
 	}
 
 	wg.Wait()
-	return nil
+	return replicationErr
+}
+
+// replicateTo creates chunk on given chunk server and transfers chunk data to it
+func (c *ChunkServer) replicateTo(chunk *model.Chunk, data []byte, chunkServer rpcChunkServer.ChunkServer) error {
+	target, err := createRemoteChunk(chunkServer.Address, *chunk)
+	if err != nil {
+		return err
+	}
+
+	defer target.close()
+
+	return target.write(data, 0)
 }
@@ -7,20 +7,28 @@ import (
 	"os"
 	fp "path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/model"
 	"github.com/pyropy/dfs/lib/cmap"
+	rpcChunkServer "github.com/pyropy/dfs/rpc/chunkserver"
 )
 
 var (
-	ErrChunkDoesNotExist = errors.New("chunk does not exist")
+	ErrChunkDoesNotExist = rpcChunkServer.ErrChunkDoesNotExist
 )
 
+// QuarantineDir is directory under chunks path where corrupted chunks are moved to
+const QuarantineDir = ".quarantine"
+
 type ChunkService struct {
 	Cfg    *Config
 	Lock   sync.RWMutex
 	Chunks cmap.Map[uuid.UUID, model.Chunk]
+
+	// inFlightWrites is number of writes waiting for or holding the lock
+	inFlightWrites int64
 }
 
 func NewChunkService(cfg *Config) *ChunkService {
@@ -47,6 +55,8 @@ func (c *ChunkService) CreateChunk(id uuid.UUID, filePath string, index, version
 		ID:       id,
 		Version:  version,
 		FilePath: filePath,
+		Index:    index,
+		Size:     size,
 	}
 
 	c.Lock.Lock()
@@ -59,18 +69,106 @@ func (c *ChunkService) CreateChunk(id uuid.UUID, filePath string, index, version
 	}
 
 	chunkPath := c.GetChunkPath(id, filePath, index, version)
-	_, err = os.Create(chunkPath)
+	f, err := os.Create(chunkPath)
 	if err != nil {
 		return nil, err
 	}
 
+	defer f.Close()
+
 	chunk.Path = chunkPath
+	err = updateChecksums(&chunk, f, 0, chunkBlocks(&chunk))
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeChunkMeta(&chunk)
+	if err != nil {
+		return nil, err
+	}
 
 	c.AddChunk(chunk)
 
 	return &chunk, nil
 }
 
+// CloneChunk creates local copy of the chunk under new ID
+func (c *ChunkService) CloneChunk(chunkID uuid.UUID, newChunkID uuid.UUID, filePath string, index, version int) (*model.Chunk, error) {
+	chunk, exists := c.GetChunk(chunkID)
+	if !exists {
+		return nil, ErrChunkDoesNotExist
+	}
+
+	if chunk.Version != version {
+		return nil, ErrChunkVersionMismatch
+	}
+
+	clone := model.Chunk{
+		ID:       newChunkID,
+		Version:  version,
+		FilePath: filePath,
+		Index:    index,
+		Size:     chunk.Size,
+		Checksum: chunk.Checksum,
+	}
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	err := os.MkdirAll(fp.Join(c.Cfg.Chunks.Path, filePath), 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(chunk.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// corrupted chunk must not be copied together with freshly computed checksums
+	data, err := readVerified(chunk, src, 0, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	clone.Path = c.GetChunkPath(newChunkID, filePath, index, version)
+	dst, err := os.Create(clone.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dst.Write(data)
+	if err == nil {
+		err = updateChecksums(&clone, dst, 0, chunkBlocks(&clone))
+	}
+
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	if err == nil {
+		err = writeChunkMeta(&clone)
+	}
+
+	dst.Close()
+	if err != nil {
+		os.Remove(clone.Path)
+		os.Remove(GetChecksumPath(clone.Path))
+		return nil, err
+	}
+
+	c.AddChunk(clone)
+
+	return &clone, nil
+}
+
 func (c *ChunkService) AddChunk(chunk model.Chunk) {
 	c.Chunks.Set(chunk.ID, chunk)
 }
@@ -92,7 +190,8 @@ func (c *ChunkService) GetAllChunks() []model.Chunk {
 	return chunks
 }
 
-// ReadChunk reads chunk length number of bytes starting at given offset. If length is -1 whole chunk file is read
+// ReadChunk reads chunk length number of bytes starting at given offset. If length is -1 whole chunk file is read.
+// Checksum of every block read is verified and ChunkCorruptionError is returned if any of them does not match.
 func (c *ChunkService) ReadChunk(chunkID uuid.UUID, offset, length int) ([]byte, error) {
 	chunk, exists := c.GetChunk(chunkID)
 	if !exists {
@@ -102,28 +201,25 @@ func (c *ChunkService) ReadChunk(chunkID uuid.UUID, offset, length int) ([]byte,
 	c.Lock.RLock()
 	defer c.Lock.RUnlock()
 
-	// Read all
-	if length == -1 {
-		return os.ReadFile(chunk.Path)
-	}
-
 	file, err := os.Open(chunk.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = file.Seek(int64(offset), 0)
-	if err != nil {
-		return nil, err
-	}
+	defer file.Close()
 
-	data := make([]byte, length)
-	_, err = file.Read(data)
-	if err != nil {
-		return nil, err
+	// Read all
+	if length == -1 {
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		length = int(fi.Size()) - offset
 	}
 
-	return data, nil
+	// Reading past the end of written data returns only the bytes available
+	return readVerified(chunk, file, int64(offset), int64(length))
 }
 
 func (c *ChunkService) WriteChunkBytes(chunkID uuid.UUID, data []byte, offset int, version int) (int, error) {
@@ -132,6 +228,8 @@ func (c *ChunkService) WriteChunkBytes(chunkID uuid.UUID, data []byte, offset in
 		return 0, ErrChunkDoesNotExist
 	}
 
+	defer c.trackWrite()()
+
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
@@ -145,14 +243,129 @@ func (c *ChunkService) WriteChunkBytes(chunkID uuid.UUID, data []byte, offset in
 		return 0, err
 	}
 
+	defer f.Close()
+
+	err = verifyEdgeBlocks(chunk, f, int64(offset), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// blocks between previous end of the chunk and the offset are filled with zeros so their checksums change too
+	fromBlock := int64(offset)
+	if fi.Size() < fromBlock {
+		fromBlock = fi.Size()
+		err = verifyEdgeBlocks(chunk, f, fromBlock, int64(offset)-fromBlock)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	bytesWritten, err := f.WriteAt(data, int64(offset))
 	if err != nil {
 		return 0, err
 	}
 
+	// only checksums of blocks touched by the write are recomputed
+	toBlock := (int64(offset+len(data)) + ChecksumBlockSize - 1) / ChecksumBlockSize
+	err = updateChecksums(chunk, f, fromBlock/ChecksumBlockSize, toBlock)
+	if err != nil {
+		return 0, err
+	}
+
 	return bytesWritten, nil
 }
 
+// InFlightWrites returns number of writes currently in progress
+func (c *ChunkService) InFlightWrites() int {
+	return int(atomic.LoadInt64(&c.inFlightWrites))
+}
+
+// trackWrite counts write as in progress until returned func is called
+func (c *ChunkService) trackWrite() func() {
+	atomic.AddInt64(&c.inFlightWrites, 1)
+	return func() {
+		atomic.AddInt64(&c.inFlightWrites, -1)
+	}
+}
+
+// ChunkLength returns number of bytes written to chunk so far
+func (c *ChunkService) ChunkLength(chunkID uuid.UUID) (int, error) {
+	chunk, exists := c.GetChunk(chunkID)
+	if !exists {
+		return 0, ErrChunkDoesNotExist
+	}
+
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	fi, err := os.Stat(chunk.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(fi.Size()), nil
+}
+
+// PadChunk fills chunk with zeros starting at given offset up to the chunk size
+func (c *ChunkService) PadChunk(chunkID uuid.UUID, offset int, version int) error {
+	chunk, exists := c.GetChunk(chunkID)
+	if !exists {
+		return ErrChunkDoesNotExist
+	}
+
+	defer c.trackWrite()()
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if chunk.Version != version {
+		return ErrChunkVersionMismatch
+	}
+
+	f, err := os.OpenFile(chunk.Path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// replica might hold data past the offset from failed append, those bytes are overwritten too
+	fromBlock := fi.Size()
+	if fromBlock > int64(offset) {
+		fromBlock = int64(offset)
+	}
+
+	// data kept in the block padding starts in is not rewritten, so it is verified before checksum is recomputed
+	err = verifyEdgeBlocks(chunk, f, fromBlock, ChecksumBlockSize-fromBlock%ChecksumBlockSize)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() > int64(offset) {
+		err = f.Truncate(int64(offset))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Truncate(int64(chunk.Size))
+	if err != nil {
+		return err
+	}
+
+	return updateChecksums(chunk, f, fromBlock/ChecksumBlockSize, chunkBlocks(chunk))
+}
+
 // IncrementChunkVersion increments chunk version number but also checks if
 // there is a mismatch between version given by master and local chunk version
 func (c *ChunkService) IncrementChunkVersion(chunkID uuid.UUID, version int) error {
@@ -164,15 +377,20 @@ func (c *ChunkService) IncrementChunkVersion(chunkID uuid.UUID, version int) err
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
+	currentVersion := chunk.Version
+	if (currentVersion + 1) != version {
+		return ErrChunkVersionMismatch
+	}
+
 	newPath := c.GetChunkPath(chunk.ID, chunk.FilePath, chunk.Index, version)
 	err := os.Rename(chunk.Path, newPath)
 	if err != nil {
 		return err
 	}
 
-	currentVersion := chunk.Version
-	if (currentVersion + 1) != version {
-		return ErrChunkVersionMismatch
+	err = os.Rename(GetChecksumPath(chunk.Path), GetChecksumPath(newPath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
 	chunk.Path = newPath
@@ -191,10 +409,90 @@ func (c *ChunkService) DeleteChunk(chunkID uuid.UUID) error {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
+	return c.removeChunk(chunk)
+}
+
+// DeleteStaleChunk deletes chunk only if its version is older than given version,
+// replica that has been brought up to date in the meantime is kept
+func (c *ChunkService) DeleteStaleChunk(chunkID uuid.UUID, version int) error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	chunk, exists := c.Chunks.Get(chunkID)
+	if !exists {
+		return ErrChunkDoesNotExist
+	}
+
+	if chunk.Version >= version {
+		return nil
+	}
+
+	return c.removeChunk(chunk)
+}
+
+// removeChunk removes all files of the chunk and stops serving it
+func (c *ChunkService) removeChunk(chunk *model.Chunk) error {
+	if err := c.removeChunkFiles(chunk); err != nil {
+		return err
+	}
+
+	if err := os.Remove(GetChunkMetaPath(chunk.Path, chunk.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	c.Chunks.Delete(chunk.ID)
+	return nil
+}
+
+// removeChunkFiles removes chunk file together with its checksums, chunk attributes shared
+// with other versions of the chunk are kept
+func (c *ChunkService) removeChunkFiles(chunk *model.Chunk) error {
 	if err := os.Remove(chunk.Path); err != nil {
 		return err
 	}
 
+	if err := os.Remove(GetChecksumPath(chunk.Path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// QuarantineChunk moves corrupted chunk together with its checksums and attributes out of the chunks tree and stops serving it.
+// Quarantined files are kept for inspection and are not reported to master anymore.
+func (c *ChunkService) QuarantineChunk(chunkID uuid.UUID) error {
+	chunk, exists := c.Chunks.Get(chunkID)
+	if !exists {
+		return ErrChunkDoesNotExist
+	}
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
 	c.Chunks.Delete(chunkID)
+
+	return c.quarantineChunkFiles(chunk)
+}
+
+// quarantineChunkFiles moves chunk file together with its checksums and attributes to quarantine directory
+func (c *ChunkService) quarantineChunkFiles(chunk *model.Chunk) error {
+	quarantinePath := fp.Join(c.Cfg.Chunks.Path, QuarantineDir)
+	err := os.MkdirAll(quarantinePath, 0750)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(chunk.Path, fp.Join(quarantinePath, fp.Base(chunk.Path)))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{GetChecksumPath(chunk.Path), GetChunkMetaPath(chunk.Path, chunk.ID)} {
+		err = os.Rename(path, fp.Join(quarantinePath, fp.Base(path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -1,6 +1,10 @@
 package chunkserver
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
 	Server struct {
@@ -10,9 +14,17 @@ type Config struct {
 	Master struct {
 		Addr string `envconfig:"MASTER_ADDR"`
 	}
+	Topology struct {
+		Zone string `envconfig:"ZONE"`
+		Rack string `envconfig:"RACK"`
+	}
 	Chunks struct {
 		Path string `envconfig:"CHUNK_PATH" default:"/app/chunks"`
 	}
+	Scrubber struct {
+		BytesPerSecond int           `envconfig:"SCRUB_BYTES_PER_SECOND" default:"1048576"`
+		Interval       time.Duration `envconfig:"SCRUB_INTERVAL" default:"1h"`
+	}
 }
 
 func GetConfig() (*Config, error) {
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package chunkserver
+
+import "syscall"
+
+// diskUsage returns total and free bytes of the file system holding given path
+func diskUsage(path string) (int64, int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+
+	return total, free, nil
+}
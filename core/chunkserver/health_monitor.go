@@ -4,20 +4,24 @@ import (
 	"context"
 	"log"
 	"net/rpc"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/pyropy/dfs/rpc/master"
 )
 
 type HealthMonitor struct {
-	masterAddr    string
-	chunkServerID uuid.UUID
-	chunkService  *ChunkService
+	registration *Registration
+	chunkService *ChunkService
+	register     func() error
+
+	// registerLock keeps overlapping reports from registering chunk server again at the same time
+	registerLock sync.Mutex
 }
 
-func NewHealthMonitor(chunkService *ChunkService) *HealthMonitor {
+func NewHealthMonitor(chunkService *ChunkService, registration *Registration) *HealthMonitor {
 	return &HealthMonitor{
+		registration: registration,
 		chunkService: chunkService,
 	}
 }
@@ -36,12 +40,38 @@ func (h *HealthMonitor) Start(ctx context.Context) {
 	}
 }
 
+// Report reports chunks held by chunk server to master. If master does not know about chunk server
+// (e.g. it has been restarted) chunk server registers again and repeats the report. Report that finds
+// registration already in progress leaves it to the report that started it.
 func (h *HealthMonitor) Report() error {
-	if h.masterAddr == "" {
+	if h.registration.MasterAddr() == "" {
 		return nil
 	}
 
-	client, err := rpc.DialHTTP("tcp", h.masterAddr)
+	err := h.report()
+	if err != nil && err.Error() == master.ErrChunkServerNotRegistered.Error() && h.register != nil {
+		if !h.registerLock.TryLock() {
+			return err
+		}
+
+		defer h.registerLock.Unlock()
+
+		log.Println("info", "healthMonitor", "master does not know chunk server, registering again")
+		err = h.register()
+		if err != nil {
+			log.Println("error", "healthMonitor", "failed to register chunk server", err)
+			return err
+		}
+
+		return h.report()
+	}
+
+	return err
+}
+
+func (h *HealthMonitor) report() error {
+
+	client, err := rpc.DialHTTP("tcp", h.registration.MasterAddr())
 	if err != nil {
 		log.Println("error", "unreachable")
 		return err
@@ -59,10 +89,21 @@ func (h *HealthMonitor) Report() error {
 		chunkReport = append(chunkReport, ch)
 	}
 
+	totalBytes, freeBytes, err := diskUsage(h.chunkService.Cfg.Chunks.Path)
+	if err != nil {
+		log.Println("error", "healthMonitor", "failed to get disk usage", err)
+	}
+
 	var reply master.ReportHealthReply
 	args := &master.ReportHealthArgs{
-		ChunkServerID: h.chunkServerID,
+		ChunkServerID: h.registration.ChunkServerID(),
 		Chunks:        chunkReport,
+		Usage: master.Usage{
+			TotalBytes:     totalBytes,
+			FreeBytes:      freeBytes,
+			ChunkCount:     len(chunkReport),
+			InFlightWrites: h.chunkService.InFlightWrites(),
+		},
 	}
 
 	err = client.Call("MasterAPI.ReportHealth", args, &reply)
@@ -0,0 +1,77 @@
+package chunkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	fp "path/filepath"
+
+	"github.com/google/uuid"
+)
+
+const identityFilename = ".identity"
+
+// Identity is stored in chunks path so that chunk server keeps its ID across restarts
+// and can not join master of another cluster by mistake
+type Identity struct {
+	ChunkServerID uuid.UUID
+	ClusterID     uuid.UUID
+}
+
+// LoadIdentity reads identity stored in chunks path, empty identity is returned if chunk server
+// has never been registered with master
+func LoadIdentity(chunksPath string) (*Identity, error) {
+	data, err := os.ReadFile(fp.Join(chunksPath, identityFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Identity{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var identity Identity
+	err = json.Unmarshal(data, &identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// Save durably writes identity to chunks path
+func (i *Identity) Save(chunksPath string) error {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(chunksPath, 0750)
+	if err != nil {
+		return err
+	}
+
+	path := fp.Join(chunksPath, identityFilename)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -12,14 +12,14 @@ import (
 )
 
 type LeaseMonitor struct {
-	masterAddr    string
-	chunkServerID uuid.UUID
-	leaseExpChan  chan model.Lease
-	leaseStore    *LeaseStore
+	registration *Registration
+	leaseExpChan chan model.Lease
+	leaseStore   *LeaseStore
 }
 
-func NewLeaseMonitor(leaseStore *LeaseStore, leaseExpChan chan model.Lease) *LeaseMonitor {
+func NewLeaseMonitor(leaseStore *LeaseStore, leaseExpChan chan model.Lease, registration *Registration) *LeaseMonitor {
 	return &LeaseMonitor{
+		registration: registration,
 		leaseStore:   leaseStore,
 		leaseExpChan: leaseExpChan,
 	}
@@ -68,16 +68,19 @@ func (l *LeaseMonitor) MonitorLeases(ctx context.Context) {
 
 // RequestLeaseRenewal requests renewal for given lease from master
 func (l *LeaseMonitor) RequestLeaseRenewal(lease model.Lease) error {
-	client, err := rpc.DialHTTP("tcp", l.masterAddr)
+	client, err := rpc.DialHTTP("tcp", l.registration.MasterAddr())
 	if err != nil {
 		log.Println("error", "unreachable")
 		return err
 	}
 
+	// lease duration is counted from the request so that it does not outlast lease known to master
+	requestedAt := time.Now()
+
 	var reply master.RequestLeaseRenewalReply
 	args := &master.RequestLeaseRenewalArgs{
 		ChunkID:       lease.ChunkID,
-		ChunkServerID: l.chunkServerID,
+		ChunkServerID: l.registration.ChunkServerID(),
 	}
 
 	err = client.Call("MasterAPI.RequestLeaseRenewal", args, &reply)
@@ -89,8 +92,11 @@ func (l *LeaseMonitor) RequestLeaseRenewal(lease model.Lease) error {
 		return ErrChunkLeaseNotGranted
 	}
 
-	l.leaseStore.GrantLease(reply.ChunkID, reply.ValidUntil)
+	err = l.leaseStore.GrantLease(reply.ChunkID, requestedAt.Add(reply.ValidFor), reply.Epoch)
+	if err != nil {
+		return err
+	}
 
-	log.Println("info", "chunkServer", "lease granted", reply.ChunkID, reply.ValidUntil)
+	log.Println("info", "chunkServer", "lease granted", reply.ChunkID, reply.ValidFor, reply.Epoch)
 	return nil
 }
@@ -1,42 +1,110 @@
 package chunkserver
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/pyropy/dfs/core/model"
 	"github.com/pyropy/dfs/lib/cmap"
-	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrStaleLease = errors.New("lease epoch is older than highest epoch seen for chunk")
+)
+
 // LeaseStore manages leases
 type LeaseStore struct {
 	Leases cmap.Map[uuid.UUID, model.Lease]
+
+	epochsLock sync.Mutex
+	// epochs holds highest lease epoch seen for each chunk, mutations sent under older
+	// epoch come from primary that has been superseded
+	epochs map[uuid.UUID]int
 }
 
 func NewLeaseStore() *LeaseStore {
 	return &LeaseStore{
 		Leases: cmap.NewMap[uuid.UUID, model.Lease](),
+		epochs: make(map[uuid.UUID]int),
 	}
 }
 
 // HasLease checks if chunk servers has lease over chunk for given chunk ID
 func (ls *LeaseStore) HasLease(chunkID uuid.UUID) bool {
+	_, held := ls.GetLease(chunkID)
+	return held
+}
+
+// GetLease returns lease over chunk if it has not expired and has not been superseded by lease with newer epoch
+func (ls *LeaseStore) GetLease(chunkID uuid.UUID) (*model.Lease, bool) {
 	lease, leaseExists := ls.Leases.Get(chunkID)
-	if !leaseExists {
-		return false
+	if !leaseExists || lease.IsExpired() {
+		return nil, false
+	}
+
+	ls.epochsLock.Lock()
+	defer ls.epochsLock.Unlock()
+
+	if lease.Epoch < ls.epochs[chunkID] {
+		return nil, false
 	}
 
-	return !lease.IsExpired()
+	return lease, true
 }
 
-// GrantLease grants lease over chunk for period of time
-func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, validUntil time.Time) {
+// ObserveEpoch records lease epoch seen for chunk. Epoch older than highest epoch seen is rejected.
+func (ls *LeaseStore) ObserveEpoch(chunkID uuid.UUID, epoch int) error {
+	ls.epochsLock.Lock()
+	defer ls.epochsLock.Unlock()
+
+	if epoch < ls.epochs[chunkID] {
+		return ErrStaleLease
+	}
+
+	ls.epochs[chunkID] = epoch
+	return nil
+}
+
+// ForgetEpoch removes highest epoch seen for chunk, e.g. once chunk is deleted
+func (ls *LeaseStore) ForgetEpoch(chunkID uuid.UUID) {
+	ls.epochsLock.Lock()
+	defer ls.epochsLock.Unlock()
+
+	delete(ls.epochs, chunkID)
+}
+
+// GrantLease grants lease over chunk until given time. Lease with epoch older than highest
+// epoch seen for the chunk is rejected, e.g. grant delayed until after newer one.
+func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, validUntil time.Time, epoch int) error {
+	err := ls.ObserveEpoch(chunkID, epoch)
+	if err != nil {
+		return err
+	}
+
 	lease := model.Lease{
 		ChunkID:    chunkID,
 		ValidUntil: validUntil,
+		Epoch:      epoch,
 	}
 
 	ls.Leases.Set(chunkID, lease)
+	return nil
+}
+
+// RevokeLease removes lease over chunk unless it has been granted with newer epoch than the revoked one.
+// Revoked epoch is never accepted again, so renewal of revoked lease arriving late is rejected as stale.
+func (ls *LeaseStore) RevokeLease(chunkID uuid.UUID, epoch int) {
+	_ = ls.ObserveEpoch(chunkID, epoch+1)
+
+	held, exists := ls.Leases.Get(chunkID)
+	if !exists || held.Epoch > epoch {
+		return
+	}
+
+	ls.Leases.Delete(chunkID)
 }
 
 // RemoveLease removes lease over chunk if present
@@ -0,0 +1,59 @@
+package chunkserver
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Registration holds master address and chunk server identity assigned by master. It is shared by
+// chunk server and its monitors and changes when chunk server registers again, e.g. after master restart.
+type Registration struct {
+	lock          sync.RWMutex
+	masterAddr    string
+	address       string
+	chunkServerID uuid.UUID
+}
+
+func NewRegistration() *Registration {
+	return &Registration{}
+}
+
+// MasterAddr returns address of master chunk server is registered with
+func (r *Registration) MasterAddr() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.masterAddr
+}
+
+// Address returns address chunk server has registered with
+func (r *Registration) Address() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.address
+}
+
+// ChunkServerID returns ID master assigned to chunk server
+func (r *Registration) ChunkServerID() uuid.UUID {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.chunkServerID
+}
+
+func (r *Registration) setAddresses(masterAddr, address string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.masterAddr = masterAddr
+	r.address = address
+}
+
+func (r *Registration) setChunkServerID(id uuid.UUID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.chunkServerID = id
+}
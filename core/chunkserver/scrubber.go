@@ -0,0 +1,150 @@
+package chunkserver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/rpc"
+	"time"
+
+	"github.com/google/uuid"
+	rpcChunkServer "github.com/pyropy/dfs/rpc/chunkserver"
+	"github.com/pyropy/dfs/rpc/master"
+)
+
+// Scrubber periodically re-reads all chunks held by chunk server to find corrupted blocks
+// in data that is rarely read by clients. Reads are throttled to configured number of bytes
+// per second so that scrubbing does not compete with client traffic.
+type Scrubber struct {
+	registration   *Registration
+	chunkService   *ChunkService
+	leaseStore     *LeaseStore
+	bytesPerSecond int
+	interval       time.Duration
+}
+
+func NewScrubber(chunkService *ChunkService, leaseStore *LeaseStore, registration *Registration, bytesPerSecond int, interval time.Duration) *Scrubber {
+	return &Scrubber{
+		registration:   registration,
+		chunkService:   chunkService,
+		leaseStore:     leaseStore,
+		bytesPerSecond: bytesPerSecond,
+		interval:       interval,
+	}
+}
+
+// Start scrubs all chunks and repeats the pass after every interval until canceled
+func (s *Scrubber) Start(ctx context.Context) {
+	for {
+		err := s.ScrubAll(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Println("error", "scrubber", "scrub failed", err)
+		}
+
+		select {
+		case <-time.After(s.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ScrubAll verifies checksums of every chunk currently held by chunk server
+func (s *Scrubber) ScrubAll(ctx context.Context) error {
+	for _, chunk := range s.chunkService.GetAllChunks() {
+		err := s.ScrubChunk(ctx, chunk.ID)
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+
+		if err != nil {
+			log.Println("error", "scrubber", "failed to scrub chunk", chunk.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// ScrubChunk reads chunk block by block and verifies its checksums. Corrupted chunk
+// is quarantined and reported to master so that it can be re-replicated from healthy replica.
+func (s *Scrubber) ScrubChunk(ctx context.Context, chunkID uuid.UUID) error {
+	offset := 0
+	for {
+		data, err := s.chunkService.ReadChunk(chunkID, offset, ChecksumBlockSize)
+		if errors.Is(err, rpcChunkServer.ErrChunkCorrupted) {
+			log.Println("error", "scrubber", "chunk corrupted", err)
+			return s.quarantine(chunkID)
+		}
+
+		// chunk has been deleted in the meantime
+		if errors.Is(err, ErrChunkDoesNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		offset += len(data)
+		err = s.throttle(ctx, len(data))
+		if err != nil {
+			return err
+		}
+
+		if len(data) < ChecksumBlockSize {
+			return nil
+		}
+	}
+}
+
+// throttle waits long enough for reads of n bytes to stay within the I/O budget
+func (s *Scrubber) throttle(ctx context.Context, n int) error {
+	if s.bytesPerSecond <= 0 || n == 0 {
+		return ctx.Err()
+	}
+
+	wait := time.Duration(n) * time.Second / time.Duration(s.bytesPerSecond)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scrubber) quarantine(chunkID uuid.UUID) error {
+	s.leaseStore.RemoveLease(chunkID)
+
+	err := s.chunkService.QuarantineChunk(chunkID)
+	if err != nil {
+		return err
+	}
+
+	log.Println("info", "scrubber", "chunk quarantined", chunkID)
+
+	return s.ReportBadChunk(chunkID)
+}
+
+// ReportBadChunk tells master that chunk server no longer holds healthy replica of the chunk
+func (s *Scrubber) ReportBadChunk(chunkID uuid.UUID) error {
+	masterAddr := s.registration.MasterAddr()
+	if masterAddr == "" {
+		return nil
+	}
+
+	client, err := rpc.DialHTTP("tcp", masterAddr)
+	if err != nil {
+		log.Println("error", "unreachable")
+		return err
+	}
+
+	defer client.Close()
+
+	var reply master.ReportBadChunkReply
+	args := &master.ReportBadChunkArgs{
+		ChunkServerID: s.registration.ChunkServerID(),
+		ChunkID:       chunkID,
+	}
+
+	return client.Call("MasterAPI.ReportBadChunk", args, &reply)
+}
@@ -0,0 +1,292 @@
+package chunkserver
+
+import (
+	"errors"
+	"log"
+	"net/rpc"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+	"github.com/pyropy/dfs/lib/checksum"
+	"github.com/pyropy/dfs/lib/erasure"
+	rpcChunkServer "github.com/pyropy/dfs/rpc/chunkserver"
+)
+
+// stripeSegmentSize is number of bytes of each stripe member coded at once, it bounds memory
+// used by stripe rebuild to stripe width times segment size
+const stripeSegmentSize = 1 << 20
+
+var ErrInvalidStripe = errors.New("invalid stripe")
+
+// RebuildStripe computes missing members of erasure coded stripe from the members that are available and
+// writes them to their target chunk servers. Converting file to erasure coding is rebuild of stripe whose
+// parity members are all missing. Member that cannot be read is treated as missing, rebuild fails only if
+// fewer than dataShards members are left. Stripe is processed segment by segment so that whole chunks are
+// never held in memory. Number of bytes held by each member is returned.
+func (c *ChunkServer) RebuildStripe(dataShards, parityShards, chunkSize int, filePath string, members []rpcChunkServer.StripeMember) ([]int, error) {
+	if len(members) != dataShards+parityShards {
+		return nil, ErrInvalidStripe
+	}
+
+	code, err := erasure.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]*rpc.Client)
+	targets := make([]*remoteChunk, len(members))
+	defer func() {
+		for _, conn := range sources {
+			conn.Close()
+		}
+
+		for _, target := range targets {
+			if target != nil {
+				target.close()
+			}
+		}
+	}()
+
+	// rebuilt member is created on its target once there is first segment to write to it
+	createTarget := func(i int) error {
+		member := members[i]
+		targets[i], err = createRemoteChunk(member.Target, model.Chunk{
+			ID:       member.ChunkID,
+			Version:  member.Version,
+			Index:    member.Index,
+			Size:     chunkSize,
+			FilePath: filePath,
+		})
+
+		return err
+	}
+
+	lengths := make([]int, len(members))
+	unreadable := make([]bool, len(members))
+	for offset := 0; offset < chunkSize; {
+		segment := stripeSegmentSize
+		if chunkSize-offset < segment {
+			segment = chunkSize - offset
+		}
+
+		shards := make([][]byte, len(members))
+		valid := make([]int, len(members))
+		segmentLength := 0
+
+		for i, member := range members {
+			if member.ChunkID == uuid.Nil || member.Source == "" || unreadable[i] {
+				continue
+			}
+
+			shards[i], err = c.readStripeMember(sources, member, offset, segment)
+			if err != nil {
+				log.Println("error", "chunkServer", "failed to read stripe member", member.ChunkID, member.Source, err)
+				unreadable[i] = true
+				shards[i] = nil
+				continue
+			}
+
+			// member read past its end is present with no data
+			if shards[i] == nil {
+				shards[i] = []byte{}
+			}
+		}
+
+		for i, member := range members {
+			switch {
+			case member.ChunkID == uuid.Nil:
+				shards[i] = []byte{}
+			case shards[i] != nil:
+				valid[i] = len(shards[i])
+			case member.Length >= 0:
+				valid[i] = clamp(member.Length-offset, 0, segment)
+			}
+
+			if valid[i] > segmentLength {
+				segmentLength = valid[i]
+			}
+		}
+
+		if segmentLength == 0 {
+			break
+		}
+
+		for i, shard := range shards {
+			if shard != nil {
+				shards[i] = padShard(shard, segmentLength)
+			}
+		}
+
+		err = code.Reconstruct(shards)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, member := range members {
+			if member.Target == "" || member.ChunkID == uuid.Nil {
+				continue
+			}
+
+			// parity members are as long as the longest data member, data member with
+			// source is copied as it is read
+			if i >= dataShards || ((member.Source == "" || unreadable[i]) && member.Length < 0) {
+				valid[i] = segmentLength
+			}
+
+			if valid[i] == 0 {
+				continue
+			}
+
+			if targets[i] == nil {
+				err = createTarget(i)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			err = targets[i].write(shards[i][:valid[i]], offset)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for i := range members {
+			if valid[i] > 0 {
+				lengths[i] = offset + valid[i]
+			}
+		}
+
+		offset += segmentLength
+		if segmentLength < segment {
+			break
+		}
+	}
+
+	// rebuilt members that hold no data are still created so that they are reported by this chunk server
+	for i, member := range members {
+		if member.Target != "" && member.ChunkID != uuid.Nil && targets[i] == nil {
+			err = createTarget(i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return lengths, nil
+}
+
+// readStripeMember reads segment of stripe member from chunk server holding it, reading locally if it is this one
+func (c *ChunkServer) readStripeMember(sources map[string]*rpc.Client, member rpcChunkServer.StripeMember, offset, length int) ([]byte, error) {
+	if member.Source == c.Address() {
+		data, _, err := c.ReadChunk(member.ChunkID, offset, length, member.Version)
+		return data, err
+	}
+
+	conn, exists := sources[member.Source]
+	if !exists {
+		var err error
+		conn, err = rpc.DialHTTP("tcp", member.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		sources[member.Source] = conn
+	}
+
+	args := rpcChunkServer.ReadChunkArgs{
+		ChunkID: member.ChunkID,
+		Offset:  offset,
+		Length:  length,
+		Version: member.Version,
+	}
+
+	var reply rpcChunkServer.ReadChunkReply
+	err := conn.Call("ChunkServerAPI.ReadChunk", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Data, nil
+}
+
+// padShard extends shard with zeros up to given length
+func padShard(shard []byte, length int) []byte {
+	if len(shard) >= length {
+		return shard[:length]
+	}
+
+	return append(shard, make([]byte, length-len(shard))...)
+}
+
+func clamp(value, lower, upper int) int {
+	if value < lower {
+		return lower
+	}
+
+	if value > upper {
+		return upper
+	}
+
+	return value
+}
+
+// remoteChunk is chunk created on another chunk server and written to piece by piece
+type remoteChunk struct {
+	conn  *rpc.Client
+	chunk model.Chunk
+}
+
+// createRemoteChunk creates chunk on chunk server with given address
+func createRemoteChunk(address string, chunk model.Chunk) (*remoteChunk, error) {
+	conn, err := rpc.DialHTTP("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	args := rpcChunkServer.CreateChunkRequest{
+		ChunkID:      chunk.ID,
+		ChunkVersion: chunk.Version,
+		ChunkIndex:   chunk.Index,
+		ChunkSize:    chunk.Size,
+		FilePath:     chunk.FilePath,
+	}
+
+	var reply rpcChunkServer.CreateChunkReply
+	err = conn.Call("ChunkServerAPI.CreateChunk", args, &reply)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &remoteChunk{conn: conn, chunk: chunk}, nil
+}
+
+// write transfers data to chunk server and writes it to the chunk at given offset
+func (r *remoteChunk) write(data []byte, offset int) error {
+	checkSum := checksum.CalculateCheckSum(data)
+
+	transferDataArgs := rpcChunkServer.TransferDataArgs{
+		Data:     data,
+		CheckSum: checkSum,
+	}
+
+	var transferDataReply rpcChunkServer.TransferDataReply
+	err := r.conn.Call("ChunkServerAPI.TransferData", transferDataArgs, &transferDataReply)
+	if err != nil {
+		return err
+	}
+
+	applyMigrationArgs := rpcChunkServer.ApplyMigrationArgs{
+		ChunkID:  r.chunk.ID,
+		CheckSum: checkSum,
+		Offset:   offset,
+		Version:  r.chunk.Version,
+	}
+
+	var applyMigrationReply rpcChunkServer.ApplyMigrationReply
+	return r.conn.Call("ChunkServerAPI.ApplyMigration", applyMigrationArgs, &applyMigrationReply)
+}
+
+func (r *remoteChunk) close() {
+	r.conn.Close()
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/rpc/master"
+)
+
+// Balance starts, stops or queries cluster rebalancer depending on given action
+func (c *Client) Balance(action master.BalanceAction) (*master.BalanceReply, error) {
+	args := master.BalanceArgs{
+		Action: action,
+	}
+	var reply master.BalanceReply
+
+	err := c.RpcClient.Call("MasterAPI.Balance", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// Decommission starts draining chunk server with given ID and returns its progress
+func (c *Client) Decommission(chunkServerID uuid.UUID) (*master.DecommissionProgress, error) {
+	args := master.DecommissionArgs{
+		ChunkServerID: chunkServerID,
+	}
+	var reply master.DecommissionReply
+
+	err := c.RpcClient.Call("MasterAPI.Decommission", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply.Progress, nil
+}
+
+// DecommissionStatus returns decommissioning progress of chunk server with given ID or of all chunk servers if ID is not set
+func (c *Client) DecommissionStatus(chunkServerID uuid.UUID) ([]master.DecommissionProgress, error) {
+	args := master.DecommissionStatusArgs{
+		ChunkServerID: chunkServerID,
+	}
+	var reply master.DecommissionStatusReply
+
+	err := c.RpcClient.Call("MasterAPI.DecommissionStatus", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.ChunkServers, nil
+}
@@ -1,106 +1,105 @@
 package client
 
 import (
-	"errors"
+	"container/list"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/pyropy/dfs/core/model"
-	"github.com/pyropy/dfs/lib/cmap"
-	"github.com/pyropy/dfs/lib/utils"
+	"github.com/pyropy/dfs/rpc/master"
 )
 
-var (
-	ErrChunkNotFound = errors.New("chunk not found")
+const (
+	// DefaultChunkCacheSize is default number of chunk locations kept in cache
+	DefaultChunkCacheSize = 10000
+	// DefaultChunkCacheTTL is default duration after which cached chunk location is fetched from master again
+	DefaultChunkCacheTTL = time.Minute
 )
 
-type ChunkMetadataStore struct {
-	Chunks cmap.Map[uuid.UUID, model.ChunkMetadata]
+type cachedChunk struct {
+	location  master.ChunkLocation
+	expiresAt time.Time
 }
 
-func NewChunkMetadataStore() (*ChunkMetadataStore, error) {
-	return &ChunkMetadataStore{
-		Chunks: cmap.NewMap[uuid.UUID, model.ChunkMetadata](),
-	}, nil
+// ChunkMetadataStore is bounded cache of chunk locations and versions fetched from master.
+// Entries expire after TTL and least recently used entries are evicted once capacity is reached.
+type ChunkMetadataStore struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	chunks   map[uuid.UUID]*list.Element
+	order    *list.List
 }
 
-func NewChunkMetadata(chunkID uuid.UUID, index, version int, chunkServerIds []uuid.UUID) model.ChunkMetadata {
-	return model.ChunkMetadata{
-		Chunk: model.Chunk{
-			ID:      chunkID,
-			Index:   index,
-			Version: version,
-		},
-		ChunkServers: chunkServerIds,
+func NewChunkMetadataStore(capacity int, ttl time.Duration) *ChunkMetadataStore {
+	return &ChunkMetadataStore{
+		capacity: capacity,
+		ttl:      ttl,
+		chunks:   make(map[uuid.UUID]*list.Element),
+		order:    list.New(),
 	}
 }
 
-func (cs *ChunkMetadataStore) AddNewChunkMetadata(chunk model.ChunkMetadata) {
-	cs.Chunks.Set(chunk.ID, chunk)
-}
-
-func (cs *ChunkMetadataStore) GetChunkHolders(chunkID uuid.UUID) []uuid.UUID {
-	chunk, chunkExists := cs.Chunks.Get(chunkID)
+// Get returns cached location of the chunk if it has not expired yet
+func (cs *ChunkMetadataStore) Get(chunkID uuid.UUID) (*master.ChunkLocation, bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
 
-	if !chunkExists {
-		return []uuid.UUID{}
+	elem, exists := cs.chunks[chunkID]
+	if !exists {
+		return nil, false
 	}
 
-	return chunk.ChunkServers
-}
-
-func (cs *ChunkMetadataStore) GetChunk(chunkID uuid.UUID) (*model.ChunkMetadata, error) {
-
-	chunk, chunkExists := cs.Chunks.Get(chunkID)
-	if !chunkExists {
-		return nil, ErrChunkNotFound
+	entry := elem.Value.(*cachedChunk)
+	if time.Now().After(entry.expiresAt) {
+		cs.remove(elem)
+		return nil, false
 	}
 
-	return chunk, nil
-}
+	cs.order.MoveToFront(elem)
 
-func (cs *ChunkMetadataStore) IncrementChunkVersion(chunkID uuid.UUID) (int, error) {
+	// callers are free to reorder replicas
+	location := entry.location
+	location.ChunkServers = append([]master.ChunkServer{}, entry.location.ChunkServers...)
 
-	chunk, chunkExists := cs.Chunks.Get(chunkID)
-	if !chunkExists {
-		return 0, ErrChunkNotFound
-	}
+	return &location, true
+}
 
-	chunk.Version++
-	cs.Chunks.Set(chunkID, *chunk)
+// Set caches given chunk locations
+func (cs *ChunkMetadataStore) Set(locations ...master.ChunkLocation) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
 
-	return chunk.Version, nil
-}
+	expiresAt := time.Now().Add(cs.ttl)
+	for _, location := range locations {
+		location.ChunkServers = append([]master.ChunkServer{}, location.ChunkServers...)
+		entry := &cachedChunk{location: location, expiresAt: expiresAt}
 
-// UpdateChunksLocation updates chunk location on chunk server heart beat reported to master
-func (cs *ChunkMetadataStore) UpdateChunksLocation(chunkHolder uuid.UUID, chunks []model.ChunkMetadata) {
-	for _, c := range chunks {
-		chunk, chunkExists := cs.Chunks.Get(c.ID)
-		if !chunkExists {
-			cp := c
-			chunk = &cp
+		if elem, exists := cs.chunks[location.ChunkID]; exists {
+			elem.Value = entry
+			cs.order.MoveToFront(elem)
+			continue
 		}
 
-		if !utils.Contains(chunk.ChunkServers, chunkHolder) {
-			chunk.ChunkServers = append(chunk.ChunkServers, chunkHolder)
-			cs.Chunks.Set(chunk.ID, *chunk)
+		cs.chunks[location.ChunkID] = cs.order.PushFront(entry)
+		if cs.order.Len() > cs.capacity {
+			cs.remove(cs.order.Back())
 		}
 	}
 }
 
-// RemoveChunkHolder removes given chunk holder from list of chunk holders for all chunks
-func (cs *ChunkMetadataStore) RemoveChunkHolder(chunkHolderID uuid.UUID) {
-	cs.Chunks.Range(func(k, v any) bool {
-		chunkMetadata := v.(model.ChunkMetadata)
-		chunkServers := make([]uuid.UUID, 0)
+// Invalidate removes chunk location from cache so that it is fetched from master on next access
+func (cs *ChunkMetadataStore) Invalidate(chunkID uuid.UUID) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
 
-		for _, chunkServerID := range chunkMetadata.ChunkServers {
-			if chunkHolderID != chunkServerID {
-				chunkServers = append(chunkServers, chunkServerID)
-			}
-		}
+	if elem, exists := cs.chunks[chunkID]; exists {
+		cs.remove(elem)
+	}
+}
 
-		chunkMetadata.ChunkServers = chunkServers
-		cs.Chunks.Set(chunkMetadata.ID, chunkMetadata)
-		return true
-	})
+func (cs *ChunkMetadataStore) remove(elem *list.Element) {
+	entry := elem.Value.(*cachedChunk)
+	cs.order.Remove(elem)
+	delete(cs.chunks, entry.location.ChunkID)
 }
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/rpc"
 	"sync"
+	"time"
 
 	"github.com/pyropy/dfs/lib/checksum"
 
-	"github.com/pyropy/dfs/core/constants"
 	"github.com/pyropy/dfs/lib/logger"
 	"github.com/pyropy/dfs/rpc/chunkserver"
 	"github.com/pyropy/dfs/rpc/master"
@@ -19,64 +22,66 @@ import (
 	"github.com/google/uuid"
 )
 
-const ChunkSizeBytes = 64 * 10e+6
-
 var (
-	log, _          = logger.New("client")
-	ErrFileNotFound = errors.New("file not found")
+	log, _                = logger.New("client")
+	ErrFileNotFound       = errors.New("file not found")
+	ErrInvalidReadRange   = errors.New("invalid read range")
+	ErrNoReplicaAvailable = errors.New("no replica available for chunk")
+	ErrInvalidWriteRange  = errors.New("invalid write range")
+	ErrRecordTooLarge     = errors.New("record exceeds maximum record size")
+	ErrAppendFailed       = errors.New("record append failed after too many attempts")
 )
 
+// MaxRecordSize returns maximum size of single record appended to file with given chunk size
+func MaxRecordSize(chunkSize int) int {
+	return chunkSize / 4
+}
+
+// maxAppendAttempts limits number of times record append is retried, either on the next chunk
+// once current one is full or after failure of primary or one of secondaries
+const maxAppendAttempts = 8
+
+// appendRetryDelay is time waited before failed record append is retried, giving master
+// time to notice failed chunk server or lease to be given up
+const appendRetryDelay = 500 * time.Millisecond
+
+// maxReadAttempts limits number of times chunk read is retried with location re-queried from master
+const maxReadAttempts = 2
+
 type Client struct {
 	*ChunkMetadataStore
-	*FileMetadataStore
 
 	RpcClient *rpc.Client
 }
 
-func NewClient(masterAddr string, dsPath string) (*Client, error) {
+func NewClient(masterAddr string) (*Client, error) {
 	rpcClient, err := rpc.DialHTTP("tcp", masterAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	chunkMetadataService, err := NewChunkMetadataStore()
-	if err != nil {
-		return nil, err
-	}
-
-	fileMetadataService, err := NewFileMetadataStore(dsPath)
-	if err != nil {
-		return nil, err
-	}
-
 	return &Client{
 		RpcClient:          rpcClient,
-		ChunkMetadataStore: chunkMetadataService,
-		FileMetadataStore:  fileMetadataService,
+		ChunkMetadataStore: NewChunkMetadataStore(DefaultChunkCacheSize, DefaultChunkCacheTTL),
 	}, nil
 }
 
-func (c *Client) CreateNewFile(path string, size int) (*master.CreateNewFileReply, error) {
+// CreateNewFile creates file of given size. Default replication factor and chunk size are used if they are 0.
+func (c *Client) CreateNewFile(path string, size int, replicationFactor int, chunkSize int) (*master.CreateNewFileReply, error) {
 	var reply master.CreateNewFileReply
-	args := &master.CreateNewFileArgs{Path: path, Size: size}
+	args := &master.CreateNewFileArgs{Path: path, Size: size, ReplicationFactor: replicationFactor, ChunkSize: chunkSize}
 
 	err := c.RpcClient.Call("MasterAPI.CreateNewFile", args, &reply)
 	if err != nil {
 		return nil, err
 	}
 
-	// Chunks ids are generated sequentually hence we can index them by iterrating over chunk ids reply
-	for chunkIndex, chunkId := range reply.Chunks {
-		chunkMetadata := NewChunkMetadata(chunkId, chunkIndex, constants.INITIAL_CHUNK_VERSION, reply.ChunkServerIDs)
-		c.AddNewChunkMetadata(chunkMetadata)
-
-	}
-
 	return &reply, nil
 }
 
-func (c *Client) RequestChunkWrite(chunkID uuid.UUID) (*master.RequestWriteReply, error) {
+func (c *Client) RequestChunkWrite(path string, chunkID uuid.UUID) (*master.RequestWriteReply, error) {
 	args := master.RequestWriteArgs{
+		Path:    path,
 		ChunkID: chunkID,
 	}
 	var reply master.RequestWriteReply
@@ -89,6 +94,37 @@ func (c *Client) RequestChunkWrite(chunkID uuid.UUID) (*master.RequestWriteReply
 	return &reply, nil
 }
 
+// GetFileInfo returns file metadata and locations of its chunks from master. Returned chunk locations are cached.
+func (c *Client) GetFileInfo(path string) (*master.GetFileInfoReply, error) {
+	args := master.GetFileInfoArgs{
+		Path: path,
+	}
+	var reply master.GetFileInfoReply
+	err := c.RpcClient.Call("MasterAPI.GetFileInfo", args, &reply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.ChunkMetadataStore.Set(reply.Chunks...)
+	return &reply, nil
+}
+
+// GetChunkLocations returns current version and replicas of given chunks from master
+func (c *Client) GetChunkLocations(chunkIDs []uuid.UUID) ([]master.ChunkLocation, error) {
+	args := master.GetChunkLocationsArgs{
+		ChunkIDs: chunkIDs,
+	}
+	var reply master.GetChunkLocationsReply
+	err := c.RpcClient.Call("MasterAPI.GetChunkLocations", args, &reply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Chunks, nil
+}
+
 func min(x, y int) int {
 	if x < y {
 		return x
@@ -98,29 +134,30 @@ func min(x, y int) int {
 }
 
 func (c *Client) WriteFile(ctx context.Context, path string, data *bytes.Buffer, offset int) (int, error) {
-	fileMetadata, err := c.FileMetadataStore.Get(ctx, path)
+	fileInfo, err := c.GetFileInfo(path)
 	if err != nil {
 		return 0, err
 	}
 
-	if fileMetadata == nil {
-		return 0, ErrFileNotFound
+	chunkSize := fileInfo.ChunkSize
+	if offset < 0 || offset+data.Len() > len(fileInfo.Chunks)*chunkSize {
+		return 0, ErrInvalidWriteRange
 	}
 
 	totalBytesWritten := 0
 	remainingBytes := data.Len()
-	chunkStartOffset := offset % constants.CHUNK_SIZE_BYTES
+	chunkStartOffset := offset % chunkSize
 
-	for chunkIdx := offset / constants.CHUNK_SIZE_BYTES; remainingBytes > 0; chunkIdx++ {
+	for chunkIdx := offset / chunkSize; remainingBytes > 0; chunkIdx++ {
 		log.Debugw("WriteFile", "chunkIndex", chunkIdx, "remainingBytes", remainingBytes, "chunkStartOffset", chunkStartOffset)
-		bytesToWrite := min(constants.CHUNK_SIZE_BYTES-chunkStartOffset, remainingBytes)
+		bytesToWrite := min(chunkSize-chunkStartOffset, remainingBytes)
 		b, err := ioutil.ReadAll(io.LimitReader(data, int64(bytesToWrite)))
 		if err != nil {
 			return totalBytesWritten, err
 		}
 
-		chunkId := fileMetadata.Chunks[chunkIdx]
-		bytesWritten, err := c.WriteChunk(chunkId, b, chunkStartOffset)
+		chunkId := fileInfo.Chunks[chunkIdx].ChunkID
+		_, bytesWritten, err := c.WriteChunk(path, chunkId, b, chunkStartOffset)
 		if err != nil {
 			return totalBytesWritten, err
 		}
@@ -135,52 +172,28 @@ func (c *Client) WriteFile(ctx context.Context, path string, data *bytes.Buffer,
 }
 
 // WriteChunk sends request for write to master, pushes bytes to all chunk servers that hold copy of the chunk
-// and sends request for write to chunk server that holds the lease granted by the master
-func (c *Client) WriteChunk(chunkID uuid.UUID, data []byte, offset int) (int, error) {
-	var bytesWritten int
-	var wg sync.WaitGroup
-
-	writeRequest, err := c.RequestChunkWrite(chunkID)
+// and sends request for write to chunk server that holds the lease granted by the master.
+// ID of the chunk written to is returned as it differs from given one if chunk was copied on write.
+func (c *Client) WriteChunk(path string, chunkID uuid.UUID, data []byte, offset int) (uuid.UUID, int, error) {
+	writeRequest, err := c.RequestChunkWrite(path, chunkID)
 	if err != nil {
-		return bytesWritten, err
+		return chunkID, 0, err
 	}
 
-	log.Debugw("starting pushing data to chunk servers", "numChunkservers", len(writeRequest.ChunkServers), "lenBytes", len(data))
-	// push bytes in parallel
-	for _, cs := range writeRequest.ChunkServers {
-		wg.Add(1)
-		go func(chunkServer master.ChunkServer) {
-			defer wg.Done()
-			resp, err := c.SendBytes(chunkServer.Address, data)
-			log.Debugw("send bytes response", "bytesReceived", resp.NumBytesReceived, "err", err)
-		}(cs)
-	}
+	// granting new lease bumps chunk version
+	c.ChunkMetadataStore.Invalidate(writeRequest.ChunkID)
 
-	wg.Wait()
-
-	// find address of lease server
-	var leaseAddr string
-	for _, cs := range writeRequest.ChunkServers {
-		if cs.ID == writeRequest.PrimaryChunkServerID {
-			leaseAddr = cs.Address
-			break
-		}
-	}
+	chunkID = writeRequest.ChunkID
+	c.pushData(writeRequest.ChunkServers, data)
 
-	rpcClient, err := rpc.DialHTTP("tcp", leaseAddr)
+	rpcClient, err := rpc.DialHTTP("tcp", primaryAddress(writeRequest))
 	if err != nil {
-		return 0, err
+		return chunkID, 0, err
 	}
 
 	defer rpcClient.Close()
 
-	// TODO: stupid cast, fix
-	var chunkServers []chunkserver.ChunkServer
-	for _, cs := range writeRequest.ChunkServers {
-		chunkServer := chunkserver.ChunkServer(cs)
-		chunkServers = append(chunkServers, chunkServer)
-	}
-
+	chunkServers := toChunkServers(writeRequest.ChunkServers)
 	checkSum := checksum.CalculateCheckSum(data)
 	args := chunkserver.WriteChunkArgs{
 		ChunkID:      chunkID,
@@ -193,10 +206,164 @@ func (c *Client) WriteChunk(chunkID uuid.UUID, data []byte, offset int) (int, er
 	var reply chunkserver.WriteChunkReply
 	err = rpcClient.Call("ChunkServerAPI.WriteChunk", args, &reply)
 	if err != nil {
-		return 0, err
+		return chunkID, 0, err
 	}
 	log.Debugw("Bytes written")
-	return reply.BytesWritten, nil
+	return chunkID, reply.BytesWritten, nil
+}
+
+// Snapshot creates copy of file or directory at given path
+func (c *Client) Snapshot(ctx context.Context, srcPath string, dstPath string) error {
+	args := master.SnapshotArgs{
+		SrcPath: srcPath,
+		DstPath: dstPath,
+	}
+	var reply master.SnapshotReply
+
+	return c.RpcClient.Call("MasterAPI.Snapshot", args, &reply)
+}
+
+// AppendRecord appends data to the end of file at offset chosen by primary chunk server and returns
+// offset in the file at which record was written. Record is appended atomically at least once,
+// if append fails on any replica it is retried with primary and data requested again, at cost of record
+// possibly being duplicated in the replicas where it did succeed.
+func (c *Client) AppendRecord(ctx context.Context, path string, data []byte) (int, error) {
+	var appendErr error
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		if appendErr != nil {
+			select {
+			case <-time.After(appendRetryDelay):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		appendRequest, err := c.RequestRecordAppend(path)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(data) > MaxRecordSize(appendRequest.ChunkSize) {
+			return 0, ErrRecordTooLarge
+		}
+
+		c.ChunkMetadataStore.Invalidate(appendRequest.ChunkID)
+
+		c.pushData(appendRequest.ChunkServers, data)
+
+		args := chunkserver.RecordAppendArgs{
+			ChunkID:      appendRequest.ChunkID,
+			CheckSum:     checksum.CalculateCheckSum(data),
+			Version:      appendRequest.Version,
+			ChunkServers: toChunkServers(appendRequest.ChunkServers),
+		}
+
+		// failed secondary, lost lease or unreachable primary are all retried with new primary and replicas
+		reply, err := c.recordAppend(primaryAddress(&appendRequest.RequestWriteReply), args)
+		if err != nil {
+			log.Debugw("record append failed, retrying", "chunkID", appendRequest.ChunkID, "attempt", attempt, "error", err)
+			appendErr = err
+			continue
+		}
+
+		appendErr = nil
+		if reply.ChunkFull {
+			log.Debugw("chunk full, moving to next chunk", "chunkIndex", appendRequest.ChunkIndex)
+			err = c.AllocateChunk(path, appendRequest.ChunkIndex+1)
+			if err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		return appendRequest.ChunkIndex*appendRequest.ChunkSize + reply.Offset, nil
+	}
+
+	if appendErr != nil {
+		return 0, fmt.Errorf("%w: %v", ErrAppendFailed, appendErr)
+	}
+
+	return 0, ErrAppendFailed
+}
+
+func (c *Client) RequestRecordAppend(path string) (*master.RequestRecordAppendReply, error) {
+	args := master.RequestRecordAppendArgs{
+		Path: path,
+	}
+	var reply master.RequestRecordAppendReply
+	err := c.RpcClient.Call("MasterAPI.RequestRecordAppend", args, &reply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// AllocateChunk asks master to add chunk at given index to the file if it does not exist yet
+func (c *Client) AllocateChunk(path string, chunkIndex int) error {
+	args := master.AllocateChunkArgs{
+		Path:       path,
+		ChunkIndex: chunkIndex,
+	}
+	var reply master.AllocateChunkReply
+
+	return c.RpcClient.Call("MasterAPI.AllocateChunk", args, &reply)
+}
+
+func (c *Client) recordAppend(addr string, args chunkserver.RecordAppendArgs) (*chunkserver.RecordAppendReply, error) {
+	rpcClient, err := rpc.DialHTTP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rpcClient.Close()
+
+	var reply chunkserver.RecordAppendReply
+	err = rpcClient.Call("ChunkServerAPI.RecordAppend", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// pushData pushes bytes to all given chunk servers in parallel
+func (c *Client) pushData(chunkServers []master.ChunkServer, data []byte) {
+	var wg sync.WaitGroup
+
+	log.Debugw("starting pushing data to chunk servers", "numChunkservers", len(chunkServers), "lenBytes", len(data))
+	for _, cs := range chunkServers {
+		wg.Add(1)
+		go func(chunkServer master.ChunkServer) {
+			defer wg.Done()
+			_, err := c.SendBytes(chunkServer.Address, data)
+			log.Debugw("send bytes response", "chunkServer", chunkServer.Address, "err", err)
+		}(cs)
+	}
+
+	wg.Wait()
+}
+
+// primaryAddress returns address of chunk server that holds the lease
+func primaryAddress(writeRequest *master.RequestWriteReply) string {
+	for _, cs := range writeRequest.ChunkServers {
+		if cs.ID == writeRequest.PrimaryChunkServerID {
+			return cs.Address
+		}
+	}
+
+	return ""
+}
+
+func toChunkServers(chunkServers []master.ChunkServer) []chunkserver.ChunkServer {
+	var result []chunkserver.ChunkServer
+	for _, cs := range chunkServers {
+		result = append(result, chunkserver.ChunkServer(cs))
+	}
+
+	return result
 }
 
 func (c *Client) SendBytes(addr string, data []byte) (*chunkserver.TransferDataReply, error) {
@@ -221,3 +388,165 @@ func (c *Client) SendBytes(addr string, data []byte) (*chunkserver.TransferDataR
 
 	return &reply, nil
 }
+
+// ReadFile reads length bytes of file starting at given offset. If length is -1 file is read until its end.
+// Data appended to the file past its size known to master is read as well, so fewer bytes than
+// requested are returned once the end of written data is reached. Chunks of erasure coded file
+// that cannot be read are reconstructed from the rest of their stripe.
+func (c *Client) ReadFile(ctx context.Context, path string, offset, length int) ([]byte, error) {
+	fileInfo, err := c.GetFileInfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ReadFileAt(ctx, fileInfo, offset, length)
+}
+
+// ReadFileAt reads length bytes of file described by previously fetched file info starting at given offset.
+// It lets callers reading file in parts fetch file info once, chunk locations are resolved through cache.
+func (c *Client) ReadFileAt(ctx context.Context, fileInfo *master.GetFileInfoReply, offset, length int) ([]byte, error) {
+	chunkSize := fileInfo.ChunkSize
+	maxSize := len(fileInfo.Chunks) * chunkSize
+	if length == -1 {
+		length = maxSize - offset
+	}
+
+	if offset < 0 || length < 0 || offset+length > maxSize {
+		return nil, ErrInvalidReadRange
+	}
+
+	data := make([]byte, 0)
+	remainingBytes := length
+	chunkStartOffset := offset % chunkSize
+
+	for chunkIdx := offset / chunkSize; remainingBytes > 0; chunkIdx++ {
+		log.Debugw("ReadFile", "chunkIndex", chunkIdx, "remainingBytes", remainingBytes, "chunkStartOffset", chunkStartOffset)
+		bytesToRead := min(chunkSize-chunkStartOffset, remainingBytes)
+
+		b, err := c.ReadChunk(fileInfo.Chunks[chunkIdx].ChunkID, chunkStartOffset, bytesToRead)
+		if err != nil && fileInfo.DataShards > 0 {
+			log.Debugw("ReadFile", "status", "reconstructing chunk from its stripe", "chunkIndex", chunkIdx, "err", err)
+			b, err = c.reconstructChunk(fileInfo, chunkIdx, chunkStartOffset, bytesToRead)
+		}
+
+		if err != nil {
+			return data, err
+		}
+
+		// Regions of the chunk that were never written are read as zeros up to the file size
+		chunkPos := chunkIdx*chunkSize + chunkStartOffset
+		if fill := min(bytesToRead, fileInfo.Size-chunkPos) - len(b); fill > 0 {
+			b = append(b, make([]byte, fill)...)
+		}
+
+		data = append(data, b...)
+		if len(b) < bytesToRead {
+			break
+		}
+
+		chunkStartOffset = 0
+		remainingBytes -= bytesToRead
+	}
+
+	return data, nil
+}
+
+// ReadChunk reads data from one of the chunk replicas. Chunk location is taken from cache or asked from master
+// if it is not cached. If no replica could serve the read, location is re-queried from master and read is retried.
+func (c *Client) ReadChunk(chunkID uuid.UUID, offset, length int) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < maxReadAttempts; attempt++ {
+		var location *master.ChunkLocation
+		location, err = c.chunkLocation(chunkID)
+		if err != nil {
+			return nil, err
+		}
+
+		var data []byte
+		data, err = c.readChunk(*location, offset, length)
+		if err == nil {
+			return data, nil
+		}
+
+		c.ChunkMetadataStore.Invalidate(chunkID)
+	}
+
+	return nil, err
+}
+
+// chunkLocation returns cached chunk location or asks master for it on cache miss
+func (c *Client) chunkLocation(chunkID uuid.UUID) (*master.ChunkLocation, error) {
+	location, cached := c.ChunkMetadataStore.Get(chunkID)
+	if cached {
+		return location, nil
+	}
+
+	locations, err := c.GetChunkLocations([]uuid.UUID{chunkID})
+	if err != nil {
+		return nil, err
+	}
+
+	c.ChunkMetadataStore.Set(locations...)
+	return &locations[0], nil
+}
+
+// readChunk reads data from one of the chunk replicas. Replicas are tried in random order
+// until one with matching chunk version responds. Cached location is invalidated if any
+// of the replicas turns out to be unreachable or to hold different version of the chunk.
+func (c *Client) readChunk(location master.ChunkLocation, offset, length int) ([]byte, error) {
+	replicas := location.ChunkServers
+	rand.Shuffle(len(replicas), func(i, j int) {
+		replicas[i], replicas[j] = replicas[j], replicas[i]
+	})
+
+	for _, cs := range replicas {
+		reply, err := c.readFromReplica(cs.Address, location.ChunkID, offset, length, location.Version)
+		if err != nil {
+			log.Debugw("failed to read chunk from replica", "chunkID", location.ChunkID, "chunkServer", cs.Address, "err", err)
+			if isStaleLocation(err) {
+				c.ChunkMetadataStore.Invalidate(location.ChunkID)
+			}
+
+			continue
+		}
+
+		return reply.Data, nil
+	}
+
+	return nil, ErrNoReplicaAvailable
+}
+
+// isStaleLocation checks if error returned by replica means that cached chunk location is no longer valid
+func isStaleLocation(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, rpc.ErrShutdown) {
+		return true
+	}
+
+	msg := err.Error()
+	return msg == chunkserver.ErrChunkVersionMismatch.Error() || msg == chunkserver.ErrChunkDoesNotExist.Error()
+}
+
+func (c *Client) readFromReplica(addr string, chunkID uuid.UUID, offset, length, version int) (*chunkserver.ReadChunkReply, error) {
+	rpcClient, err := rpc.DialHTTP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rpcClient.Close()
+
+	args := chunkserver.ReadChunkArgs{
+		ChunkID: chunkID,
+		Offset:  offset,
+		Length:  length,
+		Version: version,
+	}
+
+	var reply chunkserver.ReadChunkReply
+	err = rpcClient.Call("ChunkServerAPI.ReadChunk", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
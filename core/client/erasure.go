@@ -0,0 +1,71 @@
+package client
+
+import (
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/lib/erasure"
+	"github.com/pyropy/dfs/rpc/master"
+)
+
+// SetErasureCoding converts replicated file into erasure coded file stored with given policy, e.g. RS-6-3
+func (c *Client) SetErasureCoding(path string, policy string) error {
+	args := master.SetErasureCodingArgs{
+		Path:   path,
+		Policy: policy,
+	}
+	var reply master.SetErasureCodingReply
+
+	return c.RpcClient.Call("MasterAPI.SetErasureCoding", args, &reply)
+}
+
+// reconstructChunk decodes range of erasure coded data chunk from the rest of its stripe. Any DataShards
+// chunks of the stripe are enough, data chunks are tried before parity chunks since reading them
+// makes decoding cheaper.
+func (c *Client) reconstructChunk(fileInfo *master.GetFileInfoReply, chunkIdx, offset, length int) ([]byte, error) {
+	code, err := erasure.New(fileInfo.DataShards, fileInfo.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	stripe := fileInfo.Stripes[chunkIdx/fileInfo.DataShards]
+	lost := chunkIdx % fileInfo.DataShards
+
+	shards := make([][]byte, len(stripe.Chunks))
+	available := 0
+	for i, location := range stripe.Chunks {
+		if available == fileInfo.DataShards {
+			break
+		}
+
+		if i == lost {
+			continue
+		}
+
+		var data []byte
+		if location.ChunkID != uuid.Nil {
+			data, err = c.readChunk(location, offset, length)
+			if err != nil {
+				log.Debugw("stripe chunk unavailable", "chunkID", location.ChunkID, "err", err)
+				continue
+			}
+		}
+
+		shards[i] = append(data, make([]byte, length-len(data))...)
+		available++
+	}
+
+	if available < fileInfo.DataShards {
+		return nil, ErrNoReplicaAvailable
+	}
+
+	err = code.Reconstruct(shards)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := min(length, stripe.Lengths[lost]-offset)
+	if valid < 0 {
+		valid = 0
+	}
+
+	return shards[lost][:valid], nil
+}
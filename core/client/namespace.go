@@ -0,0 +1,117 @@
+package client
+
+import (
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/rpc/master"
+)
+
+// Mkdir creates directory at given path. If parents is set missing parent directories are created as well.
+func (c *Client) Mkdir(path string, parents bool) error {
+	args := master.MkdirArgs{
+		Path:    path,
+		Parents: parents,
+	}
+	var reply master.MkdirReply
+
+	return c.RpcClient.Call("MasterAPI.Mkdir", args, &reply)
+}
+
+// ListDirectory lists directory entries page by page, calling fn for each of them
+func (c *Client) ListDirectory(path string, recursive bool, fn func(entry master.FileStatus) error) error {
+	args := master.ListDirectoryArgs{
+		Path:      path,
+		Recursive: recursive,
+	}
+
+	for {
+		var reply master.ListDirectoryReply
+		err := c.RpcClient.Call("MasterAPI.ListDirectory", args, &reply)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range reply.Entries {
+			err = fn(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !reply.HasMore || len(reply.Entries) == 0 {
+			return nil
+		}
+
+		args.StartAfter = reply.Entries[len(reply.Entries)-1].Path
+	}
+}
+
+// Stat returns status of file or directory at given path
+func (c *Client) Stat(path string) (*master.FileStatus, error) {
+	args := master.StatArgs{
+		Path: path,
+	}
+	var reply master.StatReply
+
+	err := c.RpcClient.Call("MasterAPI.Stat", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply.FileStatus, nil
+}
+
+// DeleteFile moves file or directory to trash. Non empty directory is deleted only if recursive is set.
+func (c *Client) DeleteFile(path string, recursive bool) error {
+	args := master.DeleteFileArgs{
+		Path:      path,
+		Recursive: recursive,
+	}
+	var reply master.DeleteFileReply
+
+	return c.RpcClient.Call("MasterAPI.DeleteFile", args, &reply)
+}
+
+// Undelete restores file from trash. If id is not given most recently deleted file from given path is restored.
+func (c *Client) Undelete(path string, id uuid.UUID) (*master.UndeleteReply, error) {
+	args := master.UndeleteArgs{
+		Path: path,
+		ID:   id,
+	}
+	var reply master.UndeleteReply
+
+	err := c.RpcClient.Call("MasterAPI.Undelete", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+// ListTrash returns deleted files that can still be restored
+func (c *Client) ListTrash() ([]master.TrashedFile, error) {
+	args := master.ListTrashArgs{}
+	var reply master.ListTrashReply
+
+	err := c.RpcClient.Call("MasterAPI.ListTrash", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Files, nil
+}
+
+// SetReplication sets replication factor of the file, or of all files under the directory, and returns number of files updated
+func (c *Client) SetReplication(path string, replicationFactor int) (int, error) {
+	args := master.SetReplicationArgs{
+		Path:              path,
+		ReplicationFactor: replicationFactor,
+	}
+	var reply master.SetReplicationReply
+
+	err := c.RpcClient.Call("MasterAPI.SetReplication", args, &reply)
+	if err != nil {
+		return 0, err
+	}
+
+	return reply.Files, nil
+}
@@ -1,5 +1,20 @@
 package constants
 
 const INITIAL_CHUNK_VERSION = 1
-const CHUNK_SIZE_BYTES = 64 * 10e+6
 const REPLICATION_FACTOR = 3
+const MAX_REPLICATION_FACTOR = 10
+
+// CHUNK_SIZE_BYTES is default size of file chunks
+const CHUNK_SIZE_BYTES = 64 << 20
+
+// MIN_CHUNK_SIZE_BYTES and MAX_CHUNK_SIZE_BYTES bound chunk size chosen per file,
+// chunk size has to be multiple of MIN_CHUNK_SIZE_BYTES
+const MIN_CHUNK_SIZE_BYTES = 64 << 10
+const MAX_CHUNK_SIZE_BYTES = 1 << 30
+
+// LEGACY_CHUNK_SIZE_BYTES is size of chunks of files created before chunk size was set per file
+const LEGACY_CHUNK_SIZE_BYTES = 640000000
+
+// MAX_STRIPE_WIDTH bounds number of data and parity chunks in erasure coded stripe,
+// each of them is placed on distinct chunk server
+const MAX_STRIPE_WIDTH = 32
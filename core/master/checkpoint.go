@@ -0,0 +1,219 @@
+package master
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyropy/dfs/core/model"
+)
+
+const (
+	checkpointMagic      = "DFSCKPT1"
+	checkpointHeaderSize = len(checkpointMagic) + 12
+	checkpointPrefix     = "checkpoint-"
+	checkpointSuffix     = ".ckpt"
+	// retainedCheckpoints is number of checkpoints kept on disk so that master can fall back
+	// to previous checkpoint if newest one is corrupted
+	retainedCheckpoints = 2
+)
+
+var (
+	ErrCorruptedCheckpoint = errors.New("corrupted checkpoint")
+)
+
+// Checkpoint is snapshot of master metadata taken after operation with sequence number Seq has been applied
+type Checkpoint struct {
+	Seq         uint64
+	Directories []model.DirectoryMetadata
+	Files       []model.FileMetadata
+	Trash       []model.FileMetadata
+	Chunks      []model.ChunkMetadata
+}
+
+type Checkpointer struct {
+	opLog    *OperationLog
+	interval time.Duration
+}
+
+func NewCheckpointer(opLog *OperationLog, interval time.Duration) *Checkpointer {
+	return &Checkpointer{
+		opLog:    opLog,
+		interval: interval,
+	}
+}
+
+// Start starts checkpoint loop where checkpoint of master metadata is taken on each interval
+// if there were any new operations since the last checkpoint.
+func (c *Checkpointer) Start(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	log.Info("starting checkpointer")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.opLog.Checkpoint()
+			if err != nil {
+				log.Errorw("checkpoint", "status", "failed to take checkpoint", "error", err)
+			}
+		}
+	}
+}
+
+func encodeCheckpoint(ckpt *Checkpoint) ([]byte, error) {
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+
+	err := json.NewEncoder(zw).Encode(ckpt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, checkpointHeaderSize, checkpointHeaderSize+payload.Len())
+	copy(data, checkpointMagic)
+	binary.BigEndian.PutUint64(data[len(checkpointMagic):], uint64(payload.Len()))
+	binary.BigEndian.PutUint32(data[len(checkpointMagic)+8:], crc32.ChecksumIEEE(payload.Bytes()))
+
+	return append(data, payload.Bytes()...), nil
+}
+
+func decodeCheckpoint(data []byte) (*Checkpoint, error) {
+	if len(data) < checkpointHeaderSize || string(data[:len(checkpointMagic)]) != checkpointMagic {
+		return nil, ErrCorruptedCheckpoint
+	}
+
+	length := binary.BigEndian.Uint64(data[len(checkpointMagic):])
+	checksum := binary.BigEndian.Uint32(data[len(checkpointMagic)+8:])
+	payload := data[checkpointHeaderSize:]
+
+	if uint64(len(payload)) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ErrCorruptedCheckpoint
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, ErrCorruptedCheckpoint
+	}
+
+	var ckpt Checkpoint
+	err = json.NewDecoder(zr).Decode(&ckpt)
+	if err != nil {
+		return nil, ErrCorruptedCheckpoint
+	}
+
+	return &ckpt, nil
+}
+
+// writeCheckpoint durably writes checkpoint to temporary file and renames it once it is complete
+// so that partially written checkpoint never has valid checkpoint name
+func writeCheckpoint(dirPath string, seq uint64, data []byte) error {
+	path := fp.Join(dirPath, sequencedFilename(checkpointPrefix, seq, checkpointSuffix))
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dirPath)
+}
+
+func readCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCheckpoint(data)
+}
+
+// listCheckpoints returns sequence numbers of checkpoints found in dir, newest first
+func listCheckpoints(dirPath string) ([]uint64, error) {
+	seqs, err := listSequenced(dirPath, checkpointPrefix, checkpointSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] > seqs[j]
+	})
+
+	return seqs, nil
+}
+
+func sequencedFilename(prefix string, seq uint64, suffix string) string {
+	return fmt.Sprintf("%s%020d%s", prefix, seq, suffix)
+}
+
+// listSequenced returns sequence numbers of files in dir whose names have given prefix and suffix
+func listSequenced(dirPath string, prefix, suffix string) ([]uint64, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+
+	return seqs, nil
+}
+
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -2,6 +2,7 @@ package master
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/model"
@@ -10,25 +11,50 @@ import (
 )
 
 var (
-	ErrChunkNotFound = errors.New("chunk not found")
+	ErrChunkNotFound       = errors.New("chunk not found")
+	ErrChunkVersionChanged = errors.New("chunk version changed")
+	ErrChunkChangePending  = errors.New("chunk holders are being changed")
 )
 
+// pendingChange is change of chunk holders in progress, targets are chunk servers chunk is being copied to
+type pendingChange struct {
+	refs    int
+	targets []uuid.UUID
+}
+
 type ChunkMetadataStore struct {
 	Chunks cmap.Map[uuid.UUID, model.ChunkMetadata]
+
+	// lock serializes updates of chunk metadata so that chunk holders are never changed
+	// based on version that has been incremented in the meantime
+	lock sync.Mutex
+
+	// pending holds chunks being created or having their holders changed by erasure coding or rebalancing. Copies
+	// on pending targets are not added to chunk holders from heart beats and replicas of pending
+	// chunks are not removed as excess, until the change is done. Guarded by lock.
+	pending map[uuid.UUID]*pendingChange
+
+	// refs holds number of files referencing each chunk, chunks referenced
+	// by more than one file are shared by snapshots and copied on write
+	refsLock sync.Mutex
+	refs     map[uuid.UUID]int
 }
 
 func NewChunkMetadataStore() *ChunkMetadataStore {
 	return &ChunkMetadataStore{
-		Chunks: cmap.NewMap[uuid.UUID, model.ChunkMetadata](),
+		Chunks:  cmap.NewMap[uuid.UUID, model.ChunkMetadata](),
+		pending: make(map[uuid.UUID]*pendingChange),
+		refs:    make(map[uuid.UUID]int),
 	}
 }
 
-func NewChunkMetadata(chunkID uuid.UUID, index, version int, filePath string, chunkServerIds []uuid.UUID) model.ChunkMetadata {
+func NewChunkMetadata(chunkID uuid.UUID, index, version, size int, filePath string, chunkServerIds []uuid.UUID) model.ChunkMetadata {
 	return model.ChunkMetadata{
 		Chunk: model.Chunk{
 			ID:       chunkID,
 			Index:    index,
 			Version:  version,
+			Size:     size,
 			FilePath: filePath,
 		},
 		ChunkServers: chunkServerIds,
@@ -59,36 +85,100 @@ func (cs *ChunkMetadataStore) GetChunk(chunkID uuid.UUID) (*model.ChunkMetadata,
 	return chunk, nil
 }
 
-func (cs *ChunkMetadataStore) IncrementChunkVersion(chunkID uuid.UUID) (int, error) {
+func (cs *ChunkMetadataStore) SetChunkVersion(chunkID uuid.UUID, version int) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
 	chunk, chunkExists := cs.Chunks.Get(chunkID)
 
 	if !chunkExists {
-		return 0, ErrChunkNotFound
+		return ErrChunkNotFound
+	}
+
+	chunk.Version = version
+	cs.Chunks.Set(chunkID, *chunk)
+
+	return nil
+}
+
+// SetReplicationFactor sets number of replicas chunk should be kept at
+func (cs *ChunkMetadataStore) SetReplicationFactor(chunkID uuid.UUID, replicationFactor int) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return
 	}
 
-	chunk.Version++
+	chunk.ReplicationFactor = replicationFactor
 	cs.Chunks.Set(chunkID, *chunk)
+}
 
-	return chunk.Version, nil
+// SetErasureCoded marks chunk as member of erasure coded stripe kept without replicas
+func (cs *ChunkMetadataStore) SetErasureCoded(chunkID uuid.UUID) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return
+	}
+
+	chunk.ErasureCoded = true
+	cs.Chunks.Set(chunkID, *chunk)
 }
 
-// UpdateChunksLocation updates chunk location on chunk server heart beat reported to master
-func (cs *ChunkMetadataStore) UpdateChunksLocation(chunkHolder uuid.UUID, chunks []model.ChunkMetadata) {
-	chunkIds := []uuid.UUID{}
+// UpdateChunksLocation updates chunk location on chunk server heart beat reported to master.
+// Replicas reported with version older than the one known to master are stale, they are not added
+// to chunk holders and their IDs are returned so that they can be deleted from chunk server.
+// Replicas reported with newer version are returned as well, since master has to persist their
+// version before it can treat them as valid. Chunk holders are only those that master has already
+// seen at current version, so older version reported by one of them comes from report sent before
+// the version was incremented and is ignored. Holders of pending targets are left to the change in progress.
+// Reported chunks unknown to master are orphans left by creations that never committed or by chunks removed
+// from metadata, their IDs are returned so that they can be deleted. Chunks being created are pending.
+func (cs *ChunkMetadataStore) UpdateChunksLocation(chunkHolder uuid.UUID, chunks []model.ChunkMetadata) ([]uuid.UUID, []uuid.UUID, []model.ChunkMetadata) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	reported := make(map[uuid.UUID]int)
+	for _, c := range chunks {
+		reported[c.ID] = c.Version
+	}
+
+	stale := make([]uuid.UUID, 0)
+	unknown := make([]uuid.UUID, 0)
+	newer := make([]model.ChunkMetadata, 0)
+
 	for _, c := range chunks {
-		chunkIds = append(chunkIds, c.ID)
+		_, known := cs.Chunks.Get(c.ID)
+		if _, pending := cs.pending[c.ID]; !known && !pending {
+			unknown = append(unknown, c.ID)
+		}
 	}
 
 	cs.Chunks.Range(func(k, v any) bool {
 		chunkID := k.(uuid.UUID)
 		chunk := v.(model.ChunkMetadata)
 		inChunkHolders := utils.Contains(chunk.ChunkServers, chunkHolder)
-		isCurrentlyHoldingChunk := utils.Contains(chunkIds, chunkID)
+		reportedVersion, isCurrentlyHoldingChunk := reported[chunkID]
 
 		switch {
+		case inChunkHolders && !isCurrentlyHoldingChunk && cs.isPendingTarget(chunkID, chunkHolder):
+			// report was sent before the copy to pending target completed
+			log.Debug("Pending")
 		case inChunkHolders && !isCurrentlyHoldingChunk:
 			chunk.ChunkServers = utils.Remove(chunk.ChunkServers, chunkHolder)
 			log.Debug("Removed")
+		case isCurrentlyHoldingChunk && reportedVersion > chunk.Version:
+			newer = append(newer, model.ChunkMetadata{Chunk: model.Chunk{ID: chunkID, Version: reportedVersion}})
+			log.Debug("Newer")
+		case !inChunkHolders && isCurrentlyHoldingChunk && reportedVersion < chunk.Version:
+			stale = append(stale, chunkID)
+			log.Debug("Stale")
+		case !inChunkHolders && isCurrentlyHoldingChunk && cs.isPendingTarget(chunkID, chunkHolder):
+			log.Debug("Pending")
 		case !inChunkHolders && isCurrentlyHoldingChunk:
 			chunk.ChunkServers = append(chunk.ChunkServers, chunkHolder)
 			log.Debug("Appended")
@@ -100,19 +190,213 @@ func (cs *ChunkMetadataStore) UpdateChunksLocation(chunkHolder uuid.UUID, chunks
 
 		return true
 	})
+
+	return stale, unknown, newer
+}
+
+// AddChunkHolder adds chunk server to chunk holders of given chunk
+func (cs *ChunkMetadataStore) AddChunkHolder(chunkID uuid.UUID, chunkHolderID uuid.UUID) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return ErrChunkNotFound
+	}
+
+	if !utils.Contains(chunk.ChunkServers, chunkHolderID) {
+		chunk.ChunkServers = append(chunk.ChunkServers, chunkHolderID)
+		cs.Chunks.Set(chunkID, *chunk)
+	}
+
+	return nil
+}
+
+// ReplaceChunkHolder replaces one chunk holder of given chunk with another if chunk is still at given version.
+// Replica copied before version was incremented missed the mutation, so it is not added.
+func (cs *ChunkMetadataStore) ReplaceChunkHolder(chunkID uuid.UUID, oldHolderID, newHolderID uuid.UUID, version int) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return ErrChunkNotFound
+	}
+
+	if chunk.Version != version {
+		return ErrChunkVersionChanged
+	}
+
+	chunk.ChunkServers = utils.Remove(chunk.ChunkServers, oldHolderID)
+	if !utils.Contains(chunk.ChunkServers, newHolderID) {
+		chunk.ChunkServers = append(chunk.ChunkServers, newHolderID)
+	}
+
+	cs.Chunks.Set(chunkID, *chunk)
+
+	return nil
+}
+
+// BeginChange marks chunk as having its holders changed, until matching EndChange is called
+func (cs *ChunkMetadataStore) BeginChange(chunkID uuid.UUID) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	change, exists := cs.pending[chunkID]
+	if !exists {
+		change = &pendingChange{}
+		cs.pending[chunkID] = change
+	}
+
+	change.refs++
+}
+
+// AddPendingTarget records chunk server chunk with pending change is being copied to
+func (cs *ChunkMetadataStore) AddPendingTarget(chunkID uuid.UUID, target uuid.UUID) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	change, exists := cs.pending[chunkID]
+	if exists && !utils.Contains(change.targets, target) {
+		change.targets = append(change.targets, target)
+	}
+}
+
+// EndChange ends change of chunk holders started by BeginChange
+func (cs *ChunkMetadataStore) EndChange(chunkID uuid.UUID) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	change, exists := cs.pending[chunkID]
+	if !exists {
+		return
+	}
+
+	change.refs--
+	if change.refs <= 0 {
+		delete(cs.pending, chunkID)
+	}
+}
+
+func (cs *ChunkMetadataStore) isPendingTarget(chunkID uuid.UUID, chunkHolderID uuid.UUID) bool {
+	change, exists := cs.pending[chunkID]
+	return exists && utils.Contains(change.targets, chunkHolderID)
+}
+
+// RemoveExcessHolder removes chunk holder whose replica is about to be deleted as excess. Holders of
+// chunk with pending change are not removed, since replicas it is left with are not known yet.
+func (cs *ChunkMetadataStore) RemoveExcessHolder(chunkHolderID uuid.UUID, chunkID uuid.UUID) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if _, pending := cs.pending[chunkID]; pending {
+		return ErrChunkChangePending
+	}
+
+	return cs.removeChunkHolderFromChunk(chunkHolderID, chunkID)
+}
+
+// KeepSingleHolder leaves chunk with single holder. Keeper is kept if it still holds the chunk or chunk is being
+// copied to it, otherwise one of current holders is kept, preferably one not in avoid. Kept holder is returned
+// together with removed holders whose replicas should be deleted, kept holder is uuid.Nil if chunk has none.
+func (cs *ChunkMetadataStore) KeepSingleHolder(chunkID uuid.UUID, keeper uuid.UUID, avoid []uuid.UUID) (uuid.UUID, []uuid.UUID, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return uuid.Nil, nil, ErrChunkNotFound
+	}
+
+	kept := uuid.Nil
+	if keeper != uuid.Nil && (utils.Contains(chunk.ChunkServers, keeper) || cs.isPendingTarget(chunkID, keeper)) {
+		kept = keeper
+	}
+
+	for _, holder := range chunk.ChunkServers {
+		if kept == uuid.Nil && !utils.Contains(avoid, holder) {
+			kept = holder
+		}
+	}
+
+	if kept == uuid.Nil && len(chunk.ChunkServers) > 0 {
+		kept = chunk.ChunkServers[0]
+	}
+
+	if kept == uuid.Nil {
+		return uuid.Nil, nil, nil
+	}
+
+	removed := utils.Remove(chunk.ChunkServers, kept)
+	chunk.ChunkServers = []uuid.UUID{kept}
+	cs.Chunks.Set(chunkID, *chunk)
+
+	return kept, removed, nil
+}
+
+// SetChunkHolders replaces chunk holders of given chunk
+func (cs *ChunkMetadataStore) SetChunkHolders(chunkID uuid.UUID, chunkHolders []uuid.UUID) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	chunk, chunkExists := cs.Chunks.Get(chunkID)
+	if !chunkExists {
+		return ErrChunkNotFound
+	}
+
+	chunk.ChunkServers = chunkHolders
+	cs.Chunks.Set(chunkID, *chunk)
+
+	return nil
+}
+
+// GetHolderChunks returns metadata of all chunks held by given chunk holder
+func (cs *ChunkMetadataStore) GetHolderChunks(chunkHolderID uuid.UUID) []model.ChunkMetadata {
+	chunks := make([]model.ChunkMetadata, 0)
+	cs.Chunks.Range(func(k, v any) bool {
+		chunk := v.(model.ChunkMetadata)
+		if utils.Contains(chunk.ChunkServers, chunkHolderID) {
+			chunks = append(chunks, chunk)
+		}
+
+		return true
+	})
+
+	return chunks
 }
 
 // RemoveChunkHolder removes given chunk holder from list of chunk holders for all chunks
-func (cs *ChunkMetadataStore) RemoveChunkHolder(chunkHolderID uuid.UUID) {
+// and returns IDs of chunks it has been removed from
+func (cs *ChunkMetadataStore) RemoveChunkHolder(chunkHolderID uuid.UUID) []uuid.UUID {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	removedFrom := make([]uuid.UUID, 0)
 	cs.Chunks.Range(func(k, v any) bool {
-		chunkID := k.(uuid.UUID)
-		cs.RemoveChunkHolderFromChunk(chunkHolderID, chunkID)
+		chunk := v.(model.ChunkMetadata)
+		if !utils.Contains(chunk.ChunkServers, chunkHolderID) {
+			return true
+		}
+
+		if cs.removeChunkHolderFromChunk(chunkHolderID, chunk.ID) == nil {
+			removedFrom = append(removedFrom, chunk.ID)
+		}
+
 		return true
 	})
+
+	return removedFrom
 }
 
 // RemoveChunkHolderFromChunk removes given chunk holder from chunk holders for given chunk
 func (cs *ChunkMetadataStore) RemoveChunkHolderFromChunk(chunkHolderID uuid.UUID, chunkID uuid.UUID) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	return cs.removeChunkHolderFromChunk(chunkHolderID, chunkID)
+}
+
+func (cs *ChunkMetadataStore) removeChunkHolderFromChunk(chunkHolderID uuid.UUID, chunkID uuid.UUID) error {
 	chunkServers := make([]uuid.UUID, 0)
 	chunkMetadata, found := cs.Chunks.Get(chunkID)
 	if !found {
@@ -125,10 +409,47 @@ func (cs *ChunkMetadataStore) RemoveChunkHolderFromChunk(chunkHolderID uuid.UUID
 		}
 	}
 
+	chunkMetadata.ChunkServers = chunkServers
 	cs.Chunks.Set(chunkMetadata.ID, *chunkMetadata)
 	return nil
 }
 
 func (cs *ChunkMetadataStore) RemoveChunkMetadata(chunkID uuid.UUID) {
 	cs.Chunks.Delete(chunkID)
+
+	cs.refsLock.Lock()
+	defer cs.refsLock.Unlock()
+
+	delete(cs.refs, chunkID)
+}
+
+// IncrementRefs records one more file referencing each of given chunks
+func (cs *ChunkMetadataStore) IncrementRefs(chunkIDs ...uuid.UUID) {
+	cs.refsLock.Lock()
+	defer cs.refsLock.Unlock()
+
+	for _, chunkID := range chunkIDs {
+		cs.refs[chunkID]++
+	}
+}
+
+// DecrementRefs records one less file referencing each of given chunks
+func (cs *ChunkMetadataStore) DecrementRefs(chunkIDs ...uuid.UUID) {
+	cs.refsLock.Lock()
+	defer cs.refsLock.Unlock()
+
+	for _, chunkID := range chunkIDs {
+		cs.refs[chunkID]--
+		if cs.refs[chunkID] <= 0 {
+			delete(cs.refs, chunkID)
+		}
+	}
+}
+
+// RefCount returns number of files referencing chunk
+func (cs *ChunkMetadataStore) RefCount(chunkID uuid.UUID) int {
+	cs.refsLock.Lock()
+	defer cs.refsLock.Unlock()
+
+	return cs.refs[chunkID]
 }
@@ -1,42 +1,93 @@
 package master
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/model"
 	"github.com/pyropy/dfs/lib/cmap"
-	"github.com/pyropy/dfs/lib/utils"
-	"time"
 )
 
 var (
 	FailedHealthChecksThreshold = 3
 )
 
+var (
+	ErrChunkServerNotFound = errors.New("chunk server not found")
+)
+
 type ChunkServerMetadata struct {
+	Topology
+	Usage
+
 	ID                 uuid.UUID
 	Address            string
 	Healthy            bool
 	Active             bool
 	FailedHealthChecks int
 	LastHealthReport   time.Time
+	// Draining is set for chunk server being decommissioned, it keeps serving reads while its
+	// chunks are replicated elsewhere but is not selected for new replicas
+	Draining bool
+	// Decommissioned is set once every chunk held by draining chunk server has enough replicas without it
+	Decommissioned bool
+}
+
+// Usage is disk usage and load of chunk server reported in heart beats. Zero total bytes
+// means that chunk server has not reported its usage yet.
+type Usage struct {
+	TotalBytes     int64
+	FreeBytes      int64
+	ChunkCount     int
+	InFlightWrites int
 }
 
 type ChunkServerMetadataStore struct {
 	Leases       cmap.Map[uuid.UUID, model.Lease]
 	ChunkServers cmap.Map[uuid.UUID, ChunkServerMetadata]
+
+	// lock serializes updates of chunk server metadata so that concurrent updates of different
+	// fields do not overwrite each other
+	lock sync.Mutex
+
+	// minFreeBytes is free space below which chunk server is not selected for new replicas
+	minFreeBytes int64
 }
 
-func NewChunkServerMetadataStore() *ChunkServerMetadataStore {
+func NewChunkServerMetadataStore(minFreeBytes int64) *ChunkServerMetadataStore {
 	return &ChunkServerMetadataStore{
 		Leases:       cmap.NewMap[uuid.UUID, model.Lease](),
 		ChunkServers: cmap.NewMap[uuid.UUID, ChunkServerMetadata](),
+		minFreeBytes: minFreeBytes,
 	}
 }
 
-func (m *ChunkServerMetadataStore) RegisterNewChunkServer(addr string) *ChunkServerMetadata {
-	chunkServerMetadata := ChunkServerMetadata{ID: uuid.New(), Address: addr, Healthy: true, Active: true, LastHealthReport: time.Now()}
-	m.ChunkServers.Set(chunkServerMetadata.ID, chunkServerMetadata)
-	return &chunkServerMetadata
+func (m *ChunkServerMetadataStore) RegisterNewChunkServer(addr string, topology Topology) *ChunkServerMetadata {
+	return m.RegisterChunkServer(uuid.New(), addr, topology)
+}
+
+// RegisterChunkServer registers chunk server under given ID. Chunk server that is already known
+// to master is re-attached to its existing entry with updated address.
+func (m *ChunkServerMetadataStore) RegisterChunkServer(chunkServerID uuid.UUID, addr string, topology Topology) *ChunkServerMetadata {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	chunkServerMetadata, exists := m.ChunkServers.Get(chunkServerID)
+	if !exists {
+		chunkServerMetadata = &ChunkServerMetadata{ID: chunkServerID}
+	}
+
+	chunkServerMetadata.Address = addr
+	chunkServerMetadata.Topology = topology
+	chunkServerMetadata.Healthy = true
+	chunkServerMetadata.Active = true
+	chunkServerMetadata.FailedHealthChecks = 0
+	chunkServerMetadata.LastHealthReport = time.Now()
+	m.ChunkServers.Set(chunkServerMetadata.ID, *chunkServerMetadata)
+
+	return chunkServerMetadata
 }
 
 func (m *ChunkServerMetadataStore) GetAllActiveChunkServers() []ChunkServerMetadata {
@@ -54,29 +105,6 @@ func (m *ChunkServerMetadataStore) GetAllActiveChunkServers() []ChunkServerMetad
 	return chunkServerList
 }
 
-func (m *ChunkServerMetadataStore) SelectChunkServers(num int, excludedChunkServers []uuid.UUID) []ChunkServerMetadata {
-	// TODO: Optimise by implementing some kinda priority queue
-	result := make([]ChunkServerMetadata, 0)
-	chunkServers := m.GetAllActiveChunkServers()
-
-	for _, cs := range chunkServers {
-
-		if !utils.Contains(excludedChunkServers, cs.ID) {
-			result = append(result, cs)
-		}
-
-		if len(result) == num || len(result) == len(chunkServers) {
-			return result
-		}
-	}
-
-	if len(result) > num {
-		return result[:num-1]
-	}
-
-	return result
-}
-
 func (m *ChunkServerMetadataStore) GetChunkServerMetadata(chunkServerID uuid.UUID) *ChunkServerMetadata {
 	chunkServerMetadata, exists := m.ChunkServers.Get(chunkServerID)
 	if !exists {
@@ -86,32 +114,80 @@ func (m *ChunkServerMetadataStore) GetChunkServerMetadata(chunkServerID uuid.UUI
 	return chunkServerMetadata
 }
 
-func (m *ChunkServerMetadataStore) MarkHealthy(chunkServerID uuid.UUID) *ChunkServerMetadata {
+// update applies given change to chunk server metadata under lock, it returns nil if chunk server is not known
+func (m *ChunkServerMetadataStore) update(chunkServerID uuid.UUID, change func(cs *ChunkServerMetadata)) *ChunkServerMetadata {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	chunkServer, exists := m.ChunkServers.Get(chunkServerID)
 	if !exists {
 		return nil
 	}
 
-	chunkServer.Healthy = true
-	chunkServer.FailedHealthChecks = 0
-	chunkServer.Active = true
+	change(chunkServer)
 	m.ChunkServers.Set(chunkServerID, *chunkServer)
 
 	return chunkServer
 }
 
+func (m *ChunkServerMetadataStore) MarkHealthy(chunkServerID uuid.UUID) *ChunkServerMetadata {
+	return m.update(chunkServerID, func(cs *ChunkServerMetadata) {
+		cs.Healthy = true
+		cs.FailedHealthChecks = 0
+		cs.Active = true
+		cs.LastHealthReport = time.Now()
+	})
+}
+
 func (m *ChunkServerMetadataStore) MarkUnhealthy(chunkServerID uuid.UUID) *ChunkServerMetadata {
-	chunkServer, exists := m.ChunkServers.Get(chunkServerID)
-	if !exists {
-		return nil
+	return m.update(chunkServerID, func(cs *ChunkServerMetadata) {
+		cs.Healthy = false
+		cs.FailedHealthChecks += 1
+		if cs.FailedHealthChecks >= FailedHealthChecksThreshold {
+			cs.Active = false
+		}
+	})
+}
+
+// UpdateUsage stores disk usage and load reported by chunk server
+func (m *ChunkServerMetadataStore) UpdateUsage(chunkServerID uuid.UUID, usage Usage) {
+	m.update(chunkServerID, func(cs *ChunkServerMetadata) {
+		cs.Usage = usage
+	})
+}
+
+// SetDraining marks chunk server as being decommissioned
+func (m *ChunkServerMetadataStore) SetDraining(chunkServerID uuid.UUID) (*ChunkServerMetadata, error) {
+	chunkServer := m.update(chunkServerID, func(cs *ChunkServerMetadata) {
+		cs.Draining = true
+	})
+
+	if chunkServer == nil {
+		return nil, ErrChunkServerNotFound
 	}
 
-	chunkServer.Healthy = false
-	chunkServer.FailedHealthChecks += 1
-	if chunkServer.FailedHealthChecks >= FailedHealthChecksThreshold {
-		chunkServer.Active = false
+	return chunkServer, nil
+}
+
+// MarkDecommissioned marks draining chunk server as safe to be retired
+func (m *ChunkServerMetadataStore) MarkDecommissioned(chunkServerID uuid.UUID) {
+	m.update(chunkServerID, func(cs *ChunkServerMetadata) {
+		if cs.Draining {
+			cs.Decommissioned = true
+		}
+	})
+}
+
+// WithoutDraining returns chunk holders that are not being decommissioned. Replicas held by draining
+// chunk servers are not counted towards chunk replicas since they are about to be retired.
+func (m *ChunkServerMetadataStore) WithoutDraining(chunkHolders []uuid.UUID) []uuid.UUID {
+	holders := make([]uuid.UUID, 0, len(chunkHolders))
+	for _, id := range chunkHolders {
+		cs := m.GetChunkServerMetadata(id)
+		if cs == nil || !cs.Draining {
+			holders = append(holders, id)
+		}
 	}
-	m.ChunkServers.Set(chunkServerID, *chunkServer)
 
-	return chunkServer
+	return holders
 }
@@ -0,0 +1,40 @@
+package master
+
+import (
+	"errors"
+	"os"
+	fp "path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const clusterIDFilename = "cluster-id"
+
+// loadClusterID reads ID of the cluster stored in metadata dir. New cluster ID is generated
+// and stored when master is started for the first time.
+func loadClusterID(dirPath string) (uuid.UUID, error) {
+	path := fp.Join(dirPath, clusterIDFilename)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return uuid.Parse(strings.TrimSpace(string(data)))
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return uuid.UUID{}, err
+	}
+
+	clusterID := uuid.New()
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, []byte(clusterID.String()+"\n"), 0640)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	return clusterID, syncDir(dirPath)
+}
@@ -0,0 +1,40 @@
+package master
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type Config struct {
+	Metadata struct {
+		Path               string        `envconfig:"META_PATH" default:"/app/meta"`
+		CheckpointInterval time.Duration `envconfig:"CHECKPOINT_INTERVAL" default:"5m"`
+	}
+	Chunks struct {
+		DefaultSize int `envconfig:"DEFAULT_CHUNK_SIZE" default:"67108864"`
+	}
+	Placement struct {
+		MinFreeBytes int64 `envconfig:"MIN_FREE_BYTES" default:"1073741824"`
+	}
+	Replication struct {
+		Workers         int           `envconfig:"REPLICATION_WORKERS" default:"8"`
+		ClonesPerServer int           `envconfig:"REPLICATION_CLONES_PER_SERVER" default:"2"`
+		RetryBackoff    time.Duration `envconfig:"REPLICATION_RETRY_BACKOFF" default:"5s"`
+	}
+	Rebalancer struct {
+		Interval    time.Duration `envconfig:"REBALANCE_INTERVAL" default:"1m"`
+		Threshold   float64       `envconfig:"REBALANCE_THRESHOLD" default:"0.1"`
+		Concurrency int           `envconfig:"REBALANCE_CONCURRENCY" default:"4"`
+	}
+}
+
+func GetConfig() (*Config, error) {
+	var cfg Config
+	err := envconfig.Process("", &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
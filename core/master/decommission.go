@@ -0,0 +1,130 @@
+package master
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/lib/utils"
+)
+
+// DecommissionProgress is state of chunk server being decommissioned
+type DecommissionProgress struct {
+	ChunkServer ChunkServerMetadata
+	// Chunks is number of chunks held by chunk server
+	Chunks int
+	// PendingChunks is number of chunks held by chunk server that would be left without enough replicas without it
+	PendingChunks int
+}
+
+// Decommissioner drains chunk servers that are being retired. Draining chunk server keeps serving
+// reads while its chunks are replicated elsewhere and is marked decommissioned once it holds no
+// chunk that would be left without enough replicas if it were shut down.
+type Decommissioner struct {
+	chunkMetadataStore   *ChunkMetadataStore
+	chunkServerMetaStore *ChunkServerMetadataStore
+	replicationMonitor   *ReplicationMonitor
+	stripeRepairer       *StripeRepairer
+}
+
+func NewDecommissioner(cm *ChunkMetadataStore, cs *ChunkServerMetadataStore, rm *ReplicationMonitor, sr *StripeRepairer) *Decommissioner {
+	return &Decommissioner{
+		chunkMetadataStore:   cm,
+		chunkServerMetaStore: cs,
+		replicationMonitor:   rm,
+		stripeRepairer:       sr,
+	}
+}
+
+// Start starts process that periodically checks progress of draining chunk servers
+func (d *Decommissioner) Start(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	log.Info("starting decommissioner")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.CheckDrained()
+		}
+	}
+}
+
+// Decommission starts draining given chunk server. Chunks it holds are queued for replication and
+// erasure coded chunks it holds are moved to other chunk servers of their stripes.
+func (d *Decommissioner) Decommission(chunkServerID uuid.UUID) (*DecommissionProgress, error) {
+	chunkServer, err := d.chunkServerMetaStore.SetDraining(chunkServerID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infow("decommission", "status", "draining chunk server", "chunkServer", chunkServer.Address)
+
+	chunks := d.chunkMetadataStore.GetHolderChunks(chunkServerID)
+	chunkIDs := make([]uuid.UUID, 0, len(chunks))
+	for _, chunk := range chunks {
+		chunkIDs = append(chunkIDs, chunk.ID)
+	}
+
+	d.replicationMonitor.EnqueueChunks(chunkIDs...)
+	// repair pass started here waits for periodic one in progress to finish
+	go d.stripeRepairer.RepairStripes()
+
+	return d.DecommissionStatus(chunkServerID)
+}
+
+// DecommissionStatus returns progress of decommissioning given chunk server. For chunk server in service
+// pending chunks are those that would be under-replicated if it were decommissioned right away.
+func (d *Decommissioner) DecommissionStatus(chunkServerID uuid.UUID) (*DecommissionProgress, error) {
+	chunkServer := d.chunkServerMetaStore.GetChunkServerMetadata(chunkServerID)
+	if chunkServer == nil {
+		return nil, ErrChunkServerNotFound
+	}
+
+	progress := &DecommissionProgress{ChunkServer: *chunkServer}
+	for _, chunk := range d.chunkMetadataStore.GetHolderChunks(chunkServerID) {
+		progress.Chunks++
+		others := utils.Remove(d.chunkServerMetaStore.WithoutDraining(chunk.ChunkServers), chunkServerID)
+		if len(others) < chunk.TargetReplicas() {
+			progress.PendingChunks++
+		}
+	}
+
+	return progress, nil
+}
+
+// DecommissionStatuses returns decommissioning progress of all known chunk servers
+func (d *Decommissioner) DecommissionStatuses() []DecommissionProgress {
+	statuses := make([]DecommissionProgress, 0)
+	d.chunkServerMetaStore.ChunkServers.Range(func(k, v any) bool {
+		cs := v.(ChunkServerMetadata)
+
+		progress, err := d.DecommissionStatus(cs.ID)
+		if err == nil {
+			statuses = append(statuses, *progress)
+		}
+
+		return true
+	})
+
+	return statuses
+}
+
+// CheckDrained marks draining chunk servers whose chunks all have enough replicas without them as decommissioned
+func (d *Decommissioner) CheckDrained() {
+	for _, progress := range d.DecommissionStatuses() {
+		cs := progress.ChunkServer
+		if !cs.Draining || cs.Decommissioned {
+			continue
+		}
+
+		if progress.PendingChunks > 0 {
+			log.Infow("decommission", "status", "draining chunk server", "chunkServer", cs.Address, "pendingChunks", progress.PendingChunks, "chunks", progress.Chunks)
+			continue
+		}
+
+		d.chunkServerMetaStore.MarkDecommissioned(cs.ID)
+		log.Infow("decommission", "status", "chunk server decommissioned", "chunkServer", cs.Address)
+	}
+}
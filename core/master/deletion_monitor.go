@@ -8,6 +8,7 @@ import (
 
 type DeletionMonitor struct {
 	fileStore *FileMetadataStore
+	opLog     *OperationLog
 }
 
 var (
@@ -16,9 +17,10 @@ var (
 
 // NewDeletionMonitor creates new deletion monitor responsible for deleting file metadata
 // for files that have been tagged for deletion for more than three days
-func NewDeletionMonitor(fileStore *FileMetadataStore) *DeletionMonitor {
+func NewDeletionMonitor(fileStore *FileMetadataStore, opLog *OperationLog) *DeletionMonitor {
 	return &DeletionMonitor{
 		fileStore: fileStore,
+		opLog:     opLog,
 	}
 }
 
@@ -38,22 +40,26 @@ func (gc *DeletionMonitor) Start(ctx context.Context) error {
 			go gc.filterDeletedFiles(deletionChan)
 		case f := <-deletionChan:
 			if forDeletion := gc.isForDeletion(f); forDeletion {
-				gc.fileStore.DeleteFile(f.Path)
+				op := Operation{
+					Type:   OpPurgeFile,
+					FileID: f.ID,
+				}
+
+				if err := gc.opLog.Commit(op); err != nil {
+					log.Error("Error when purging file", "path", f.Path, "error", err)
+				}
 			}
 		}
 	}
 }
 
-// filterDeletedFiles filters all files to and sends files marked for deletion to deletion channel
+// filterDeletedFiles sends files found in trash to deletion channel
 func (gc *DeletionMonitor) filterDeletedFiles(d chan model.FileMetadata) {
-	gc.fileStore.Files.Range(func(k, v any) bool {
-		f := v.(model.FileMetadata)
+	for _, f := range gc.fileStore.TrashedFiles() {
 		if f.Deleted {
 			d <- f
 		}
-
-		return true
-	})
+	}
 }
 
 // isForDeletion checks if file has been deleted before now - threshold period
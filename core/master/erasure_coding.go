@@ -0,0 +1,354 @@
+package master
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/constants"
+	"github.com/pyropy/dfs/core/model"
+	"github.com/pyropy/dfs/lib/utils"
+	csRpc "github.com/pyropy/dfs/rpc/chunkserver"
+)
+
+var (
+	ErrFileErasureCoded    = errors.New("file is erasure coded")
+	ErrChunkShared         = errors.New("file shares chunks with snapshot")
+	ErrChunkModified       = errors.New("chunk modified during conversion")
+	ErrStripeUnrecoverable = errors.New("stripe lost more chunks than it has parity chunks")
+)
+
+// SetErasureCoding converts replicated file at given path into erasure coded file. File data chunks are
+// grouped into stripes of ec.DataShards chunks, each stripe is placed on distinct chunk servers and parity
+// chunks are computed over it by one of them. Once parity is written data chunks are left with single replica.
+// Erasure coded files are read-only, so files being written to or sharing chunks with snapshots are rejected.
+func (m *Master) SetErasureCoding(path string, ec model.ErasureCoding) error {
+	path, err := model.NormalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	if !ec.Valid() {
+		return model.ErrInvalidErasureCoding
+	}
+
+	unlock := m.namespaceLocks.Lock(path)
+	defer unlock()
+
+	file := m.FileMetadataStore.Get(path)
+	if file == nil {
+		return ErrPathNotFound
+	}
+
+	if file.ErasureCoding.Enabled() {
+		return ErrFileErasureCoded
+	}
+
+	if len(m.ChunkServerMetadataStore.GetAllActiveChunkServers()) < ec.StripeWidth() {
+		return ErrNoChunkServersAvailable
+	}
+
+	chunks := make([]*model.ChunkMetadata, 0, len(file.Chunks))
+	for _, chunkID := range file.Chunks {
+		if m.ChunkMetadataStore.RefCount(chunkID) > 1 {
+			return ErrChunkShared
+		}
+
+		chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
+		if err != nil {
+			return err
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	// no new mutation can start without lease and namespace lock held here
+	m.revokeLeases(file.Chunks...)
+
+	// replicas are not removed as excess and copies are not added from heart beats until conversion is done
+	for _, chunkID := range file.Chunks {
+		m.ChunkMetadataStore.BeginChange(chunkID)
+		defer m.ChunkMetadataStore.EndChange(chunkID)
+	}
+
+	converted := *file
+	converted.ErasureCoding = ec
+	converted.Stripes = make([]model.Stripe, 0)
+	converted.Size = 0
+
+	parity := make([]model.ChunkMetadata, 0)
+	keepers := make(map[uuid.UUID]uuid.UUID)
+	for first := 0; first < len(chunks); first += ec.DataShards {
+		last := first + ec.DataShards
+		if last > len(chunks) {
+			last = len(chunks)
+		}
+
+		stripe, stripeParity, stripeKeepers, err := m.encodeStripe(&converted, chunks[first:last], len(chunks)+len(parity))
+		if err != nil {
+			m.discardParity(parity)
+			return err
+		}
+
+		for i, length := range stripe.Lengths[:ec.DataShards] {
+			if size := (first+i)*converted.ChunkSizeBytes() + length; length > 0 && size > converted.Size {
+				converted.Size = size
+			}
+		}
+
+		converted.Stripes = append(converted.Stripes, *stripe)
+		parity = append(parity, stripeParity...)
+		for chunkID, keeper := range stripeKeepers {
+			keepers[chunkID] = keeper
+		}
+	}
+
+	// data written while stripes were encoded would not be covered by parity
+	for _, chunk := range chunks {
+		current, err := m.ChunkMetadataStore.GetChunk(chunk.ID)
+		if err != nil || current.Version != chunk.Version {
+			m.discardParity(parity)
+			return ErrChunkModified
+		}
+	}
+
+	op := Operation{
+		Type:      OpSetErasureCoding,
+		Path:      path,
+		File:      &converted,
+		Chunks:    parity,
+		Timestamp: time.Now(),
+	}
+
+	err = m.opLog.Commit(op)
+	if err != nil {
+		m.discardParity(parity)
+		return err
+	}
+
+	for _, chunk := range parity {
+		m.ChunkMetadataStore.EndChange(chunk.ID)
+	}
+
+	for _, stripe := range converted.Stripes {
+		m.removeReplicas(stripe, keepers)
+	}
+
+	log.Infow("erasure coding", "status", "file converted", "path", path, "policy", ec.String(), "stripes", len(converted.Stripes))
+	return nil
+}
+
+// encodeStripe places data chunks of the stripe on distinct chunk servers, copying chunks whose replicas
+// are all held by chunk servers already used by the stripe, and computes parity chunks. Stripe together
+// with its parity chunks and chunk server keeping single replica of each data chunk is returned.
+func (m *Master) encodeStripe(file *model.FileMetadata, chunks []*model.ChunkMetadata, parityIndex int) (*model.Stripe, []model.ChunkMetadata, map[uuid.UUID]uuid.UUID, error) {
+	ec := file.ErasureCoding
+	members := make([]csRpc.StripeMember, ec.StripeWidth())
+	keepers := make(map[uuid.UUID]uuid.UUID)
+	used := make([]uuid.UUID, 0, ec.StripeWidth())
+	copies := make([]int, 0)
+
+	for i, chunk := range chunks {
+		members[i] = csRpc.StripeMember{
+			ChunkID: chunk.ID,
+			Version: chunk.Version,
+			Index:   chunk.Index,
+			Length:  -1,
+		}
+
+		holders := m.activeHolders(chunk.ChunkServers)
+		if len(holders) == 0 {
+			return nil, nil, nil, ErrChunkHasNoHolders
+		}
+
+		members[i].Source = holders[0].Address
+		for _, holder := range holders {
+			if !utils.Contains(used, holder.ID) {
+				keepers[chunk.ID] = holder.ID
+				members[i].Source = holder.Address
+				used = append(used, holder.ID)
+				break
+			}
+		}
+
+		if _, placed := keepers[chunk.ID]; !placed {
+			copies = append(copies, i)
+		}
+	}
+
+	targets := m.ChunkServerMetadataStore.SelectChunkServers(len(copies)+ec.ParityShards, used)
+	if len(targets) < len(copies)+ec.ParityShards {
+		return nil, nil, nil, ErrNoChunkServersAvailable
+	}
+
+	for _, i := range copies {
+		target := targets[0]
+		targets = targets[1:]
+		members[i].Target = target.Address
+		keepers[members[i].ChunkID] = target.ID
+		m.ChunkMetadataStore.AddPendingTarget(members[i].ChunkID, target.ID)
+	}
+
+	// last stripe of the file is completed with chunks read as zeros
+	for i := len(chunks); i < ec.DataShards; i++ {
+		members[i] = csRpc.StripeMember{Length: 0}
+	}
+
+	parity := make([]model.ChunkMetadata, 0, ec.ParityShards)
+	for p := 0; p < ec.ParityShards; p++ {
+		chunk := NewChunkMetadata(uuid.New(), parityIndex+p, constants.INITIAL_CHUNK_VERSION, file.ChunkSizeBytes(), file.Path, []uuid.UUID{targets[p].ID})
+		chunk.ErasureCoded = true
+		parity = append(parity, chunk)
+		m.ChunkMetadataStore.BeginChange(chunk.ID) // not an orphan until committed
+
+		members[ec.DataShards+p] = csRpc.StripeMember{
+			ChunkID: chunk.ID,
+			Version: chunk.Version,
+			Index:   chunk.Index,
+			Length:  -1,
+			Target:  targets[p].Address,
+		}
+	}
+
+	args := csRpc.RebuildStripeArgs{
+		DataShards:   ec.DataShards,
+		ParityShards: ec.ParityShards,
+		ChunkSize:    file.ChunkSizeBytes(),
+		FilePath:     file.Path,
+		Members:      members,
+	}
+
+	// parity is computed on chunk server storing the first parity chunk
+	lengths, err := rebuildStripe(args, &targets[0])
+	if err != nil {
+		m.discardParity(parity)
+		return nil, nil, nil, err
+	}
+
+	stripe := &model.Stripe{
+		Chunks:  make([]uuid.UUID, 0, len(members)),
+		Lengths: lengths,
+	}
+
+	for _, member := range members {
+		stripe.Chunks = append(stripe.Chunks, member.ChunkID)
+	}
+
+	return stripe, parity, keepers, nil
+}
+
+// StripeLocation is erasure coded stripe together with locations of its chunks
+type StripeLocation struct {
+	Chunks  []ChunkLocation // missing data chunks of the last stripe are left empty
+	Lengths []int
+}
+
+// GetStripeLocations returns locations of chunks of erasure coded file grouped into stripes
+func (m *Master) GetStripeLocations(file *model.FileMetadata) ([]StripeLocation, error) {
+	stripes := make([]StripeLocation, 0, len(file.Stripes))
+	for _, stripe := range file.Stripes {
+		location := StripeLocation{
+			Chunks:  make([]ChunkLocation, 0, len(stripe.Chunks)),
+			Lengths: stripe.Lengths,
+		}
+
+		for _, chunkID := range stripe.Chunks {
+			if chunkID == uuid.Nil {
+				location.Chunks = append(location.Chunks, ChunkLocation{})
+				continue
+			}
+
+			chunks, err := m.GetChunkLocations([]uuid.UUID{chunkID})
+			if err != nil {
+				return nil, err
+			}
+
+			location.Chunks = append(location.Chunks, chunks[0])
+		}
+
+		stripes = append(stripes, location)
+	}
+
+	return stripes, nil
+}
+
+// activeHolders returns metadata of active chunk servers among given chunk holders
+func (m *Master) activeHolders(chunkHolders []uuid.UUID) []*ChunkServerMetadata {
+	holders := make([]*ChunkServerMetadata, 0, len(chunkHolders))
+	for _, id := range chunkHolders {
+		cs := m.ChunkServerMetadataStore.GetChunkServerMetadata(id)
+		if cs != nil && cs.Active {
+			holders = append(holders, cs)
+		}
+	}
+
+	return holders
+}
+
+// discardParity deletes parity chunks of conversion that did not complete
+func (m *Master) discardParity(parity []model.ChunkMetadata) {
+	for _, chunk := range parity {
+		for _, holder := range m.activeHolders(chunk.ChunkServers) {
+			err := deleteChunk(chunk.ID, holder)
+			if err != nil {
+				log.Errorw("erasure coding", "status", "failed to delete parity chunk", "chunkID", chunk.ID, "chunkServer", holder.Address, "error", err)
+			}
+		}
+
+		m.ChunkMetadataStore.EndChange(chunk.ID)
+	}
+}
+
+// removeReplicas leaves each data chunk of converted stripe with single replica and deletes other replicas.
+// Keeper chosen when the stripe was encoded might have died or lost its replica in the meantime, in which case
+// one of remaining replicas is kept instead, preferably on active chunk server not used by the rest of the stripe.
+func (m *Master) removeReplicas(stripe model.Stripe, keepers map[uuid.UUID]uuid.UUID) {
+	used := make([]uuid.UUID, 0, len(stripe.Chunks))
+	for _, chunkID := range stripe.Chunks {
+		if keeper, isData := keepers[chunkID]; isData {
+			used = append(used, keeper)
+		} else if chunkID != uuid.Nil {
+			used = append(used, m.ChunkMetadataStore.GetChunkHolders(chunkID)...)
+		}
+	}
+
+	for _, chunkID := range stripe.Chunks {
+		keeper, isData := keepers[chunkID]
+		if !isData {
+			continue
+		}
+
+		if cs := m.ChunkServerMetadataStore.GetChunkServerMetadata(keeper); cs == nil || !cs.Active {
+			keeper = uuid.Nil
+		}
+
+		avoid := utils.Remove(used, keepers[chunkID])
+		for _, holder := range m.ChunkMetadataStore.GetChunkHolders(chunkID) {
+			if cs := m.ChunkServerMetadataStore.GetChunkServerMetadata(holder); cs == nil || !cs.Active {
+				avoid = append(avoid, holder)
+			}
+		}
+
+		kept, removed, err := m.ChunkMetadataStore.KeepSingleHolder(chunkID, keeper, avoid)
+		if err != nil {
+			log.Errorw("erasure coding", "status", "failed to remove replicas", "chunkID", chunkID, "error", err)
+			continue
+		}
+
+		if kept == uuid.Nil {
+			log.Warnw("erasure coding", "status", "data chunk lost all replicas", "chunkID", chunkID)
+			continue
+		}
+
+		if kept != keepers[chunkID] {
+			log.Warnw("erasure coding", "status", "keeper lost replica, keeping another one", "chunkID", chunkID, "keeper", keepers[chunkID], "kept", kept)
+		}
+
+		for _, holder := range m.activeHolders(removed) {
+			err := deleteChunk(chunkID, holder)
+			if err != nil {
+				log.Errorw("erasure coding", "status", "failed to delete replica", "chunkID", chunkID, "chunkServer", holder.Address, "error", err)
+			}
+		}
+	}
+}
@@ -1,40 +1,567 @@
 package master
 
 import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/model"
-	"github.com/pyropy/dfs/lib/cmap"
 )
 
-// TODO: Implement some kinda Tree Structure
-// to hold file/dir metadata so users can traverse filesystem
+var (
+	ErrPathNotFound      = errors.New("path not found")
+	ErrParentNotFound    = errors.New("parent directory not found")
+	ErrNotADirectory     = errors.New("not a directory")
+	ErrDirectoryNotEmpty = errors.New("directory not empty")
+	ErrFileNotInTrash    = errors.New("file not found in trash")
+)
+
+// namespaceNode is single file or directory in the namespace tree
+type namespaceNode struct {
+	file     *model.FileMetadata
+	dir      *model.DirectoryMetadata
+	children map[string]*namespaceNode
+	// names holds names of children in lexicographical order so that listing can seek to any of them
+	names []string
+}
+
+func newDirectoryNode(dir model.DirectoryMetadata) *namespaceNode {
+	return &namespaceNode{
+		dir:      &dir,
+		children: make(map[string]*namespaceNode),
+	}
+}
+
+func (n *namespaceNode) isDir() bool {
+	return n.dir != nil
+}
+
+func (n *namespaceNode) status() model.FileStatus {
+	if n.isDir() {
+		return model.FileStatus{
+			Path:      n.dir.Path,
+			IsDir:     true,
+			CreatedAt: n.dir.CreatedAt,
+		}
+	}
+
+	return model.FileStatus{
+		Path:              n.file.Path,
+		Size:              n.file.Size,
+		NumChunks:         len(n.file.Chunks),
+		CreatedAt:         n.file.CreatedAt,
+		ReplicationFactor: n.file.TargetReplicas(),
+		ChunkSize:         n.file.ChunkSizeBytes(),
+		ErasureCoding:     n.file.ErasureCoding.String(),
+	}
+}
+
+// setChild adds child with given name to directory node or replaces existing one
+func (n *namespaceNode) setChild(name string, child *namespaceNode) {
+	if _, exists := n.children[name]; !exists {
+		i := sort.SearchStrings(n.names, name)
+		n.names = append(n.names, "")
+		copy(n.names[i+1:], n.names[i:])
+		n.names[i] = name
+	}
+
+	n.children[name] = child
+}
+
+// removeChild removes child with given name from directory node
+func (n *namespaceNode) removeChild(name string) {
+	if _, exists := n.children[name]; !exists {
+		return
+	}
+
+	i := sort.SearchStrings(n.names, name)
+	n.names = append(n.names[:i], n.names[i+1:]...)
+	delete(n.children, name)
+}
+
+// FileMetadataStore holds file and directory metadata in a tree
+// so users can traverse the filesystem. Deleted files are kept in trash
+// until they are purged by deletion monitor.
 type FileMetadataStore struct {
-	Files cmap.Map[model.FilePath, model.FileMetadata]
+	lock  sync.RWMutex
+	root  *namespaceNode
+	trash map[uuid.UUID]model.FileMetadata
 }
 
 func NewFileMetadataStore() *FileMetadataStore {
 	return &FileMetadataStore{
-		Files: cmap.NewMap[model.FilePath, model.FileMetadata](),
+		root:  newDirectoryNode(model.NewDirectoryMetadata(model.RootPath)),
+		trash: make(map[uuid.UUID]model.FileMetadata),
 	}
 }
 
 func (f *FileMetadataStore) Get(filePath string) *model.FileMetadata {
-	file, exists := f.Files.Get(filePath)
-	if !exists {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.lookup(filePath)
+	if node == nil || node.isDir() {
 		return nil
 	}
 
-	return file
+	file := *node.file
+	return &file
 }
 
 func (f *FileMetadataStore) CheckFileExists(filePath model.FilePath) bool {
-	_, fileExists := f.Files.Get(filePath)
-	return fileExists
+	return f.Get(filePath) != nil
+}
+
+// CheckPathExists checks if there is file or directory at given path
+func (f *FileMetadataStore) CheckPathExists(path model.FilePath) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.lookup(path) != nil
+}
+
+// CheckDirectoryExists checks if there is directory at given path
+func (f *FileMetadataStore) CheckDirectoryExists(path model.FilePath) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.lookup(path)
+	return node != nil && node.isDir()
+}
+
+// CheckParentsCreatable checks if missing parent directories of given path can be created,
+// i.e. that none of its ancestors is a file
+func (f *FileMetadataStore) CheckParentsCreatable(path model.FilePath) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.root
+	for _, name := range model.SplitPath(model.ParentPath(path)) {
+		child, exists := node.children[name]
+		if !exists {
+			return true
+		}
+
+		if !child.isDir() {
+			return false
+		}
+
+		node = child
+	}
+
+	return true
+}
+
+// AddNewFileMetadata adds file to the namespace creating missing parent directories
+func (f *FileMetadataStore) AddNewFileMetadata(filePath model.FilePath, metadata model.FileMetadata) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parent, err := f.mkdirAll(model.ParentPath(filePath), metadata.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	parent.setChild(model.BaseName(filePath), &namespaceNode{file: &metadata})
+	return nil
 }
 
-func (f *FileMetadataStore) AddNewFileMetadata(filePath model.FilePath, metadata model.FileMetadata) {
-	f.Files.Set(filePath, metadata)
+// Mkdir adds directory to the namespace creating missing parent directories
+func (f *FileMetadataStore) Mkdir(dir model.DirectoryMetadata) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parent, err := f.mkdirAll(model.ParentPath(dir.Path), dir.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	name := model.BaseName(dir.Path)
+	if _, exists := parent.children[name]; exists || dir.Path == model.RootPath {
+		return nil
+	}
+
+	parent.setChild(name, newDirectoryNode(dir))
+	return nil
+}
+
+// AddChunk appends chunk to the list of file chunks. Chunks preceding the new one
+// are full so file size is extended up to the start of the added chunk.
+func (f *FileMetadataStore) AddChunk(filePath model.FilePath, chunk model.Chunk) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	node := f.lookup(filePath)
+	if node == nil || node.isDir() {
+		return
+	}
+
+	node.file.Chunks = append(node.file.Chunks, chunk.ID)
+	if size := chunk.Index * chunk.Size; size > node.file.Size {
+		node.file.Size = size
+	}
 }
 
-func (f *FileMetadataStore) DeleteFile(filePath model.FilePath) {
-	f.Files.Delete(filePath)
+// MoveToTrash removes file or directory with all of its descendants from the namespace
+// and moves removed files to trash marking them as deleted at given time
+func (f *FileMetadataStore) MoveToTrash(path model.FilePath, deletedAt time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parent := f.lookup(model.ParentPath(path))
+	if parent == nil || !parent.isDir() || path == model.RootPath {
+		return
+	}
+
+	name := model.BaseName(path)
+	node, exists := parent.children[name]
+	if !exists {
+		return
+	}
+
+	parent.removeChild(name)
+	f.walk(node, func(n *namespaceNode) {
+		if n.isDir() {
+			return
+		}
+
+		file := *n.file
+		file.Deleted = true
+		file.DeletedAt = deletedAt
+		f.trash[file.ID] = file
+	})
+}
+
+// AddToTrash adds already deleted file to trash
+func (f *FileMetadataStore) AddToTrash(file model.FileMetadata) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.trash[file.ID] = file
+}
+
+// GetTrashed returns deleted file with given ID if it is still in trash
+func (f *FileMetadataStore) GetTrashed(fileID uuid.UUID) *model.FileMetadata {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	file, exists := f.trash[fileID]
+	if !exists {
+		return nil
+	}
+
+	return &file
+}
+
+// TrashedFiles returns all files in trash, most recently deleted first
+func (f *FileMetadataStore) TrashedFiles() []model.FileMetadata {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	files := make([]model.FileMetadata, 0, len(f.trash))
+	for _, file := range f.trash {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].DeletedAt.After(files[j].DeletedAt)
+	})
+
+	return files
+}
+
+// Restore moves file from trash back to its original path recreating missing parent directories.
+// File is kept in trash if one of its ancestors is a file now.
+func (f *FileMetadataStore) Restore(fileID uuid.UUID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, exists := f.trash[fileID]
+	if !exists {
+		return nil
+	}
+
+	parent, err := f.mkdirAll(model.ParentPath(file.Path), file.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	delete(f.trash, fileID)
+	file.Deleted = false
+	file.DeletedAt = time.Time{}
+
+	parent.setChild(model.BaseName(file.Path), &namespaceNode{file: &file})
+	return nil
+}
+
+// Purge permanently removes file from trash and returns removed file
+func (f *FileMetadataStore) Purge(fileID uuid.UUID) *model.FileMetadata {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, exists := f.trash[fileID]
+	if !exists {
+		return nil
+	}
+
+	delete(f.trash, fileID)
+	return &file
+}
+
+// ReplaceChunk replaces chunk of the file with its copy
+func (f *FileMetadataStore) ReplaceChunk(filePath model.FilePath, chunkID uuid.UUID, newChunkID uuid.UUID) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	node := f.lookup(filePath)
+	if node == nil || node.isDir() {
+		return
+	}
+
+	// chunk list might be shared with copies of metadata handed out earlier
+	chunks := make([]uuid.UUID, 0, len(node.file.Chunks))
+	for _, id := range node.file.Chunks {
+		if id == chunkID {
+			id = newChunkID
+		}
+
+		chunks = append(chunks, id)
+	}
+
+	node.file.Chunks = chunks
+}
+
+// SetReplicationFactor sets number of replicas chunks of the file should be kept at
+func (f *FileMetadataStore) SetReplicationFactor(filePath model.FilePath, replicationFactor int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	node := f.lookup(filePath)
+	if node == nil || node.isDir() {
+		return
+	}
+
+	node.file.ReplicationFactor = replicationFactor
+}
+
+// SetErasureCoding records that file chunks are stored as erasure coded stripes
+func (f *FileMetadataStore) SetErasureCoding(filePath model.FilePath, ec model.ErasureCoding, stripes []model.Stripe, size int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	node := f.lookup(filePath)
+	if node == nil || node.isDir() {
+		return
+	}
+
+	node.file.ErasureCoding = ec
+	node.file.Stripes = stripes
+	node.file.Size = size
+}
+
+// Subtree returns metadata of file or directory at given path together with all of its descendants.
+// Directories are ordered before their children.
+func (f *FileMetadataStore) Subtree(path model.FilePath) ([]model.DirectoryMetadata, []model.FileMetadata, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.lookup(path)
+	if node == nil {
+		return nil, nil, ErrPathNotFound
+	}
+
+	dirs := make([]model.DirectoryMetadata, 0)
+	files := make([]model.FileMetadata, 0)
+	f.walk(node, func(n *namespaceNode) {
+		if n.isDir() {
+			dirs = append(dirs, *n.dir)
+			return
+		}
+
+		file := *n.file
+		file.Chunks = append([]uuid.UUID{}, n.file.Chunks...)
+		files = append(files, file)
+	})
+
+	return dirs, files, nil
+}
+
+// Stat returns status of file or directory at given path
+func (f *FileMetadataStore) Stat(path model.FilePath) (*model.FileStatus, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.lookup(path)
+	if node == nil {
+		return nil, ErrPathNotFound
+	}
+
+	status := node.status()
+	return &status, nil
+}
+
+// List returns status of at most limit directory entries ordered by path, starting right after startAfter
+// if it is set. If recursive is set entries of all subdirectories are returned as well, each directory
+// followed by its children. Listing seeks to startAfter in each directory on its path, so entries before
+// it are never visited. Whether more entries are left is returned as well.
+func (f *FileMetadataStore) List(dirPath model.FilePath, startAfter model.FilePath, limit int, recursive bool) ([]model.FileStatus, bool, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	node := f.lookup(dirPath)
+	if node == nil {
+		return nil, false, ErrPathNotFound
+	}
+
+	if !node.isDir() {
+		return nil, false, ErrNotADirectory
+	}
+
+	// cursor holds names on the path from listed directory to startAfter
+	var cursor []string
+	if startAfter != "" {
+		dirNames, afterNames := model.SplitPath(dirPath), model.SplitPath(startAfter)
+		switch {
+		case len(afterNames) > len(dirNames) && model.ComparePaths(model.JoinPath(afterNames[:len(dirNames)]...), dirPath) == 0:
+			cursor = afterNames[len(dirNames):]
+		case model.ComparePaths(startAfter, dirPath) > 0:
+			// startAfter is ordered after all entries of the directory
+			return []model.FileStatus{}, false, nil
+		}
+	}
+
+	entries := make([]model.FileStatus, 0)
+	// walk stops once one entry more than limit is found, so that it is known whether more entries are left
+	var walk func(n *namespaceNode, cursor []string) bool
+	walk = func(n *namespaceNode, cursor []string) bool {
+		names := n.names
+		if len(cursor) > 0 {
+			names = names[sort.SearchStrings(names, cursor[0]):]
+		}
+
+		for _, name := range names {
+			child := n.children[name]
+
+			// child on the path to startAfter has been listed already, its descendants are listed after it
+			if len(cursor) > 0 && name == cursor[0] {
+				if recursive && child.isDir() && !walk(child, cursor[1:]) {
+					return false
+				}
+
+				continue
+			}
+
+			entries = append(entries, child.status())
+			if len(entries) > limit {
+				return false
+			}
+
+			if recursive && child.isDir() && !walk(child, nil) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	walk(node, cursor)
+	if len(entries) > limit {
+		return entries[:limit], true, nil
+	}
+
+	return entries, false, nil
+}
+
+// Range calls f for each file in the namespace until f returns false
+func (f *FileMetadataStore) Range(fn func(file model.FileMetadata) bool) {
+	for _, file := range f.Files() {
+		if !fn(file) {
+			return
+		}
+	}
+}
+
+// Files returns copy of metadata for all files in the namespace
+func (f *FileMetadataStore) Files() []model.FileMetadata {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	files := make([]model.FileMetadata, 0)
+	f.walk(f.root, func(n *namespaceNode) {
+		if !n.isDir() {
+			files = append(files, *n.file)
+		}
+	})
+
+	return files
+}
+
+// Directories returns copy of metadata for all directories in the namespace except the root
+func (f *FileMetadataStore) Directories() []model.DirectoryMetadata {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	dirs := make([]model.DirectoryMetadata, 0)
+	f.walk(f.root, func(n *namespaceNode) {
+		if n.isDir() && n != f.root {
+			dirs = append(dirs, *n.dir)
+		}
+	})
+
+	return dirs
+}
+
+// walk visits node and all of its descendants, parents are visited before children
+func (f *FileMetadataStore) walk(n *namespaceNode, visit func(n *namespaceNode)) {
+	visit(n)
+	for _, child := range n.children {
+		f.walk(child, visit)
+	}
+}
+
+func (f *FileMetadataStore) lookup(path model.FilePath) *namespaceNode {
+	node := f.root
+	for _, name := range model.SplitPath(path) {
+		if !node.isDir() {
+			return nil
+		}
+
+		child, exists := node.children[name]
+		if !exists {
+			return nil
+		}
+
+		node = child
+	}
+
+	return node
+}
+
+// mkdirAll returns directory node at given path creating it and its parents if missing.
+// Files are never replaced, ErrNotADirectory is returned if any node on the path is a file.
+func (f *FileMetadataStore) mkdirAll(dirPath model.FilePath, createdAt time.Time) (*namespaceNode, error) {
+	node := f.root
+	names := model.SplitPath(dirPath)
+
+	for i, name := range names {
+		child, exists := node.children[name]
+		if exists && !child.isDir() {
+			return nil, ErrNotADirectory
+		}
+
+		if !exists {
+			dir := model.DirectoryMetadata{
+				Path:      model.JoinPath(names[:i+1]...),
+				CreatedAt: createdAt,
+			}
+			child = newDirectoryNode(dir)
+			node.setChild(name, child)
+		}
+
+		node = child
+	}
+
+	return node, nil
 }
@@ -2,6 +2,7 @@ package master
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"github.com/pyropy/dfs/core/model"
 	"time"
 )
@@ -10,13 +11,15 @@ type GC struct {
 	fileStore            *FileMetadataStore
 	chunkMetaStore       *ChunkMetadataStore
 	chunkServerMetaStore *ChunkServerMetadataStore
+	opLog                *OperationLog
 }
 
-func NewGC(fileStore *FileMetadataStore, chunkMetaStore *ChunkMetadataStore, chunkServerMetaStore *ChunkServerMetadataStore) *GC {
+func NewGC(fileStore *FileMetadataStore, chunkMetaStore *ChunkMetadataStore, chunkServerMetaStore *ChunkServerMetadataStore, opLog *OperationLog) *GC {
 	return &GC{
 		fileStore:            fileStore,
 		chunkMetaStore:       chunkMetaStore,
 		chunkServerMetaStore: chunkServerMetaStore,
+		opLog:                opLog,
 	}
 }
 
@@ -40,12 +43,22 @@ func (gc *GC) Start(ctx context.Context) error {
 	}
 }
 
-// findOrphanedChunks goes through all chunks to and sends orphaned chunks to deletion channel
+// findOrphanedChunks goes through all chunks to and sends orphaned chunks to deletion channel.
+// Chunk is orphaned once neither file in the namespace nor file in trash references it. Chunks
+// committed while files are listed look orphaned as well, so sweep checks each chunk again.
 func (gc *GC) findOrphanedChunks(d chan model.ChunkMetadata) {
+	referenced := make(map[uuid.UUID]bool)
+	files := append(gc.fileStore.Files(), gc.fileStore.TrashedFiles()...)
+	for _, f := range files {
+		for _, chunkID := range f.AllChunks() {
+			referenced[chunkID] = true
+		}
+	}
+
 	gc.chunkMetaStore.Chunks.Range(func(k any, v any) bool {
 		c := v.(model.ChunkMetadata)
 
-		if hasParent := gc.fileStore.CheckFileExists(c.FilePath); !hasParent {
+		if hasParent := referenced[c.ID]; !hasParent {
 			d <- c
 		}
 
@@ -57,6 +70,10 @@ func (gc *GC) findOrphanedChunks(d chan model.ChunkMetadata) {
 func (gc *GC) sweep(chunk model.ChunkMetadata) {
 	var removedChunks int
 
+	if !gc.opLog.IsOrphaned(chunk.ID) {
+		return
+	}
+
 	for _, csId := range chunk.ChunkServers {
 		cs := gc.chunkServerMetaStore.GetChunkServerMetadata(csId)
 		// TODO: Create some retry queue and or workerpool
@@ -74,6 +91,13 @@ func (gc *GC) sweep(chunk model.ChunkMetadata) {
 
 	if removedChunks == len(chunk.ChunkServers) {
 		log.Info("Cleaned chunk", "chunkId", chunk.ID, "chunkServers", chunk.ChunkServers)
-		gc.chunkMetaStore.RemoveChunkMetadata(chunk.ID)
+		op := Operation{
+			Type:    OpRemoveChunk,
+			ChunkID: chunk.ID,
+		}
+
+		if err := gc.opLog.Commit(op); err != nil {
+			log.Error("Error when removing chunk metadata", "chunkId", chunk.ID.String(), "error", err)
+		}
 	}
 }
@@ -10,16 +10,18 @@ import (
 type HealthCheckService struct {
 	cs *ChunkServerMetadataStore
 	cm *ChunkMetadataStore
+	rm *ReplicationMonitor
 }
 
 var (
 	HealthCheckDurationThreshold = time.Second * 30
 )
 
-func NewHealthCheckService(cs *ChunkServerMetadataStore, cm *ChunkMetadataStore) *HealthCheckService {
+func NewHealthCheckService(cs *ChunkServerMetadataStore, cm *ChunkMetadataStore, rm *ReplicationMonitor) *HealthCheckService {
 	return &HealthCheckService{
 		cs: cs,
 		cm: cm,
+		rm: rm,
 	}
 }
 
@@ -48,7 +50,8 @@ func (hs *HealthCheckService) Start(ctx context.Context) {
 			cs := hs.cs.MarkUnhealthy(unhealthyChunkServerID)
 			if !cs.Active {
 				log.Warn("health-check", "status", "removed from chunk holders", "chunkID", cs.ID)
-				hs.cm.RemoveChunkHolder(cs.ID)
+				// chunks left with the fewest replicas are repaired first
+				hs.rm.EnqueueChunks(hs.cm.RemoveChunkHolder(cs.ID)...)
 			}
 		}
 	}
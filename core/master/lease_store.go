@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/pyropy/dfs/core/model"
 	"github.com/pyropy/dfs/lib/cmap"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,10 +13,27 @@ import (
 var (
 	ErrLeaseNotFound           = errors.New("Lease not found")
 	ErrLeaseNotPreviouslyOwned = errors.New("Failed to extend lease. Chunk Server was not previous owner of the lease")
+	ErrLeaseRevoked            = errors.New("lease is being revoked")
 )
 
+// leaseSafetyMargin is cut from lease duration sent to chunk server. Chunk server counts the duration
+// from the moment it receives the grant, so without the margin its lease could outlive master's view of it.
+const leaseSafetyMargin = 5 * time.Second
+
+// ChunkServerLeaseDuration returns for how long chunk server may treat given lease as valid
+func ChunkServerLeaseDuration(lease *model.Lease) time.Duration {
+	validFor := time.Until(lease.ValidUntil) - leaseSafetyMargin
+	if validFor < 0 {
+		return 0
+	}
+
+	return validFor
+}
+
 // Manages leases
 type LeaseStore struct {
+	// lock serializes lease updates so that lease being revoked is never overwritten by its extension
+	lock   sync.Mutex
 	Leases cmap.Map[uuid.UUID, model.Lease]
 }
 
@@ -41,8 +59,15 @@ func (ls *LeaseStore) HasLease(chunkID uuid.UUID) bool {
 	return lease.ValidUntil.After(now)
 }
 
-// GrantLease grants lease over chunk for period of time
-func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) *model.Lease {
+// GrantLease grants lease over chunk for period of time with given epoch
+func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, chunkServer *ChunkServerMetadata, epoch int) *model.Lease {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	return ls.grantLease(chunkID, chunkServer, epoch)
+}
+
+func (ls *LeaseStore) grantLease(chunkID uuid.UUID, chunkServer *ChunkServerMetadata, epoch int) *model.Lease {
 	validFor := 60 * time.Second
 	validUntil := time.Now().Add(validFor)
 
@@ -50,6 +75,7 @@ func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, chunkServer *ChunkServerMeta
 		ChunkID:       chunkID,
 		ValidUntil:    validUntil,
 		ChunkServerID: chunkServer.ID,
+		Epoch:         epoch,
 	}
 
 	ls.Leases.Set(chunkID, lease)
@@ -57,8 +83,11 @@ func (ls *LeaseStore) GrantLease(chunkID uuid.UUID, chunkServer *ChunkServerMeta
 }
 
 // ExtendLease extends lease for a given chunkID if chunkserver
-// requesting extension previously had lase over the chunk
+// requesting extension previously had lase over the chunk. Extended lease keeps its epoch.
 func (ls *LeaseStore) ExtendLease(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) (*model.Lease, error) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
 	prevLease, leaseExists := ls.Leases.Get(chunkID)
 
 	if !leaseExists {
@@ -70,6 +99,43 @@ func (ls *LeaseStore) ExtendLease(chunkID uuid.UUID, chunkServer *ChunkServerMet
 
 	}
 
-	lease := ls.GrantLease(chunkID, chunkServer)
+	if prevLease.Revoked {
+		return nil, ErrLeaseRevoked
+	}
+
+	lease := ls.grantLease(chunkID, chunkServer, prevLease.Epoch)
 	return lease, nil
 }
+
+// RevokeLease marks lease over chunk as revoked so that it is not extended anymore and returns it.
+// Expired lease is removed right away and false is returned.
+func (ls *LeaseStore) RevokeLease(chunkID uuid.UUID) (*model.Lease, bool) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	lease, leaseExists := ls.Leases.Get(chunkID)
+	if !leaseExists {
+		return nil, false
+	}
+
+	if lease.IsExpired() {
+		ls.Leases.Delete(chunkID)
+		return nil, false
+	}
+
+	lease.Revoked = true
+	ls.Leases.Set(chunkID, *lease)
+	return lease, true
+}
+
+// RemoveRevokedLease removes revoked lease over chunk so that new lease can be granted, lease
+// granted after revoked one expired is kept
+func (ls *LeaseStore) RemoveRevokedLease(chunkID uuid.UUID) {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	lease, leaseExists := ls.Leases.Get(chunkID)
+	if leaseExists && lease.Revoked {
+		ls.Leases.Delete(chunkID)
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"github.com/pyropy/dfs/core/constants"
 	"github.com/pyropy/dfs/core/model"
 	"github.com/pyropy/dfs/lib/logger"
+	"github.com/pyropy/dfs/lib/utils"
+	masterRpc "github.com/pyropy/dfs/rpc/master"
 	"math/rand"
+	"strings"
+	"time"
 )
 
 type Master struct {
@@ -19,6 +23,15 @@ type Master struct {
 	*HealthCheckService
 	*DeletionMonitor
 	*ReplicationMonitor
+	*Rebalancer
+	*StripeRepairer
+	*Decommissioner
+	*Checkpointer
+
+	opLog            *OperationLog
+	namespaceLocks   *NamespaceLocks
+	clusterID        uuid.UUID
+	defaultChunkSize int
 }
 
 var (
@@ -27,44 +40,132 @@ var (
 	ErrChunkHolderNotFound     = errors.New("chunk holder not found")
 	ErrChunkHasNoHolders       = errors.New("chunk has no holders")
 	ErrNoChunkServersAvailable = errors.New("no chunk servers available")
+	ErrInvalidOperation        = errors.New("invalid operation")
+	ErrInvalidChunkIndex       = errors.New("invalid chunk index")
+	ErrInvalidReplication      = errors.New("invalid replication factor")
+	ErrInvalidChunkSize        = errors.New("invalid chunk size")
+	ErrClusterIDMismatch       = masterRpc.ErrClusterIDMismatch
 )
 
+// MaxListLimit is maximum number of entries returned by single directory listing
+const MaxListLimit = 1000
+
 var log, _ = logger.New("master-rpc")
 
-func NewMaster() *Master {
+// NewMaster creates master and recovers file and chunk metadata by replaying operation log
+func NewMaster(cfg *Config) (*Master, error) {
+	if !model.ValidChunkSize(cfg.Chunks.DefaultSize) {
+		return nil, ErrInvalidChunkSize
+	}
+
 	chunkMetadataStore := NewChunkMetadataStore()
-	chunkServerMetadataStore := NewChunkServerMetadataStore()
+	chunkServerMetadataStore := NewChunkServerMetadataStore(cfg.Placement.MinFreeBytes)
 	leaseService := NewLeaseStore()
 	fileMetadataStore := NewFileMetadataStore()
 
+	opLog, err := NewOperationLog(cfg.Metadata.Path, fileMetadataStore, chunkMetadataStore)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opLog.Recover()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterID, err := loadClusterID(cfg.Metadata.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	replicationMonitor := NewReplicationMonitor(chunkMetadataStore, leaseService, chunkServerMetadataStore, fileMetadataStore, cfg.Replication.Workers, cfg.Replication.ClonesPerServer, cfg.Replication.RetryBackoff)
+	stripeRepairer := NewStripeRepairer(chunkMetadataStore, chunkServerMetadataStore, fileMetadataStore)
+
 	return &Master{
 		LeaseStore:               leaseService,
 		FileMetadataStore:        fileMetadataStore,
 		ChunkMetadataStore:       chunkMetadataStore,
 		ChunkServerMetadataStore: chunkServerMetadataStore,
-		GC:                       NewGC(fileMetadataStore, chunkMetadataStore, chunkServerMetadataStore),
-		HealthCheckService:       NewHealthCheckService(chunkServerMetadataStore, chunkMetadataStore),
-		DeletionMonitor:          NewDeletionMonitor(fileMetadataStore),
-		ReplicationMonitor:       NewReplicationMonitor(chunkMetadataStore, leaseService, chunkServerMetadataStore),
+		GC:                       NewGC(fileMetadataStore, chunkMetadataStore, chunkServerMetadataStore, opLog),
+		HealthCheckService:       NewHealthCheckService(chunkServerMetadataStore, chunkMetadataStore, replicationMonitor),
+		DeletionMonitor:          NewDeletionMonitor(fileMetadataStore, opLog),
+		ReplicationMonitor:       replicationMonitor,
+		Rebalancer:               NewRebalancer(chunkMetadataStore, leaseService, chunkServerMetadataStore, cfg.Rebalancer.Interval, cfg.Rebalancer.Threshold, cfg.Rebalancer.Concurrency),
+		StripeRepairer:           stripeRepairer,
+		Decommissioner:           NewDecommissioner(chunkMetadataStore, chunkServerMetadataStore, replicationMonitor, stripeRepairer),
+		Checkpointer:             NewCheckpointer(opLog, cfg.Metadata.CheckpointInterval),
+		opLog:                    opLog,
+		namespaceLocks:           NewNamespaceLocks(),
+		clusterID:                clusterID,
+		defaultChunkSize:         cfg.Chunks.DefaultSize,
+	}, nil
+}
+
+// ClusterID returns ID of the cluster managed by master
+func (m *Master) ClusterID() uuid.UUID {
+	return m.clusterID
+}
+
+// RegisterChunkServer registers chunk server with master. Chunk server registering with ID it got
+// from master before keeps its ID, while chunk server that belongs to another cluster is rejected.
+func (m *Master) RegisterChunkServer(clusterID uuid.UUID, chunkServerID uuid.UUID, addr string, topology Topology) (*ChunkServerMetadata, error) {
+	if clusterID != uuid.Nil && clusterID != m.clusterID {
+		return nil, ErrClusterIDMismatch
+	}
+
+	if chunkServerID == uuid.Nil {
+		return m.ChunkServerMetadataStore.RegisterNewChunkServer(addr, topology), nil
 	}
+
+	return m.ChunkServerMetadataStore.RegisterChunkServer(chunkServerID, addr, topology), nil
 }
 
-// CreateNewFile selects chunk servers and instructs them to create N number of chunks with predefined IDs
+// CreateNewFile selects chunk servers and instructs them to create N number of chunks with predefined IDs.
+// File chunks are of given size, or of cluster default size if chunk size is 0.
 func (m *Master) CreateNewFile(filePath string, fileSizeBytes, repFactor, chunkSizeBytes int) (*model.FileMetadata, []uuid.UUID, error) {
-	// TODO: Add file namespace locks
 	var chunkIds []uuid.UUID
 	var chunkMetadata []model.ChunkMetadata
 	var chunkServerIds []uuid.UUID
 
-	fileExists := m.FileMetadataStore.CheckFileExists(filePath)
-	if fileExists {
+	filePath, err := model.NormalizePath(filePath)
+	if err != nil {
+		return nil, chunkIds, err
+	}
+
+	if repFactor < 1 || repFactor > constants.MAX_REPLICATION_FACTOR {
+		return nil, chunkIds, ErrInvalidReplication
+	}
+
+	if chunkSizeBytes == 0 {
+		chunkSizeBytes = m.defaultChunkSize
+	}
+
+	if !model.ValidChunkSize(chunkSizeBytes) {
+		return nil, chunkIds, ErrInvalidChunkSize
+	}
+
+	unlock := m.namespaceLocks.Lock(filePath)
+	defer unlock()
+
+	if !m.FileMetadataStore.CheckDirectoryExists(model.ParentPath(filePath)) {
+		return nil, chunkIds, ErrParentNotFound
+	}
+
+	pathExists := m.FileMetadataStore.CheckPathExists(filePath)
+	if pathExists {
 		return nil, chunkIds, ErrFileExists
 	}
 
 	chunkVersion := constants.INITIAL_CHUNK_VERSION
 	chunkServers := m.ChunkServerMetadataStore.SelectChunkServers(repFactor, []uuid.UUID{})
 	fileMetadata := model.NewFileMetadata(filePath)
+	fileMetadata.Size = fileSizeBytes
+	fileMetadata.ReplicationFactor = repFactor
+	fileMetadata.ChunkSize = chunkSizeBytes
 	numChunks := (fileSizeBytes + (chunkSizeBytes - 1)) / chunkSizeBytes
+	if numChunks > 0 && len(chunkServers) == 0 {
+		return nil, chunkIds, ErrNoChunkServersAvailable
+	}
 
 	for _, cs := range chunkServers {
 		chunkServerIds = append(chunkServerIds, cs.ID)
@@ -74,80 +175,809 @@ func (m *Master) CreateNewFile(filePath string, fileSizeBytes, repFactor, chunkS
 		chunkID := uuid.New()
 		chunkIds = append(chunkIds, chunkID)
 		fileMetadata.Chunks = append(fileMetadata.Chunks, chunkID)
-		chunk := NewChunkMetadata(chunkID, i, chunkVersion, filePath, chunkServerIds)
+		chunk := NewChunkMetadata(chunkID, i, chunkVersion, chunkSizeBytes, filePath, chunkServerIds)
+		chunk.ReplicationFactor = repFactor
 		chunkMetadata = append(chunkMetadata, chunk)
 
+		// chunk created on chunk servers is not treated as orphan until the file is committed
+		m.ChunkMetadataStore.BeginChange(chunkID)
+		defer m.ChunkMetadataStore.EndChange(chunkID)
+
 		for _, chunkServer := range chunkServers {
-			err := createNewChunk(chunkID, filePath, chunkSizeBytes, chunkVersion, &chunkServer)
+			err := createNewChunk(chunkID, filePath, i, chunkSizeBytes, chunkVersion, &chunkServer)
 			if err != nil {
 				return nil, nil, ErrFileCreation
 			}
 		}
 	}
 
-	// Add file metadata
-	m.FileMetadataStore.AddNewFileMetadata(filePath, fileMetadata)
+	// Record file and its chunks before acknowledging file creation
+	op := Operation{
+		Type:   OpCreateFile,
+		File:   &fileMetadata,
+		Chunks: chunkMetadata,
+	}
 
-	// Add chunk metadata for each chunk created
-	for _, meta := range chunkMetadata {
-		m.ChunkMetadataStore.AddNewChunkMetadata(meta)
+	err = m.opLog.Commit(op)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return &fileMetadata, chunkServerIds, nil
 }
 
-func (m *Master) RequestWrite(chunkID uuid.UUID) (uuid.UUID, *model.Lease, []*ChunkServerMetadata, int, error) {
-	chunkServerIds := m.GetChunkHolders(chunkID)
-	if len(chunkServerIds) == 0 {
-		return uuid.UUID{}, nil, nil, 0, ErrChunkHolderNotFound
+// Mkdir creates new directory. If parents is set missing parent directories are created as well
+// and existing directory at given path is not considered an error.
+func (m *Master) Mkdir(dirPath string, parents bool) error {
+	dirPath, err := model.NormalizePath(dirPath)
+	if err != nil {
+		return err
 	}
 
-	chunkServers := make([]*ChunkServerMetadata, 0)
-	for _, chunkServerId := range chunkServerIds {
-		chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerId)
-		chunkServers = append(chunkServers, chunkServer)
+	unlock := m.namespaceLocks.Lock(dirPath)
+	defer unlock()
+
+	names := model.SplitPath(dirPath)
+	for i := range names {
+		path := model.JoinPath(names[:i+1]...)
+		isTarget := i == len(names)-1
+
+		status, err := m.FileMetadataStore.Stat(path)
+		switch {
+		case err == nil && !status.IsDir:
+			return ErrNotADirectory
+		case err == nil && isTarget && !parents:
+			return ErrFileExists
+		case err == nil:
+			continue
+		case !isTarget && !parents:
+			return ErrParentNotFound
+		}
+
+		dir := model.NewDirectoryMetadata(path)
+		op := Operation{
+			Type:      OpMkdir,
+			Directory: &dir,
+		}
+
+		err = m.opLog.Commit(op)
+		if err != nil {
+			return err
+		}
 	}
 
-	lease, hasLeaseHolder := m.LeaseStore.GetHolder(chunkID)
+	return nil
+}
+
+// ListDirectory returns at most limit directory entries ordered by path that come after startAfter path.
+// Returned flag reports whether there are more entries to be listed.
+func (m *Master) ListDirectory(dirPath string, startAfter string, limit int, recursive bool) ([]model.FileStatus, bool, error) {
+	dirPath, err := model.NormalizePath(dirPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	// entries are ordered by path so listing resumes right after the last returned path
+	// even if that path has been removed in meantime
+	return m.FileMetadataStore.List(dirPath, startAfter, limit, recursive)
+}
+
+// DeleteFile marks file as deleted and moves it to trash from where it can be restored until it is
+// purged by deletion monitor. Directory is deleted together with its contents only if recursive is set.
+func (m *Master) DeleteFile(path string, recursive bool) error {
+	path, err := model.NormalizePath(path)
+	if err != nil {
+		return err
+	}
+
+	if path == model.RootPath {
+		return ErrInvalidOperation
+	}
+
+	unlock := m.namespaceLocks.Lock(path)
+	defer unlock()
+
+	status, err := m.FileMetadataStore.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if status.IsDir && !recursive {
+		entries, _, err := m.FileMetadataStore.List(path, "", 1, false)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			return ErrDirectoryNotEmpty
+		}
+	}
+
+	op := Operation{
+		Type:      OpDeleteFile,
+		Path:      path,
+		Timestamp: time.Now(),
+	}
+
+	return m.opLog.Commit(op)
+}
+
+// Undelete restores deleted file from trash to its original path. File is identified by its ID or,
+// if ID is not given, the most recently deleted file from given path is restored.
+func (m *Master) Undelete(path string, fileID uuid.UUID) (*model.FileMetadata, error) {
+	var file *model.FileMetadata
+	if fileID != uuid.Nil {
+		file = m.FileMetadataStore.GetTrashed(fileID)
+	} else {
+		path, err := model.NormalizePath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range m.FileMetadataStore.TrashedFiles() {
+			if f.Path == path {
+				file = &f
+				break
+			}
+		}
+	}
+
+	if file == nil || file.DeletedAt.Before(time.Now().Add(-FileDeletionThreshold)) {
+		return nil, ErrFileNotInTrash
+	}
+
+	unlock := m.namespaceLocks.Lock(file.Path)
+	defer unlock()
+
+	// file might have been purged or restored while waiting for the lock
+	if m.FileMetadataStore.GetTrashed(file.ID) == nil {
+		return nil, ErrFileNotInTrash
+	}
+
+	if m.FileMetadataStore.CheckPathExists(file.Path) {
+		return nil, ErrFileExists
+	}
+
+	// missing parent directories are recreated, but file created in place of one of them is kept
+	if !m.FileMetadataStore.CheckParentsCreatable(file.Path) {
+		return nil, ErrNotADirectory
+	}
+
+	op := Operation{
+		Type:   OpUndeleteFile,
+		FileID: file.ID,
+	}
+
+	err := m.opLog.Commit(op)
+	if err != nil {
+		return nil, err
+	}
 
-	chunkVersion, err := m.IncrementChunkVersion(chunkID)
+	return m.FileMetadataStore.Get(file.Path), nil
+}
+
+// ListTrash returns deleted files that can still be restored, most recently deleted first
+func (m *Master) ListTrash() []model.FileMetadata {
+	files := make([]model.FileMetadata, 0)
+	deleteAfter := time.Now().Add(-FileDeletionThreshold)
+
+	for _, f := range m.FileMetadataStore.TrashedFiles() {
+		if f.DeletedAt.After(deleteAfter) {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+// Stat returns status of file or directory at given path
+func (m *Master) Stat(path string) (*model.FileStatus, error) {
+	path, err := model.NormalizePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.FileMetadataStore.Stat(path)
+}
+
+// Snapshot copies file or directory with all of its descendants to given path. Only metadata is copied,
+// copies share chunks with the original until either of them is written to. Leases over snapshotted chunks
+// are revoked so that any following write has to go through master and copy shared chunk first.
+func (m *Master) Snapshot(srcPath string, dstPath string) error {
+	srcPath, err := model.NormalizePath(srcPath)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err = model.NormalizePath(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if srcPath == dstPath || strings.HasPrefix(dstPath, srcPath+model.PathSeparator) || srcPath == model.RootPath {
+		return ErrInvalidOperation
+	}
+
+	unlock := m.namespaceLocks.Lock(srcPath, dstPath)
+	defer unlock()
+
+	if !m.FileMetadataStore.CheckDirectoryExists(model.ParentPath(dstPath)) {
+		return ErrParentNotFound
+	}
+
+	if m.FileMetadataStore.CheckPathExists(dstPath) {
+		return ErrFileExists
+	}
+
+	dirs, files, err := m.FileMetadataStore.Subtree(srcPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	copyPath := func(path model.FilePath) model.FilePath {
+		return dstPath + strings.TrimPrefix(path, srcPath)
+	}
+
+	op := Operation{
+		Type:        OpSnapshot,
+		Path:        srcPath,
+		Timestamp:   now,
+		Directories: make([]model.DirectoryMetadata, 0, len(dirs)),
+		Files:       make([]model.FileMetadata, 0, len(files)),
+	}
+
+	for _, dir := range dirs {
+		dir.Path = copyPath(dir.Path)
+		dir.CreatedAt = now
+		op.Directories = append(op.Directories, dir)
+	}
+
+	// writes to source files have to go through copy on write once snapshot is taken
+	chunkIDs := make([]uuid.UUID, 0)
+	for _, file := range files {
+		chunkIDs = append(chunkIDs, file.Chunks...)
+	}
+
+	m.revokeLeases(chunkIDs...)
+
+	for _, file := range files {
+		file.ID = uuid.New()
+		file.Path = copyPath(file.Path)
+		file.CreatedAt = now
+		op.Files = append(op.Files, file)
+	}
+
+	return m.opLog.Commit(op)
+}
+
+// SetReplication sets replication factor of the file, or of all replicated files under the directory, at given
+// path and returns number of files updated. Chunks shared with snapshots are kept at the highest replication
+// factor of files referencing them. Missing replicas are queued for replication and excess ones removed.
+func (m *Master) SetReplication(path string, replicationFactor int) (int, error) {
+	path, err := model.NormalizePath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if replicationFactor < 1 || replicationFactor > constants.MAX_REPLICATION_FACTOR {
+		return 0, ErrInvalidReplication
+	}
+
+	unlock := m.namespaceLocks.Lock(path)
+	defer unlock()
+
+	_, subtree, err := m.FileMetadataStore.Subtree(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// erasure coded files are kept without replicas
+	files := make([]model.FileMetadata, 0, len(subtree))
+	for _, file := range subtree {
+		if !file.ErasureCoding.Enabled() {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 && len(subtree) > 0 {
+		return 0, ErrFileErasureCoded
+	}
+
+	updated := make(map[uuid.UUID]bool)
+	for _, file := range files {
+		updated[file.ID] = true
+	}
+
+	// replication factor other files require for shared chunks
+	required := make(map[uuid.UUID]int)
+	others := append(m.FileMetadataStore.Files(), m.FileMetadataStore.TrashedFiles()...)
+	for _, file := range others {
+		if updated[file.ID] {
+			continue
+		}
+
+		for _, chunkID := range file.Chunks {
+			if file.TargetReplicas() > required[chunkID] {
+				required[chunkID] = file.TargetReplicas()
+			}
+		}
+	}
+
+	op := Operation{
+		Type:              OpSetReplication,
+		Path:              path,
+		ReplicationFactor: replicationFactor,
+		Timestamp:         time.Now(),
+		Files:             files,
+		Chunks:            make([]model.ChunkMetadata, 0),
+	}
+
+	raised := make([]uuid.UUID, 0)
+	lowered := make([]uuid.UUID, 0)
+	for _, file := range files {
+		for _, chunkID := range file.Chunks {
+			chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
+			if err != nil {
+				continue
+			}
+
+			target := replicationFactor
+			if required[chunkID] > target {
+				target = required[chunkID]
+			}
+
+			switch {
+			case target > chunk.TargetReplicas():
+				raised = append(raised, chunkID)
+			case target < chunk.TargetReplicas():
+				lowered = append(lowered, chunkID)
+			}
+
+			chunk.ReplicationFactor = target
+			op.Chunks = append(op.Chunks, *chunk)
+		}
+	}
+
+	err = m.opLog.Commit(op)
+	if err != nil {
+		return 0, err
+	}
+
+	m.ReplicationMonitor.EnqueueChunks(raised...)
+	go func() {
+		for _, chunkID := range lowered {
+			err := m.ReplicationMonitor.RemoveExcessReplica(chunkID)
+			if err != nil {
+				log.Errorw("replication", "status", "failed to remove excess replicas", "chunkID", chunkID, "error", err)
+			}
+		}
+	}()
+
+	return len(files), nil
+}
+
+// RequestWrite returns primary and secondaries for chunk of the file at given path. If chunk is shared
+// with snapshot, chunk holders are instructed to copy it first and ID of the copy is returned instead.
+func (m *Master) RequestWrite(filePath string, chunkID uuid.UUID) (uuid.UUID, *model.Lease, []*ChunkServerMetadata, int, error) {
+	filePath, err := model.NormalizePath(filePath)
+	if err != nil {
+		return uuid.UUID{}, nil, nil, 0, err
+	}
+
+	// lease has to be granted before snapshot of the file can be taken
+	unlock := m.namespaceLocks.Lock(filePath)
+	defer unlock()
+
+	chunkID, err = m.copyOnWrite(filePath, chunkID)
 	if err != nil {
 		return uuid.UUID{}, nil, nil, 0, err
 	}
 
-	if !hasLeaseHolder {
-		lease, err = m.grantLeaseRandom(chunkID, chunkServers)
+	return m.requestWrite(chunkID)
+}
+
+// copyOnWrite copies chunk of the file if it is referenced by other files as well and returns ID of the copy.
+// Copy is created locally by each chunk holder so no data is sent over the network.
+func (m *Master) copyOnWrite(filePath model.FilePath, chunkID uuid.UUID) (uuid.UUID, error) {
+	file := m.FileMetadataStore.Get(filePath)
+	if file == nil {
+		return uuid.UUID{}, ErrPathNotFound
+	}
+
+	if file.ErasureCoding.Enabled() {
+		return uuid.UUID{}, ErrFileErasureCoded
+	}
+
+	if !utils.Contains(file.Chunks, chunkID) {
+		return uuid.UUID{}, ErrChunkNotFound
+	}
+
+	if m.ChunkMetadataStore.RefCount(chunkID) <= 1 {
+		return chunkID, nil
+	}
+
+	chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	clone := NewChunkMetadata(uuid.New(), chunk.Index, chunk.Version, chunk.Size, filePath, []uuid.UUID{})
+	clone.ReplicationFactor = file.TargetReplicas()
+	m.ChunkMetadataStore.BeginChange(clone.ID)
+	defer m.ChunkMetadataStore.EndChange(clone.ID)
+
+	for _, chunkServerID := range chunk.ChunkServers {
+		chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerID)
+		if chunkServer == nil {
+			continue
+		}
+
+		err = cloneChunk(chunkID, clone, chunkServer)
+		if err != nil {
+			log.Errorw("copy on write", "status", "failed to clone chunk", "chunkID", chunkID, "chunkServer", chunkServer.Address, "error", err)
+			continue
+		}
+
+		clone.ChunkServers = append(clone.ChunkServers, chunkServerID)
+	}
+
+	if len(clone.ChunkServers) == 0 {
+		return uuid.UUID{}, ErrChunkHasNoHolders
+	}
+
+	op := Operation{
+		Type:    OpReplaceChunk,
+		Path:    filePath,
+		ChunkID: chunkID,
+		Chunks:  []model.ChunkMetadata{clone},
+	}
+
+	err = m.opLog.Commit(op)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	return clone.ID, nil
+}
+
+// requestWrite returns primary and secondaries for given chunk. Chunk version is incremented
+// only when new lease is granted, so concurrent writers holding the same lease keep writing to
+// the same chunk version. If lease holder still holds valid lease it is extended.
+func (m *Master) requestWrite(chunkID uuid.UUID) (uuid.UUID, *model.Lease, []*ChunkServerMetadata, int, error) {
+	chunkServers := m.chunkHolderServers(chunkID)
+	if len(chunkServers) == 0 {
+		return uuid.UUID{}, nil, nil, 0, ErrChunkHolderNotFound
+	}
+
+	var leaseHolder *ChunkServerMetadata
+	lease, hasLeaseHolder := m.LeaseStore.GetHolder(chunkID)
+	if hasLeaseHolder && m.LeaseStore.HasLease(chunkID) {
+		// new lease can not be granted until revoked one is given up or expires
+		if lease.Revoked {
+			return uuid.UUID{}, nil, nil, 0, ErrLeaseRevoked
+		}
+
+		for _, chunkServer := range chunkServers {
+			if chunkServer.ID == lease.ChunkServerID {
+				leaseHolder = chunkServer
+				break
+			}
+		}
+	}
+
+	if leaseHolder != nil {
+		chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
 		if err != nil {
 			return uuid.UUID{}, nil, nil, 0, err
 		}
-    } else {
-        var leaseHolder *ChunkServerMetadata
-        for _, chunkServer := range chunkServers {
-            if chunkServer.ID == lease.ChunkServerID {
-                leaseHolder = chunkServer
-                break
-            }
 
-        }
+		lease, err = m.extendLease(chunkID, leaseHolder)
+		if err != nil {
+			return uuid.UUID{}, nil, nil, 0, err
+		}
 
-        lease, err = m.extendLease(chunkID, leaseHolder)
-    }
+		return chunkID, lease, chunkServers, chunk.Version, nil
+	}
 
+	chunkVersion, err := m.opLog.IncrementChunkVersion(chunkID)
+	if err != nil {
+		return uuid.UUID{}, nil, nil, 0, err
+	}
+
+	// holders are read again since replica might have been added by rebalancer before version was incremented
+	chunkServers = m.chunkHolderServers(chunkID)
+
+	// holders that missed version increment are stale and must not take part in writes
+	upToDate := make([]*ChunkServerMetadata, 0, len(chunkServers))
 	for _, chunkServer := range chunkServers {
-		// TODO: Retry if fails
 		err = incrementChunkVersion(chunkID, chunkVersion, chunkServer)
 		if err != nil {
-			return uuid.UUID{}, nil, nil, 0, err
+			log.Errorw("request write", "status", "failed to increment chunk version", "chunkID", chunkID, "chunkServer", chunkServer.Address, "error", err)
+			m.ChunkMetadataStore.RemoveChunkHolderFromChunk(chunkServer.ID, chunkID)
+			continue
 		}
+
+		upToDate = append(upToDate, chunkServer)
+	}
+
+	if len(upToDate) == 0 {
+		return uuid.UUID{}, nil, nil, 0, ErrChunkHolderNotFound
+	}
+
+	chunkServers = upToDate
+	lease, err = m.grantLeaseRandom(chunkID, chunkServers, chunkVersion)
+	if err != nil {
+		return uuid.UUID{}, nil, nil, 0, err
 	}
 
 	return chunkID, lease, chunkServers, chunkVersion, nil
 }
 
+// chunkHolderServers returns metadata of chunk servers holding given chunk
+func (m *Master) chunkHolderServers(chunkID uuid.UUID) []*ChunkServerMetadata {
+	chunkServers := make([]*ChunkServerMetadata, 0)
+	for _, chunkServerId := range m.GetChunkHolders(chunkID) {
+		chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerId)
+		if chunkServer == nil {
+			continue
+		}
+
+		chunkServers = append(chunkServers, chunkServer)
+	}
+
+	return chunkServers
+}
+
+// RequestRecordAppend returns primary and secondaries for the last chunk of the file together
+// with its metadata. Chunk is allocated if file has no chunks yet.
+func (m *Master) RequestRecordAppend(filePath string) (*model.ChunkMetadata, uuid.UUID, *model.Lease, []*ChunkServerMetadata, int, error) {
+	filePath, err := model.NormalizePath(filePath)
+	if err != nil {
+		return nil, uuid.UUID{}, nil, nil, 0, err
+	}
+
+	file := m.FileMetadataStore.Get(filePath)
+	if file == nil {
+		return nil, uuid.UUID{}, nil, nil, 0, ErrPathNotFound
+	}
+
+	chunkIndex := len(file.Chunks) - 1
+	if chunkIndex < 0 {
+		chunkIndex = 0
+	}
+
+	chunk, err := m.AllocateChunk(filePath, chunkIndex)
+	if err != nil {
+		return nil, uuid.UUID{}, nil, nil, 0, err
+	}
+
+	chunkID, lease, chunkServers, version, err := m.RequestWrite(filePath, chunk.ID)
+	if err != nil {
+		return nil, uuid.UUID{}, nil, nil, 0, err
+	}
+
+	return chunk, chunkID, lease, chunkServers, version, nil
+}
+
+// AllocateChunk returns chunk of the file at given index. If index is right after
+// the last chunk of the file new chunk is created and appended to the file.
+func (m *Master) AllocateChunk(filePath string, chunkIndex int) (*model.ChunkMetadata, error) {
+	filePath, err := model.NormalizePath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := m.namespaceLocks.Lock(filePath)
+	defer unlock()
+
+	file := m.FileMetadataStore.Get(filePath)
+	if file == nil {
+		return nil, ErrPathNotFound
+	}
+
+	if chunkIndex < 0 || chunkIndex > len(file.Chunks) {
+		return nil, ErrInvalidChunkIndex
+	}
+
+	if chunkIndex < len(file.Chunks) {
+		return m.ChunkMetadataStore.GetChunk(file.Chunks[chunkIndex])
+	}
+
+	if file.ErasureCoding.Enabled() {
+		return nil, ErrFileErasureCoded
+	}
+
+	chunkServers := m.ChunkServerMetadataStore.SelectChunkServers(file.TargetReplicas(), []uuid.UUID{})
+	if len(chunkServers) == 0 {
+		return nil, ErrNoChunkServersAvailable
+	}
+
+	chunkServerIds := make([]uuid.UUID, 0, len(chunkServers))
+	for _, cs := range chunkServers {
+		chunkServerIds = append(chunkServerIds, cs.ID)
+	}
+
+	chunkID := uuid.New()
+	chunkVersion := constants.INITIAL_CHUNK_VERSION
+	chunk := NewChunkMetadata(chunkID, chunkIndex, chunkVersion, file.ChunkSizeBytes(), filePath, chunkServerIds)
+	chunk.ReplicationFactor = file.TargetReplicas()
+	m.ChunkMetadataStore.BeginChange(chunkID)
+	defer m.ChunkMetadataStore.EndChange(chunkID)
+
+	for _, chunkServer := range chunkServers {
+		err := createNewChunk(chunkID, filePath, chunkIndex, chunk.Size, chunkVersion, &chunkServer)
+		if err != nil {
+			return nil, ErrFileCreation
+		}
+	}
+
+	op := Operation{
+		Type:   OpAddChunk,
+		Path:   filePath,
+		Chunks: []model.ChunkMetadata{chunk},
+	}
+
+	err = m.opLog.Commit(op)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunk, nil
+}
+
+// ChunkLocation is chunk metadata together with chunk servers currently holding the chunk
+type ChunkLocation struct {
+	Chunk   model.ChunkMetadata
+	Holders []*ChunkServerMetadata
+}
+
+// GetFileInfo returns metadata of the file at given path and locations of its chunks ordered by chunk index
+func (m *Master) GetFileInfo(path string) (*model.FileMetadata, []ChunkLocation, error) {
+	path, err := model.NormalizePath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file := m.FileMetadataStore.Get(path)
+	if file == nil {
+		return nil, nil, ErrPathNotFound
+	}
+
+	locations, err := m.GetChunkLocations(file.Chunks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, locations, nil
+}
+
+// GetChunkLocations returns current version and chunk servers holding each of given chunks
+func (m *Master) GetChunkLocations(chunkIDs []uuid.UUID) ([]ChunkLocation, error) {
+	locations := make([]ChunkLocation, 0, len(chunkIDs))
+	for _, chunkID := range chunkIDs {
+		chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
+		if err != nil {
+			return nil, err
+		}
+
+		holders := make([]*ChunkServerMetadata, 0, len(chunk.ChunkServers))
+		for _, chunkServerID := range chunk.ChunkServers {
+			chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerID)
+			if chunkServer == nil {
+				continue
+			}
+
+			holders = append(holders, chunkServer)
+		}
+
+		locations = append(locations, ChunkLocation{Chunk: *chunk, Holders: holders})
+	}
+
+	return locations, nil
+}
+
 func (m *Master) RequestLeaseRenewal(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) (*model.Lease, error) {
 	return m.LeaseStore.ExtendLease(chunkID, chunkServer)
 }
 
+// ReportBadChunk drops chunk server holding corrupted replica from chunk holders. Lease held by that
+// chunk server is revoked and chunk is queued for replication from one of the remaining replicas.
+func (m *Master) ReportBadChunk(chunkServerID uuid.UUID, chunkID uuid.UUID) error {
+	err := m.ChunkMetadataStore.RemoveChunkHolderFromChunk(chunkServerID, chunkID)
+	if err != nil {
+		return err
+	}
+
+	lease, exists := m.LeaseStore.GetHolder(chunkID)
+	if exists && lease.ChunkServerID == chunkServerID {
+		go m.revokeLeases(chunkID)
+	}
+
+	m.ReplicationMonitor.EnqueueChunks(chunkID)
+
+	return nil
+}
+
+// ReportChunks updates locations of chunks held by chunk server. Stale replicas reported by chunk server
+// are deleted and chunk is re-replicated. If chunk server reports version newer than the one known to
+// master (e.g. master crashed while incrementing version) master takes over the newer version and
+// other holders become stale.
+func (m *Master) ReportChunks(chunkServerID uuid.UUID, chunks []model.ChunkMetadata) {
+	stale, unknown, newer := m.ChunkMetadataStore.UpdateChunksLocation(chunkServerID, chunks)
+
+	for _, chunk := range newer {
+		version, err := m.opLog.SetChunkVersion(chunk.ID, chunk.Version)
+		if err != nil {
+			log.Errorw("chunk report", "status", "failed to set chunk version", "chunkID", chunk.ID, "error", err)
+			continue
+		}
+
+		if version != chunk.Version {
+			continue
+		}
+
+		log.Infow("chunk report", "status", "took over newer chunk version", "chunkID", chunk.ID, "version", version, "chunkServerID", chunkServerID)
+		go m.revokeLeases(chunk.ID)
+		m.ChunkMetadataStore.SetChunkHolders(chunk.ID, []uuid.UUID{chunkServerID})
+	}
+
+	if len(stale) > 0 {
+		go m.removeStaleReplicas(chunkServerID, stale)
+	}
+
+	if len(unknown) > 0 {
+		go m.removeOrphanedReplicas(chunkServerID, unknown)
+	}
+}
+
+// removeOrphanedReplicas deletes replicas of chunks master does not know about from chunk server
+func (m *Master) removeOrphanedReplicas(chunkServerID uuid.UUID, chunkIDs []uuid.UUID) {
+	chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerID)
+	if chunkServer == nil {
+		return
+	}
+
+	for _, chunkID := range chunkIDs {
+		log.Infow("chunk report", "status", "deleting orphaned replica", "chunkID", chunkID, "chunkServer", chunkServer.Address)
+		err := deleteChunk(chunkID, chunkServer)
+		if err != nil {
+			log.Errorw("chunk report", "status", "failed to delete orphaned replica", "chunkID", chunkID, "chunkServer", chunkServer.Address, "error", err)
+		}
+	}
+}
+
+// removeStaleReplicas deletes stale replicas from chunk server and replicates chunks that
+// are left without enough up-to-date replicas
+func (m *Master) removeStaleReplicas(chunkServerID uuid.UUID, chunkIDs []uuid.UUID) {
+	chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(chunkServerID)
+	if chunkServer == nil {
+		return
+	}
+
+	for _, chunkID := range chunkIDs {
+		chunk, err := m.ChunkMetadataStore.GetChunk(chunkID)
+		if err != nil {
+			continue
+		}
+
+		log.Infow("chunk report", "status", "deleting stale replica", "chunkID", chunkID, "version", chunk.Version, "chunkServer", chunkServer.Address)
+		err = deleteStaleChunk(chunkID, chunk.Version, chunkServer)
+		if err != nil {
+			log.Errorw("chunk report", "status", "failed to delete stale replica", "chunkID", chunkID, "chunkServer", chunkServer.Address, "error", err)
+			continue
+		}
+
+		if len(chunk.ChunkServers) < chunk.TargetReplicas() {
+			m.ReplicationMonitor.EnqueueChunks(chunkID)
+		}
+	}
+}
+
 func (m *Master) StartHealthCheck(ctx context.Context) {
 	m.HealthCheckService.Start(ctx)
 }
@@ -160,28 +990,83 @@ func (m *Master) StartReplicationMonitor(ctx context.Context) {
 	m.ReplicationMonitor.Start(ctx)
 }
 
+func (m *Master) StartRebalancer(ctx context.Context) {
+	m.Rebalancer.Start(ctx)
+}
+
+func (m *Master) StartStripeRepairer(ctx context.Context) {
+	m.StripeRepairer.Start(ctx)
+}
+
+func (m *Master) StartDecommissioner(ctx context.Context) {
+	m.Decommissioner.Start(ctx)
+}
+
 func (m *Master) StartGC(ctx context.Context) {
 	m.GC.Start(ctx)
 }
 
-func (m *Master) grantLeaseRandom(chunkID uuid.UUID, chunkServers []*ChunkServerMetadata) (*model.Lease, error) {
+func (m *Master) StartCheckpointer(ctx context.Context) {
+	m.Checkpointer.Start(ctx)
+}
+
+func (m *Master) Close() error {
+	return m.opLog.Close()
+}
+
+func (m *Master) grantLeaseRandom(chunkID uuid.UUID, chunkServers []*ChunkServerMetadata, epoch int) (*model.Lease, error) {
 	randomIndex := rand.Intn(len(chunkServers))
 	chunkServerMetadata := chunkServers[randomIndex]
-	lease := m.LeaseStore.GrantLease(chunkID, chunkServerMetadata)
+	lease := m.LeaseStore.GrantLease(chunkID, chunkServerMetadata, epoch)
 	err := sendLeaseGrant(chunkID, lease, chunkServerMetadata)
 	return lease, err
 }
 
 func (m *Master) extendLease(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) (*model.Lease, error) {
-    lease, err := m.LeaseStore.ExtendLease(chunkID, chunkServer)
-    if err != nil {
-        return nil, err
-    }
+	lease, err := m.LeaseStore.ExtendLease(chunkID, chunkServer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendLeaseGrant(chunkID, lease, chunkServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, err
+}
+
+// revokeLeases takes leases over given chunks away from their primaries. Each primary is told to give up
+// its lease, leases of primaries that did not acknowledge revocation are waited for to expire. New lease
+// over the chunk is not granted while its lease is being revoked.
+func (m *Master) revokeLeases(chunkIDs ...uuid.UUID) {
+	var waitUntil time.Time
+	revoked := make([]uuid.UUID, 0)
+	for _, chunkID := range chunkIDs {
+		lease, held := m.LeaseStore.RevokeLease(chunkID)
+		if !held {
+			continue
+		}
+
+		revoked = append(revoked, chunkID)
+
+		err := ErrChunkHolderNotFound
+		chunkServer := m.ChunkServerMetadataStore.GetChunkServerMetadata(lease.ChunkServerID)
+		if chunkServer != nil {
+			err = sendLeaseRevoke(chunkID, lease, chunkServer)
+		}
 
-    err = sendLeaseGrant(chunkID, lease, chunkServer)
-    if err != nil {
-        return nil, err
-    }
+		if err != nil {
+			log.Errorw("lease revocation", "status", "revocation not acknowledged, waiting for lease to expire", "chunkID", chunkID, "validUntil", lease.ValidUntil, "error", err)
+			if lease.ValidUntil.After(waitUntil) {
+				waitUntil = lease.ValidUntil
+			}
+		}
+	}
+
+	time.Sleep(time.Until(waitUntil))
 
-    return lease, err
+	for _, chunkID := range revoked {
+		m.LeaseStore.RemoveRevokedLease(chunkID)
+	}
 }
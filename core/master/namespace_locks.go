@@ -0,0 +1,122 @@
+package master
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pyropy/dfs/core/model"
+)
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// NamespaceLocks manages per path read-write locks used to serialize namespace mutations.
+// Mutation takes read locks on all ancestors of the paths it touches and write locks on the paths
+// themselves, so that concurrent mutations in the same directory are allowed while
+// directory can't be removed or snapshotted while something is being created in it.
+type NamespaceLocks struct {
+	lock  sync.Mutex
+	locks map[model.FilePath]*pathLock
+}
+
+type lockRequest struct {
+	path  model.FilePath
+	depth int
+	write bool
+}
+
+func NewNamespaceLocks() *NamespaceLocks {
+	return &NamespaceLocks{
+		locks: make(map[model.FilePath]*pathLock),
+	}
+}
+
+// Lock acquires write locks on given paths and read locks on their ancestors.
+// Locks are acquired ordered by depth in the namespace tree and lexicographically within
+// the same depth to prevent deadlocks. Returned function releases all acquired locks.
+func (nl *NamespaceLocks) Lock(paths ...model.FilePath) func() {
+	requests := make(map[model.FilePath]*lockRequest)
+
+	for _, path := range paths {
+		names := model.SplitPath(path)
+		for i := 0; i <= len(names); i++ {
+			p := model.JoinPath(names[:i]...)
+			isLeaf := i == len(names)
+
+			req, exists := requests[p]
+			if !exists {
+				req = &lockRequest{path: p, depth: i}
+				requests[p] = req
+			}
+
+			req.write = req.write || isLeaf
+		}
+	}
+
+	ordered := make([]*lockRequest, 0, len(requests))
+	for _, req := range requests {
+		ordered = append(ordered, req)
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].depth != ordered[j].depth {
+			return ordered[i].depth < ordered[j].depth
+		}
+
+		return strings.Compare(ordered[i].path, ordered[j].path) < 0
+	})
+
+	held := make([]*pathLock, 0, len(ordered))
+	for _, req := range ordered {
+		l := nl.acquire(req.path)
+		if req.write {
+			l.Lock()
+		} else {
+			l.RLock()
+		}
+
+		held = append(held, l)
+	}
+
+	return func() {
+		for i := len(ordered) - 1; i >= 0; i-- {
+			if ordered[i].write {
+				held[i].Unlock()
+			} else {
+				held[i].RUnlock()
+			}
+
+			nl.release(ordered[i].path)
+		}
+	}
+}
+
+// acquire returns lock for given path registering interest in it
+func (nl *NamespaceLocks) acquire(path model.FilePath) *pathLock {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	l, exists := nl.locks[path]
+	if !exists {
+		l = &pathLock{}
+		nl.locks[path] = l
+	}
+
+	l.refs++
+	return l
+}
+
+// release drops interest in path lock removing it once nobody uses it
+func (nl *NamespaceLocks) release(path model.FilePath) {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	l := nl.locks[path]
+	l.refs--
+	if l.refs == 0 {
+		delete(nl.locks, path)
+	}
+}
@@ -0,0 +1,101 @@
+package master
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNamespaceLocksConcurrentSnapshotsAndCreates(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 200
+	)
+
+	nl := NewNamespaceLocks()
+
+	// number of mutations currently holding locks in /a/b and /c, snapshots lock the directories
+	// themselves and creates lock files inside them, so they must never overlap
+	var snapshotsAB, snapshotsC, createsAB, createsC int32
+	var failed int32
+
+	check := func(cond bool, format string, args ...any) {
+		if !cond && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			t.Errorf(format, args...)
+		}
+	}
+
+	snapshot := func(src, dst string, srcActive, dstActive, srcCreates, dstCreates *int32) {
+		unlock := nl.Lock(src, dst)
+		atomic.AddInt32(srcActive, 1)
+		atomic.AddInt32(dstActive, 1)
+		check(atomic.LoadInt32(srcCreates) == 0, "snapshot of %s overlaps create in it", src)
+		check(atomic.LoadInt32(dstCreates) == 0, "snapshot to %s overlaps create in it", dst)
+		atomic.AddInt32(srcActive, -1)
+		atomic.AddInt32(dstActive, -1)
+		unlock()
+	}
+
+	create := func(dir string, i int, active, snapshots *int32) {
+		unlock := nl.Lock(fmt.Sprintf("%s/f%d", dir, i%5))
+		atomic.AddInt32(active, 1)
+		check(atomic.LoadInt32(snapshots) == 0, "create in %s overlaps snapshot of it", dir)
+		atomic.AddInt32(active, -1)
+		unlock()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(4)
+
+		// overlapping snapshots take the same directories in opposite roles
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				snapshot("/a/b", "/c", &snapshotsAB, &snapshotsC, &createsAB, &createsC)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				snapshot("/c", "/a/b", &snapshotsC, &snapshotsAB, &createsC, &createsAB)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				create("/a/b", i, &createsAB, &snapshotsAB)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				create("/c", i, &createsC, &snapshotsC)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("namespace locks deadlocked")
+	}
+
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	if len(nl.locks) != 0 {
+		t.Fatalf("%d path locks left after all were released", len(nl.locks))
+	}
+}
@@ -0,0 +1,655 @@
+package master
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+)
+
+type OperationType int
+
+const (
+	OpCreateFile OperationType = iota + 1
+	OpDeleteFile
+	OpSetChunkVersion
+	OpAddChunk
+	OpRemoveChunk
+	OpMkdir
+	OpUndeleteFile
+	OpPurgeFile
+	OpSnapshot
+	OpReplaceChunk
+	OpSetReplication
+	OpSetErasureCoding
+)
+
+const (
+	segmentPrefix = "operations-"
+	segmentSuffix = ".log"
+)
+
+// recordHeaderSize is size of the record header holding payload length and payload checksum
+const recordHeaderSize = 8
+
+// maxRecordSize guards against allocating huge buffers when reading torn record header
+const maxRecordSize = 64 << 20
+
+var (
+	ErrCorruptedRecord = errors.New("corrupted operation log record")
+	ErrOperationLogGap = errors.New("operation log is missing operations")
+)
+
+// Operation is single namespace mutation recorded to the operation log.
+// Chunk locations are never recorded, they are learned from chunk server heartbeats.
+type Operation struct {
+	Seq       uint64
+	Type      OperationType
+	Path      model.FilePath           `json:",omitempty"`
+	File      *model.FileMetadata      `json:",omitempty"`
+	Directory *model.DirectoryMetadata `json:",omitempty"`
+	Chunks    []model.ChunkMetadata    `json:",omitempty"`
+	// Files and Directories hold copies created by snapshot, Files also hold files whose replication factor is set
+	Files       []model.FileMetadata      `json:",omitempty"`
+	Directories []model.DirectoryMetadata `json:",omitempty"`
+	Version     int                       `json:",omitempty"`
+	// ReplicationFactor is set for files, replication factor of their chunks is held by Chunks.
+	// File converted to erasure coding is held by File and its parity chunks by Chunks.
+	ReplicationFactor int `json:",omitempty"`
+	ChunkID           uuid.UUID
+	FileID            uuid.UUID
+	Timestamp         time.Time
+}
+
+// OperationLog is durable log of metadata mutations. Every operation is written and
+// fsynced to disk before it is applied to in-memory metadata stores.
+// Log is split into segments, new segment is started each time checkpoint is taken
+// so that segments covered by checkpoints can be removed.
+type OperationLog struct {
+	lock           sync.Mutex
+	checkpointLock sync.Mutex
+	dirPath        string
+	file           *os.File
+	seq            uint64
+	checkpointSeq  uint64
+	fileStore      *FileMetadataStore
+	chunkStore     *ChunkMetadataStore
+}
+
+func NewOperationLog(dirPath string, fileStore *FileMetadataStore, chunkStore *ChunkMetadataStore) (*OperationLog, error) {
+	err := os.MkdirAll(dirPath, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OperationLog{
+		dirPath:    dirPath,
+		fileStore:  fileStore,
+		chunkStore: chunkStore,
+	}, nil
+}
+
+// Recover loads newest valid checkpoint and replays operations recorded after it.
+// Corrupted checkpoint is skipped in favour of the previous one. Torn record at the end
+// of the last segment is result of crash during append and is truncated.
+func (l *OperationLog) Recover() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	segments, err := listSequenced(l.dirPath, segmentPrefix, segmentSuffix)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	if len(segments) > 0 && segments[0] > l.seq+1 {
+		return ErrOperationLogGap
+	}
+
+	for i, firstSeq := range segments {
+		isLast := i == len(segments)-1
+		err = l.replaySegment(firstSeq, isLast)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep appending to the last segment or start a new one
+	if l.file == nil {
+		err = l.openSegment(l.seq + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infow("operation log", "status", "recovered", "checkpoint", l.checkpointSeq, "operations", l.seq)
+	return nil
+}
+
+// Checkpoint takes snapshot of metadata stores, starts new log segment and removes
+// checkpoints and segments that are no longer needed for recovery
+func (l *OperationLog) Checkpoint() error {
+	l.checkpointLock.Lock()
+	defer l.checkpointLock.Unlock()
+
+	// Snapshot and rotation are done under log lock so that checkpoint
+	// reflects exactly the operations written to previous segments
+	l.lock.Lock()
+	if l.seq == l.checkpointSeq {
+		l.lock.Unlock()
+		return nil
+	}
+
+	ckpt := l.snapshot()
+	err := l.rotate()
+	l.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// snapshot holds copies of metadata, so it is encoded without blocking operations being committed
+	data, err := encodeCheckpoint(ckpt)
+	if err != nil {
+		return err
+	}
+
+	err = writeCheckpoint(l.dirPath, ckpt.Seq, data)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.checkpointSeq = ckpt.Seq
+	l.lock.Unlock()
+
+	log.Infow("checkpoint", "status", "checkpoint taken", "seq", ckpt.Seq, "files", len(ckpt.Files), "chunks", len(ckpt.Chunks))
+
+	return l.compact()
+}
+
+// Commit durably records operation and applies it to metadata stores
+func (l *OperationLog) Commit(op Operation) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.commit(op)
+}
+
+// IsOrphaned reports whether chunk is referenced by no file in the namespace nor in trash. Chunks are
+// committed together with file referencing them, so checking under log lock never sees chunk being
+// added as orphaned, while chunk that is orphaned can not be referenced again.
+func (l *OperationLog) IsOrphaned(chunkID uuid.UUID) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.chunkStore.RefCount(chunkID) == 0
+}
+
+// IncrementChunkVersion records new version of a chunk and returns it
+func (l *OperationLog) IncrementChunkVersion(chunkID uuid.UUID) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	chunk, err := l.chunkStore.GetChunk(chunkID)
+	if err != nil {
+		return 0, err
+	}
+
+	op := Operation{
+		Type:    OpSetChunkVersion,
+		ChunkID: chunkID,
+		Version: chunk.Version + 1,
+	}
+
+	err = l.commit(op)
+	if err != nil {
+		return 0, err
+	}
+
+	return op.Version, nil
+}
+
+// SetChunkVersion records version reported by chunk server if it is newer than the one known
+// to master and returns version master ended up with
+func (l *OperationLog) SetChunkVersion(chunkID uuid.UUID, version int) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	chunk, err := l.chunkStore.GetChunk(chunkID)
+	if err != nil {
+		return 0, err
+	}
+
+	if chunk.Version >= version {
+		return chunk.Version, nil
+	}
+
+	op := Operation{
+		Type:    OpSetChunkVersion,
+		ChunkID: chunkID,
+		Version: version,
+	}
+
+	err = l.commit(op)
+	if err != nil {
+		return 0, err
+	}
+
+	return op.Version, nil
+}
+
+func (l *OperationLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
+
+// commit appends operation to the log and applies it. Operation that fails to apply stays in the log,
+// replay skips it with the same error.
+func (l *OperationLog) commit(op Operation) error {
+	op.Seq = l.seq + 1
+
+	// chunk locations are not persisted
+	logged := op
+	logged.Chunks = make([]model.ChunkMetadata, 0, len(op.Chunks))
+	for _, chunk := range op.Chunks {
+		chunk.ChunkServers = nil
+		logged.Chunks = append(logged.Chunks, chunk)
+	}
+
+	err := l.append(logged)
+	if err != nil {
+		return err
+	}
+
+	l.seq = op.Seq
+	return l.apply(op)
+}
+
+func (l *OperationLog) append(op Operation) error {
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Write(record)
+	if err == nil {
+		err = l.file.Sync()
+	}
+
+	// drop partially written record so that next append does not follow garbage
+	if err != nil {
+		_ = l.file.Truncate(offset)
+		_, _ = l.file.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	return nil
+}
+
+// loadCheckpoint loads newest valid checkpoint into metadata stores
+func (l *OperationLog) loadCheckpoint() error {
+	checkpoints, err := listCheckpoints(l.dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range checkpoints {
+		path := fp.Join(l.dirPath, sequencedFilename(checkpointPrefix, seq, checkpointSuffix))
+		ckpt, err := readCheckpoint(path)
+		if err != nil {
+			log.Warnw("checkpoint", "status", "skipping invalid checkpoint", "path", path, "error", err)
+			continue
+		}
+
+		for _, dir := range ckpt.Directories {
+			err = l.fileStore.Mkdir(dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, file := range ckpt.Files {
+			err = l.fileStore.AddNewFileMetadata(file.Path, file)
+			if err != nil {
+				return err
+			}
+
+			l.chunkStore.IncrementRefs(file.AllChunks()...)
+		}
+
+		for _, file := range ckpt.Trash {
+			l.fileStore.AddToTrash(file)
+			l.chunkStore.IncrementRefs(file.AllChunks()...)
+		}
+
+		for _, chunk := range ckpt.Chunks {
+			l.chunkStore.AddNewChunkMetadata(chunk)
+		}
+
+		l.seq = ckpt.Seq
+		l.checkpointSeq = ckpt.Seq
+		return nil
+	}
+
+	// Without valid checkpoint whole log is replayed, missing segments are detected as a gap
+	return nil
+}
+
+// replaySegment applies operations from segment that were not already applied from the checkpoint
+func (l *OperationLog) replaySegment(firstSeq uint64, isLast bool) error {
+	path := fp.Join(l.dirPath, sequencedFilename(segmentPrefix, firstSeq, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+
+	var validOffset int64
+	r := bufio.NewReader(file)
+
+	for {
+		op, n, err := readOperation(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil && !isLast {
+			file.Close()
+			return err
+		}
+
+		if err != nil {
+			log.Warnw("operation log", "status", "truncating torn record", "segment", path, "offset", validOffset, "error", err)
+			err = file.Truncate(validOffset)
+			if err != nil {
+				file.Close()
+				return err
+			}
+
+			break
+		}
+
+		validOffset += n
+		if op.Seq <= l.seq {
+			continue
+		}
+
+		if op.Seq != l.seq+1 {
+			file.Close()
+			return ErrOperationLogGap
+		}
+
+		// operation is logged before it is applied, so one that failed when committed fails the
+		// same way on replay and leaves metadata as it was left then
+		err = l.apply(op)
+		if err != nil {
+			log.Warnw("operation log", "status", "replayed operation failed", "seq", op.Seq, "type", op.Type, "error", err)
+		}
+
+		l.seq = op.Seq
+	}
+
+	if !isLast {
+		return file.Close()
+	}
+
+	_, err = file.Seek(validOffset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	return nil
+}
+
+func (l *OperationLog) openSegment(firstSeq uint64) error {
+	path := fp.Join(l.dirPath, sequencedFilename(segmentPrefix, firstSeq, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekEnd)
+	if err == nil {
+		err = syncDir(l.dirPath)
+	}
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	return nil
+}
+
+// rotate closes current segment and starts new one beginning with next operation
+func (l *OperationLog) rotate() error {
+	prev := l.file
+	err := l.openSegment(l.seq + 1)
+	if err != nil {
+		return err
+	}
+
+	return prev.Close()
+}
+
+// snapshot copies current state of metadata stores
+func (l *OperationLog) snapshot() *Checkpoint {
+	ckpt := &Checkpoint{
+		Seq:         l.seq,
+		Directories: l.fileStore.Directories(),
+		Files:       l.fileStore.Files(),
+		Trash:       l.fileStore.TrashedFiles(),
+		Chunks:      make([]model.ChunkMetadata, 0),
+	}
+
+	l.chunkStore.Chunks.Range(func(k, v any) bool {
+		chunk := v.(model.ChunkMetadata)
+		chunk.ChunkServers = nil
+		ckpt.Chunks = append(ckpt.Chunks, chunk)
+		return true
+	})
+
+	return ckpt
+}
+
+// compact removes all but last few checkpoints and log segments
+// containing only operations covered by the oldest retained checkpoint
+func (l *OperationLog) compact() error {
+	checkpoints, err := listCheckpoints(l.dirPath)
+	if err != nil {
+		return err
+	}
+
+	// Log is kept whole until there is a checkpoint to fall back to
+	if len(checkpoints) < retainedCheckpoints {
+		return nil
+	}
+
+	oldestRetained := checkpoints[retainedCheckpoints-1]
+
+	for _, seq := range checkpoints[retainedCheckpoints:] {
+		err = os.Remove(fp.Join(l.dirPath, sequencedFilename(checkpointPrefix, seq, checkpointSuffix)))
+		if err != nil {
+			return err
+		}
+	}
+
+	segments, err := listSequenced(l.dirPath, segmentPrefix, segmentSuffix)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	// segment is covered when the next segment starts right after the checkpoint or earlier
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i+1] > oldestRetained+1 {
+			break
+		}
+
+		err = os.Remove(fp.Join(l.dirPath, sequencedFilename(segmentPrefix, segments[i], segmentSuffix)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply applies operation to in-memory metadata stores
+func (l *OperationLog) apply(op Operation) error {
+	switch op.Type {
+	case OpCreateFile:
+		err := l.fileStore.AddNewFileMetadata(op.File.Path, *op.File)
+		if err != nil {
+			return err
+		}
+
+		l.chunkStore.IncrementRefs(op.File.Chunks...)
+		for _, chunk := range op.Chunks {
+			l.chunkStore.AddNewChunkMetadata(chunk)
+		}
+	case OpDeleteFile:
+		l.fileStore.MoveToTrash(op.Path, op.Timestamp)
+	case OpUndeleteFile:
+		return l.fileStore.Restore(op.FileID)
+	case OpPurgeFile:
+		if file := l.fileStore.Purge(op.FileID); file != nil {
+			l.chunkStore.DecrementRefs(file.AllChunks()...)
+		}
+	case OpSetChunkVersion:
+		return l.chunkStore.SetChunkVersion(op.ChunkID, op.Version)
+	case OpAddChunk:
+		for _, chunk := range op.Chunks {
+			l.chunkStore.AddNewChunkMetadata(chunk)
+			l.fileStore.AddChunk(op.Path, chunk.Chunk)
+			l.chunkStore.IncrementRefs(chunk.ID)
+		}
+	case OpReplaceChunk:
+		for _, chunk := range op.Chunks {
+			l.chunkStore.AddNewChunkMetadata(chunk)
+			l.fileStore.ReplaceChunk(op.Path, op.ChunkID, chunk.ID)
+			l.chunkStore.IncrementRefs(chunk.ID)
+			l.chunkStore.DecrementRefs(op.ChunkID)
+		}
+	case OpSnapshot:
+		for _, dir := range op.Directories {
+			err := l.fileStore.Mkdir(dir)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, file := range op.Files {
+			err := l.fileStore.AddNewFileMetadata(file.Path, file)
+			if err != nil {
+				return err
+			}
+
+			l.chunkStore.IncrementRefs(file.AllChunks()...)
+		}
+	case OpSetReplication:
+		for _, file := range op.Files {
+			l.fileStore.SetReplicationFactor(file.Path, op.ReplicationFactor)
+		}
+
+		for _, chunk := range op.Chunks {
+			l.chunkStore.SetReplicationFactor(chunk.ID, chunk.ReplicationFactor)
+		}
+	case OpSetErasureCoding:
+		l.fileStore.SetErasureCoding(op.Path, op.File.ErasureCoding, op.File.Stripes, op.File.Size)
+		for _, chunkID := range op.File.Chunks {
+			l.chunkStore.SetErasureCoded(chunkID)
+		}
+
+		// parity chunks are added
+		for _, chunk := range op.Chunks {
+			l.chunkStore.AddNewChunkMetadata(chunk)
+			l.chunkStore.IncrementRefs(chunk.ID)
+		}
+	case OpRemoveChunk:
+		l.chunkStore.RemoveChunkMetadata(op.ChunkID)
+	case OpMkdir:
+		return l.fileStore.Mkdir(*op.Directory)
+	}
+
+	return nil
+}
+
+// readOperation reads single record from the log returning decoded operation and number of bytes read
+func readOperation(r io.Reader) (Operation, int64, error) {
+	var op Operation
+	header := make([]byte, recordHeaderSize)
+
+	_, err := io.ReadFull(r, header)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return op, 0, ErrCorruptedRecord
+	}
+
+	if err != nil {
+		return op, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return op, 0, ErrCorruptedRecord
+	}
+
+	payload := make([]byte, length)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return op, 0, ErrCorruptedRecord
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return op, 0, ErrCorruptedRecord
+	}
+
+	err = json.Unmarshal(payload, &op)
+	if err != nil {
+		return op, 0, ErrCorruptedRecord
+	}
+
+	return op, int64(recordHeaderSize + len(payload)), nil
+}
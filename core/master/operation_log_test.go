@@ -0,0 +1,342 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	fp "path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+)
+
+// openLog returns operation log recovered from given directory together with its file store
+func openLog(t *testing.T, dir string) (*OperationLog, *FileMetadataStore, error) {
+	t.Helper()
+
+	fileStore := NewFileMetadataStore()
+	opLog, err := NewOperationLog(dir, fileStore, NewChunkMetadataStore())
+	if err != nil {
+		t.Fatalf("new operation log: %v", err)
+	}
+
+	err = opLog.Recover()
+	if err == nil {
+		t.Cleanup(func() { opLog.Close() })
+	}
+
+	return opLog, fileStore, err
+}
+
+func mustOpenLog(t *testing.T, dir string) (*OperationLog, *FileMetadataStore) {
+	t.Helper()
+
+	opLog, fileStore, err := openLog(t, dir)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+
+	return opLog, fileStore
+}
+
+// mkdirs commits creation of directories /d<first> up to /d<last>
+func mkdirs(t *testing.T, opLog *OperationLog, first, last int) {
+	t.Helper()
+
+	for i := first; i <= last; i++ {
+		dir := model.NewDirectoryMetadata(fmt.Sprintf("/d%d", i))
+		err := opLog.Commit(Operation{Type: OpMkdir, Directory: &dir})
+		if err != nil {
+			t.Fatalf("commit mkdir %s: %v", dir.Path, err)
+		}
+	}
+}
+
+func checkpoint(t *testing.T, opLog *OperationLog) {
+	t.Helper()
+
+	err := opLog.Checkpoint()
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+}
+
+// dirNames returns sorted paths of directories held by file store
+func dirNames(fileStore *FileMetadataStore) []string {
+	names := make([]string, 0)
+	for _, dir := range fileStore.Directories() {
+		names = append(names, dir.Path)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func wantDirs(first, last int) []string {
+	names := make([]string, 0)
+	for i := first; i <= last; i++ {
+		names = append(names, fmt.Sprintf("/d%d", i))
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func segmentPath(dir string, firstSeq uint64) string {
+	return fp.Join(dir, sequencedFilename(segmentPrefix, firstSeq, segmentSuffix))
+}
+
+func checkpointPath(dir string, seq uint64) string {
+	return fp.Join(dir, sequencedFilename(checkpointPrefix, seq, checkpointSuffix))
+}
+
+func sameNames(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func truncateBy(t *testing.T, path string, n int64) {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+
+	err = os.Truncate(path, info.Size()-n)
+	if err != nil {
+		t.Fatalf("truncate %s: %v", path, err)
+	}
+}
+
+// flipByte inverts byte at given offset from the end of file
+func flipByte(t *testing.T, path string, fromEnd int64) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+
+	data[int64(len(data))-fromEnd] ^= 0xff
+	err = os.WriteFile(path, data, 0640)
+	if err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare writes log into dir and damages it
+		prepare func(t *testing.T, dir string)
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "torn tail is truncated",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				truncateBy(t, segmentPath(dir, 1), 5)
+			},
+			want: wantDirs(1, 2),
+		},
+		{
+			name: "torn record header is truncated",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 2)
+				f, err := os.OpenFile(segmentPath(dir, 1), os.O_APPEND|os.O_WRONLY, 0640)
+				if err != nil {
+					t.Fatalf("open segment: %v", err)
+				}
+
+				f.Write([]byte{0, 0, 1})
+				f.Close()
+			},
+			want: wantDirs(1, 2),
+		},
+		{
+			name: "corrupt record at the end of last segment is truncated",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				flipByte(t, segmentPath(dir, 1), 2)
+			},
+			want: wantDirs(1, 2),
+		},
+		{
+			name: "corrupt record in older segment fails recovery",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 4, 5)
+				flipByte(t, segmentPath(dir, 1), 2)
+				os.Remove(checkpointPath(dir, 3))
+			},
+			wantErr: ErrCorruptedRecord,
+		},
+		{
+			name: "missing first segment is a gap",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 4, 5)
+				os.Remove(segmentPath(dir, 1))
+				os.Remove(checkpointPath(dir, 3))
+			},
+			wantErr: ErrOperationLogGap,
+		},
+		{
+			name: "operations after checkpoint are replayed",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 4, 5)
+			},
+			want: wantDirs(1, 5),
+		},
+		{
+			name: "checkpoint alone is recovered without segments it covers",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 3)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 4, 4)
+				os.Remove(segmentPath(dir, 1))
+			},
+			want: wantDirs(1, 4),
+		},
+		{
+			name: "corrupt newest checkpoint falls back to previous one",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 2)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 3, 4)
+				checkpoint(t, opLog)
+				mkdirs(t, opLog, 5, 5)
+				flipByte(t, checkpointPath(dir, 4), 1)
+			},
+			want: wantDirs(1, 5),
+		},
+		{
+			name: "operation that failed to apply is skipped",
+			prepare: func(t *testing.T, dir string) {
+				opLog, _ := mustOpenLog(t, dir)
+				mkdirs(t, opLog, 1, 1)
+				err := opLog.Commit(Operation{Type: OpSetChunkVersion, ChunkID: uuid.New(), Version: 2})
+				if !errors.Is(err, ErrChunkNotFound) {
+					t.Fatalf("commit version of missing chunk: got %v, want %v", err, ErrChunkNotFound)
+				}
+
+				mkdirs(t, opLog, 2, 2)
+			},
+			want: wantDirs(1, 2),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.prepare(t, dir)
+
+			_, fileStore, err := openLog(t, dir)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("recover: got %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("recover: %v", err)
+			}
+
+			if got := dirNames(fileStore); !sameNames(got, tt.want) {
+				t.Fatalf("recovered directories %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendAfterTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	opLog, _ := mustOpenLog(t, dir)
+	mkdirs(t, opLog, 1, 3)
+	opLog.Close()
+	truncateBy(t, segmentPath(dir, 1), 1)
+
+	opLog, fileStore := mustOpenLog(t, dir)
+	if got, want := dirNames(fileStore), wantDirs(1, 2); !sameNames(got, want) {
+		t.Fatalf("recovered directories %v, want %v", got, want)
+	}
+
+	// sequence continues right after the last valid record
+	mkdirs(t, opLog, 3, 4)
+	opLog.Close()
+
+	_, fileStore = mustOpenLog(t, dir)
+	if got, want := dirNames(fileStore), wantDirs(1, 4); !sameNames(got, want) {
+		t.Fatalf("recovered directories %v, want %v", got, want)
+	}
+}
+
+func TestCheckpointCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opLog, _ := mustOpenLog(t, dir)
+
+	for i := 0; i < 4; i++ {
+		mkdirs(t, opLog, 2*i+1, 2*i+2)
+		checkpoint(t, opLog)
+	}
+
+	mkdirs(t, opLog, 9, 9)
+	opLog.Close()
+
+	checkpoints, err := listCheckpoints(dir)
+	if err != nil {
+		t.Fatalf("list checkpoints: %v", err)
+	}
+
+	if len(checkpoints) != retainedCheckpoints || checkpoints[0] != 8 || checkpoints[1] != 6 {
+		t.Fatalf("checkpoints %v, want [8 6]", checkpoints)
+	}
+
+	segments, err := listSequenced(dir, segmentPrefix, segmentSuffix)
+	if err != nil {
+		t.Fatalf("list segments: %v", err)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+
+	// segments holding operations covered by the oldest retained checkpoint are removed
+	if len(segments) != 2 || segments[0] != 7 || segments[1] != 9 {
+		t.Fatalf("segments %v, want [7 9]", segments)
+	}
+
+	// recovery falls back to older checkpoint and replays segments after it
+	flipByte(t, checkpointPath(dir, 8), 1)
+	_, fileStore := mustOpenLog(t, dir)
+	if got, want := dirNames(fileStore), wantDirs(1, 9); !sameNames(got, want) {
+		t.Fatalf("recovered directories %v, want %v", got, want)
+	}
+}
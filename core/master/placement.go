@@ -0,0 +1,191 @@
+package master
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/lib/utils"
+)
+
+// minFailureDomains is number of racks, and zones where available, replicas of a chunk are spread across
+const minFailureDomains = 2
+
+// Topology describes failure domain of chunk server. Rack names only need to be unique within zone.
+type Topology struct {
+	Zone string
+	Rack string
+}
+
+func (t Topology) rackID() string {
+	return t.Zone + "/" + t.Rack
+}
+
+// spread tracks zones and racks used by replicas of a chunk
+type spread struct {
+	zones map[string]bool
+	racks map[string]bool
+}
+
+func newSpread(chunkServers []ChunkServerMetadata) *spread {
+	s := &spread{
+		zones: make(map[string]bool),
+		racks: make(map[string]bool),
+	}
+
+	for _, cs := range chunkServers {
+		s.add(cs.Topology)
+	}
+
+	return s
+}
+
+func (s *spread) add(t Topology) {
+	s.zones[t.Zone] = true
+	s.racks[t.rackID()] = true
+}
+
+// gain returns how much replica placed on chunk server with given topology would improve the spread,
+// new zone is preferred over new rack within already used zone
+func (s *spread) gain(t Topology) int {
+	switch {
+	case !s.zones[t.Zone]:
+		return 2
+	case !s.racks[t.rackID()]:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// covers reports whether spread is as wide as other spread allows, up to given number of replicas
+func (s *spread) covers(available *spread, replicas int) bool {
+	want := func(n int) int {
+		if n > minFailureDomains {
+			n = minFailureDomains
+		}
+
+		if n > replicas {
+			n = replicas
+		}
+
+		return n
+	}
+
+	return len(s.racks) >= want(len(available.racks)) && len(s.zones) >= want(len(available.zones))
+}
+
+// priority ranks chunk server for new replicas, chunk servers with larger share of free space
+// and fewer writes in flight come first. Chunk servers that have not reported usage yet come last.
+func (cs ChunkServerMetadata) priority() float64 {
+	if cs.TotalBytes == 0 {
+		return 0
+	}
+
+	return float64(cs.FreeBytes) / float64(cs.TotalBytes) / float64(1+cs.InFlightWrites)
+}
+
+// hasFreeSpace reports whether chunk server has not fallen below free space floor
+func (m *ChunkServerMetadataStore) hasFreeSpace(cs ChunkServerMetadata) bool {
+	return cs.TotalBytes == 0 || cs.FreeBytes >= m.minFreeBytes
+}
+
+// acceptsReplicas reports whether new replicas can be placed on chunk server
+func (m *ChunkServerMetadataStore) acceptsReplicas(cs ChunkServerMetadata) bool {
+	return !cs.Draining && m.hasFreeSpace(cs)
+}
+
+// SelectChunkServers selects num active chunk servers for new replicas of a chunk already held by
+// chunkHolders. Each next replica is placed in zone, or at least rack, not used by chunk yet and
+// within the same failure domain gain chunk server with the highest priority is selected.
+// Chunk servers below free space floor or being decommissioned are never selected.
+func (m *ChunkServerMetadataStore) SelectChunkServers(num int, chunkHolders []uuid.UUID) []ChunkServerMetadata {
+	candidates := make([]ChunkServerMetadata, 0)
+	for _, cs := range m.GetAllActiveChunkServers() {
+		if !utils.Contains(chunkHolders, cs.ID) && m.acceptsReplicas(cs) {
+			candidates = append(candidates, cs)
+		}
+	}
+
+	// chunk servers with equal priority are selected at random
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority() > candidates[j].priority()
+	})
+
+	placed := newSpread(m.getChunkServers(chunkHolders))
+	result := make([]ChunkServerMetadata, 0, num)
+	for len(result) < num && len(candidates) > 0 {
+		best := 0
+		for i := range candidates {
+			if placed.gain(candidates[i].Topology) > placed.gain(candidates[best].Topology) {
+				best = i
+			}
+		}
+
+		placed.add(candidates[best].Topology)
+		result = append(result, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+
+	return result
+}
+
+// IsPlacementSatisfied reports whether replicas held by chunkHolders span at least two racks,
+// and two zones where active chunk servers accepting new replicas allow it
+func (m *ChunkServerMetadataStore) IsPlacementSatisfied(chunkHolders []uuid.UUID) bool {
+	holders := m.getChunkServers(chunkHolders)
+	available := newSpread(holders)
+	for _, cs := range m.GetAllActiveChunkServers() {
+		if m.acceptsReplicas(cs) {
+			available.add(cs.Topology)
+		}
+	}
+
+	return newSpread(holders).covers(available, len(holders))
+}
+
+// SelectExcessReplica selects chunk holder whose replica can be removed while keeping remaining replicas
+// spread across as many zones and racks as possible. Preserved chunk holder (e.g. lease holder) is never selected.
+func (m *ChunkServerMetadataStore) SelectExcessReplica(chunkHolders []uuid.UUID, preserved uuid.UUID) (*ChunkServerMetadata, bool) {
+	holders := m.getChunkServers(chunkHolders)
+
+	var selected *ChunkServerMetadata
+	bestZones, bestRacks := -1, -1
+	for i, holder := range holders {
+		if holder.ID == preserved {
+			continue
+		}
+
+		remaining := make([]ChunkServerMetadata, 0, len(holders)-1)
+		remaining = append(remaining, holders[:i]...)
+		remaining = append(remaining, holders[i+1:]...)
+
+		// among equally spread placements replica is removed from chunk server with the lowest priority
+		s := newSpread(remaining)
+		wider := len(s.zones) > bestZones || (len(s.zones) == bestZones && len(s.racks) > bestRacks)
+		sameSpread := len(s.zones) == bestZones && len(s.racks) == bestRacks
+		if wider || (sameSpread && holder.priority() < selected.priority()) {
+			bestZones, bestRacks = len(s.zones), len(s.racks)
+			selected = &holders[i]
+		}
+	}
+
+	return selected, selected != nil
+}
+
+// getChunkServers returns metadata of known chunk servers with given IDs
+func (m *ChunkServerMetadataStore) getChunkServers(chunkServerIDs []uuid.UUID) []ChunkServerMetadata {
+	chunkServers := make([]ChunkServerMetadata, 0, len(chunkServerIDs))
+	for _, id := range chunkServerIDs {
+		cs := m.GetChunkServerMetadata(id)
+		if cs != nil {
+			chunkServers = append(chunkServers, *cs)
+		}
+	}
+
+	return chunkServers
+}
@@ -0,0 +1,320 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+	"github.com/pyropy/dfs/lib/utils"
+)
+
+var (
+	ErrChunkChangedDuringMove = errors.New("chunk changed while it was moved")
+	ErrChunkMoveTargetLost    = errors.New("chunk move target lost the chunk")
+)
+
+// Rebalancer moves chunk replicas from the most utilised chunk servers to the least utilised ones,
+// so that chunk servers added to the cluster take their share of data. It runs only once enabled.
+type Rebalancer struct {
+	leaseStore           *LeaseStore
+	chunkMetadataStore   *ChunkMetadataStore
+	chunkServerMetaStore *ChunkServerMetadataStore
+
+	interval    time.Duration
+	threshold   float64
+	concurrency int
+
+	lock        sync.Mutex
+	enabled     bool
+	movedChunks int
+}
+
+// chunkMove is planned move of chunk replica between two chunk servers
+type chunkMove struct {
+	chunk model.ChunkMetadata
+	from  ChunkServerMetadata
+	to    ChunkServerMetadata
+}
+
+func NewRebalancer(cm *ChunkMetadataStore, lm *LeaseStore, cs *ChunkServerMetadataStore, interval time.Duration, threshold float64, concurrency int) *Rebalancer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Rebalancer{
+		leaseStore:           lm,
+		chunkMetadataStore:   cm,
+		chunkServerMetaStore: cs,
+		interval:             interval,
+		threshold:            threshold,
+		concurrency:          concurrency,
+	}
+}
+
+// Start starts rebalancing loop where chunks are moved on each interval while rebalancer is enabled
+func (r *Rebalancer) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	log.Info("starting rebalancer")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.isEnabled() {
+				r.Rebalance(ctx)
+			}
+		}
+	}
+}
+
+// StartBalancing enables rebalancer
+func (r *Rebalancer) StartBalancing() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.enabled {
+		r.movedChunks = 0
+	}
+
+	r.enabled = true
+}
+
+// StopBalancing disables rebalancer, moves already in progress are finished
+func (r *Rebalancer) StopBalancing() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.enabled = false
+}
+
+// BalancingStatus returns whether rebalancer is enabled and number of chunks moved since it has been enabled
+func (r *Rebalancer) BalancingStatus() (bool, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.enabled, r.movedChunks
+}
+
+func (r *Rebalancer) isEnabled() bool {
+	enabled, _ := r.BalancingStatus()
+	return enabled
+}
+
+// Rebalance plans chunk moves based on utilisation reported by chunk servers and executes them,
+// running at most configured number of moves at once
+func (r *Rebalancer) Rebalance(ctx context.Context) {
+	moves := r.planMoves()
+	if len(moves) == 0 {
+		return
+	}
+
+	log.Infow("rebalancer", "status", "moving chunks", "moves", len(moves))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.concurrency)
+
+	for _, move := range moves {
+		if ctx.Err() != nil || !r.isEnabled() {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(move chunkMove) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := r.moveChunk(move)
+			if err != nil {
+				log.Errorw("rebalancer", "status", "failed to move chunk", "chunkID", move.chunk.ID, "from", move.from.Address, "to", move.to.Address, "error", err)
+				return
+			}
+
+			r.lock.Lock()
+			r.movedChunks++
+			r.lock.Unlock()
+		}(move)
+	}
+
+	wg.Wait()
+}
+
+// planMoves selects chunks to move from chunk servers whose utilisation is above cluster average by more
+// than threshold to chunk servers below average by more than threshold. If only one of the groups exists,
+// the other one is made of all chunk servers on the other side of average. Utilisation is estimated
+// as moves are planned, so that no chunk server is pushed across the average.
+func (r *Rebalancer) planMoves() []chunkMove {
+	servers := make([]ChunkServerMetadata, 0)
+	var used, total int64
+	for _, cs := range r.chunkServerMetaStore.GetAllActiveChunkServers() {
+		// chunks of draining chunk servers are moved by replication instead
+		if cs.TotalBytes == 0 || cs.Draining {
+			continue
+		}
+
+		servers = append(servers, cs)
+		used += cs.TotalBytes - cs.FreeBytes
+		total += cs.TotalBytes
+	}
+
+	if len(servers) < 2 {
+		return nil
+	}
+
+	average := float64(used) / float64(total)
+	usedBytes := make(map[uuid.UUID]int64)
+	utilisation := func(cs ChunkServerMetadata) float64 {
+		return float64(usedBytes[cs.ID]) / float64(cs.TotalBytes)
+	}
+
+	var sources, targets []ChunkServerMetadata
+	for _, cs := range servers {
+		usedBytes[cs.ID] = cs.TotalBytes - cs.FreeBytes
+		switch {
+		case utilisation(cs) > average+r.threshold:
+			sources = append(sources, cs)
+		case utilisation(cs) < average-r.threshold && r.chunkServerMetaStore.hasFreeSpace(cs):
+			targets = append(targets, cs)
+		}
+	}
+
+	if len(sources) == 0 && len(targets) == 0 {
+		return nil
+	}
+
+	if len(sources) == 0 {
+		for _, cs := range servers {
+			if utilisation(cs) > average {
+				sources = append(sources, cs)
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		for _, cs := range servers {
+			if utilisation(cs) < average && r.chunkServerMetaStore.hasFreeSpace(cs) {
+				targets = append(targets, cs)
+			}
+		}
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return utilisation(sources[i]) > utilisation(sources[j])
+	})
+
+	chunksByServer := r.movableChunks()
+	moves := make([]chunkMove, 0)
+	planned := make(map[uuid.UUID]bool)
+	for _, source := range sources {
+		for _, chunk := range chunksByServer[source.ID] {
+			if utilisation(source) <= average {
+				break
+			}
+
+			// chunk is moved at most once per pass since its holders change with each move
+			if planned[chunk.ID] {
+				continue
+			}
+
+			// the least utilised target that keeps replicas spread across failure domains
+			sort.Slice(targets, func(i, j int) bool {
+				return utilisation(targets[i]) < utilisation(targets[j])
+			})
+
+			for _, target := range targets {
+				if utilisation(target) >= average || utils.Contains(chunk.ChunkServers, target.ID) {
+					continue
+				}
+
+				holders := append(utils.Remove(chunk.ChunkServers, source.ID), target.ID)
+				if !r.chunkServerMetaStore.IsPlacementSatisfied(holders) {
+					continue
+				}
+
+				moves = append(moves, chunkMove{chunk: chunk, from: source, to: target})
+				planned[chunk.ID] = true
+				usedBytes[source.ID] -= int64(chunk.Size)
+				usedBytes[target.ID] += int64(chunk.Size)
+				break
+			}
+		}
+	}
+
+	return moves
+}
+
+// movableChunks returns fully replicated chunks that are not being mutated, grouped by chunk servers holding them.
+// Members of erasure coded stripes are not moved since they have to stay on distinct chunk servers.
+func (r *Rebalancer) movableChunks() map[uuid.UUID][]model.ChunkMetadata {
+	chunks := make(map[uuid.UUID][]model.ChunkMetadata)
+	r.chunkMetadataStore.Chunks.Range(func(k, v any) bool {
+		chunk := v.(model.ChunkMetadata)
+		if chunk.ErasureCoded || len(chunk.ChunkServers) != chunk.TargetReplicas() || r.leaseStore.HasLease(chunk.ID) {
+			return true
+		}
+
+		for _, chunkServerID := range chunk.ChunkServers {
+			chunks[chunkServerID] = append(chunks[chunkServerID], chunk)
+		}
+
+		return true
+	})
+
+	return chunks
+}
+
+// moveChunk copies chunk replica to target chunk server and removes it from source once the copy is complete.
+// Copy is dropped if chunk has been mutated in the meantime, since it could have missed the mutation.
+// Target is registered as pending while chunk is moved, so its heart beats neither add the copy to chunk
+// holders before the move is done nor remove it while copy is in flight, and replication monitor does not
+// remove any replica of the chunk as excess. Source is deleted only if target still holds the chunk.
+func (r *Rebalancer) moveChunk(move chunkMove) error {
+	chunkID := move.chunk.ID
+	r.chunkMetadataStore.BeginChange(chunkID)
+	defer r.chunkMetadataStore.EndChange(chunkID)
+	r.chunkMetadataStore.AddPendingTarget(chunkID, move.to.ID)
+
+	err := replicateChunk(chunkID, &move.from, []ChunkServerMetadata{move.to})
+	if err != nil {
+		return err
+	}
+
+	// new lease comes with new chunk version, so replacing holder fails if write was granted after this check
+	err = ErrChunkChangedDuringMove
+	if !r.leaseStore.HasLease(chunkID) {
+		err = r.chunkMetadataStore.ReplaceChunkHolder(chunkID, move.from.ID, move.to.ID, move.chunk.Version)
+	}
+
+	if err != nil {
+		if deleteErr := deleteChunk(chunkID, &move.to); deleteErr != nil {
+			log.Errorw("rebalancer", "status", "failed to delete copy of changed chunk", "chunkID", chunkID, "chunkServer", move.to.Address, "error", deleteErr)
+		}
+
+		if errors.Is(err, ErrChunkVersionChanged) {
+			return ErrChunkChangedDuringMove
+		}
+
+		return err
+	}
+
+	// target might have died or been removed from chunk holders since the copy was made,
+	// source is then put back so that the chunk does not lose replica
+	target := r.chunkServerMetaStore.GetChunkServerMetadata(move.to.ID)
+	if target == nil || !target.Active || !utils.Contains(r.chunkMetadataStore.GetChunkHolders(chunkID), move.to.ID) {
+		_ = r.chunkMetadataStore.AddChunkHolder(chunkID, move.from.ID)
+		return ErrChunkMoveTargetLost
+	}
+
+	err = deleteChunk(chunkID, &move.from)
+	if err != nil {
+		return err
+	}
+
+	// heart beat sent before source replica was deleted might have listed it again
+	return r.chunkMetadataStore.RemoveChunkHolderFromChunk(move.from.ID, chunkID)
+}
@@ -2,51 +2,196 @@ package master
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/pyropy/dfs/core/constants"
 	"github.com/pyropy/dfs/core/model"
+	"github.com/pyropy/dfs/lib/utils"
 	csRpc "github.com/pyropy/dfs/rpc/chunkserver"
 )
 
+var (
+	errChunkServersBusy = errors.New("chunk servers have too many clones in flight")
+)
+
+const (
+	// maxRetryBackoff caps delay between failed replication attempts of the same chunk
+	maxRetryBackoff = 5 * time.Minute
+	// busyRetryDelay is delay after which chunk is retried when its chunk servers are busy cloning other chunks
+	busyRetryDelay = time.Second
+)
+
 type ReplicationMonitor struct {
 	leaseStore           *LeaseStore
 	chunkMetadataStore   *ChunkMetadataStore
 	chunkServerMetaStore *ChunkServerMetadataStore
+	fileStore            *FileMetadataStore
+
+	queue           *ReplicationQueue
+	workers         int
+	clonesPerServer int
+	retryBackoff    time.Duration
+
+	clonesLock sync.Mutex
+	clones     map[uuid.UUID]int
 }
 
-func NewReplicationMonitor(cm *ChunkMetadataStore, lm *LeaseStore, cs *ChunkServerMetadataStore) *ReplicationMonitor {
+func NewReplicationMonitor(cm *ChunkMetadataStore, lm *LeaseStore, cs *ChunkServerMetadataStore, fs *FileMetadataStore, workers, clonesPerServer int, retryBackoff time.Duration) *ReplicationMonitor {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if clonesPerServer < 1 {
+		clonesPerServer = 1
+	}
+
 	return &ReplicationMonitor{
 		leaseStore:           lm,
 		chunkMetadataStore:   cm,
 		chunkServerMetaStore: cs,
+		fileStore:            fs,
+		queue:                NewReplicationQueue(),
+		workers:              workers,
+		clonesPerServer:      clonesPerServer,
+		retryBackoff:         retryBackoff,
+		clones:               make(map[uuid.UUID]int),
 	}
 }
 
 // Start starts process that monitors all chunks are replicated up to selected replication factor
+// and that their replicas are spread across failure domains. Chunks needing new replicas are queued
+// and cloned by pool of workers.
 func (rm *ReplicationMonitor) Start(ctx context.Context) {
 	ticker := time.NewTicker(60 * time.Second)
 	log.Info("starting replication monitor")
 
+	for i := 0; i < rm.workers; i++ {
+		go rm.worker(ctx)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			rm.chunkMetadataStore.Chunks.Range(func(k, v any) bool {
-				c := v.(model.ChunkMetadata)
-				if len(c.ChunkServers) < constants.REPLICATION_FACTOR {
-					err := rm.ReplicateChunk(c.ID)
-					if err != nil {
-						log.Error(err)
-					}
-				}
+			rm.Scan()
+		}
+	}
+}
+
+// Scan checks all chunks, queues chunks that are missing replicas or are not spread across
+// failure domains and removes excess replicas of over-replicated chunks. Lost members of erasure
+// coded stripes are left to the stripe repairer. Replicas held by draining chunk servers are not counted.
+func (rm *ReplicationMonitor) Scan() {
+	live := rm.liveChunks()
+	rm.chunkMetadataStore.Chunks.Range(func(k, v any) bool {
+		c := v.(model.ChunkMetadata)
+		holders := rm.chunkServerMetaStore.WithoutDraining(c.ChunkServers)
+
+		switch {
+		case c.ErasureCoded && len(holders) <= c.TargetReplicas():
+		case len(holders) < c.TargetReplicas():
+			rm.queue.Push(c.ID, len(holders), !live[c.ID])
+		case len(holders) > c.TargetReplicas():
+			err := rm.RemoveExcessReplica(c.ID)
+			if err != nil {
+				log.Error(err)
+			}
+		case !rm.chunkServerMetaStore.IsPlacementSatisfied(holders):
+			rm.queue.Push(c.ID, len(holders), !live[c.ID])
+		}
+
+		return true
+	})
+}
+
+// EnqueueChunks queues given chunks for replication, e.g. after chunk server holding them is lost
+func (rm *ReplicationMonitor) EnqueueChunks(chunkIDs ...uuid.UUID) {
+	if len(chunkIDs) == 0 {
+		return
+	}
+
+	live := rm.liveChunks()
+	for _, chunkID := range chunkIDs {
+		chunk, err := rm.chunkMetadataStore.GetChunk(chunkID)
+		if err != nil || chunk.ErasureCoded {
+			continue
+		}
+
+		holders := rm.chunkServerMetaStore.WithoutDraining(chunk.ChunkServers)
+		rm.queue.Push(chunkID, len(holders), !live[chunkID])
+	}
+}
 
-				return true
-			})
+// liveChunks returns set of chunks referenced by files in the namespace, chunks referenced
+// only by files in trash are not included
+func (rm *ReplicationMonitor) liveChunks() map[uuid.UUID]bool {
+	live := make(map[uuid.UUID]bool)
+	for _, f := range rm.fileStore.Files() {
+		for _, chunkID := range f.AllChunks() {
+			live[chunkID] = true
 		}
 	}
+
+	return live
+}
+
+// worker replicates queued chunks one at a time. Failed chunks are retried with exponential backoff.
+func (rm *ReplicationMonitor) worker(ctx context.Context) {
+	for {
+		task, err := rm.queue.Pop(ctx)
+		if err != nil {
+			return
+		}
+
+		err = rm.replicateQueued(task.chunkID)
+		switch {
+		case err == nil || errors.Is(err, ErrChunkNotFound):
+			rm.queue.Done(task)
+		case errors.Is(err, errChunkServersBusy):
+			rm.queue.Retry(task, busyRetryDelay)
+		default:
+			task.attempts++
+			delay := rm.backoff(task.attempts)
+			log.Errorw("replication", "status", "failed to replicate chunk", "chunkID", task.chunkID, "attempts", task.attempts, "retryIn", delay, "error", err)
+			rm.queue.Retry(task, delay)
+		}
+	}
+}
+
+// backoff returns delay before next replication attempt, doubling with each failed attempt
+func (rm *ReplicationMonitor) backoff(attempts int) time.Duration {
+	delay := rm.retryBackoff
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	return delay
+}
+
+// replicateQueued adds replicas missing to queued chunk or fixes its placement,
+// chunk might have been repaired in the meantime in which case nothing is done
+func (rm *ReplicationMonitor) replicateQueued(chunkID uuid.UUID) error {
+	chunkMetadata, err := rm.chunkMetadataStore.GetChunk(chunkID)
+	if err != nil {
+		return err
+	}
+
+	holders := rm.chunkServerMetaStore.WithoutDraining(chunkMetadata.ChunkServers)
+	switch {
+	case len(holders) < chunkMetadata.TargetReplicas():
+		return rm.ReplicateChunk(chunkID)
+	case len(holders) == chunkMetadata.TargetReplicas() && !rm.chunkServerMetaStore.IsPlacementSatisfied(holders):
+		return rm.FixPlacement(chunkID)
+	default:
+		return nil
+	}
 }
 
 func (rm *ReplicationMonitor) ReplicateChunk(chunkID uuid.UUID) error {
@@ -55,29 +200,151 @@ func (rm *ReplicationMonitor) ReplicateChunk(chunkID uuid.UUID) error {
 		return err
 	}
 
+	holders := rm.chunkServerMetaStore.WithoutDraining(chunkMetadata.ChunkServers)
+	return rm.replicate(chunkMetadata, chunkMetadata.TargetReplicas()-len(holders))
+}
+
+// FixPlacement places one more replica of the chunk into zone or rack not used by the chunk yet.
+// Chunk is over-replicated afterwards and excess replica is removed on the next check.
+func (rm *ReplicationMonitor) FixPlacement(chunkID uuid.UUID) error {
+	chunkMetadata, err := rm.chunkMetadataStore.GetChunk(chunkID)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("replication", "status", "replicas not spread across failure domains", "chunkID", chunkID)
+
+	return rm.replicate(chunkMetadata, 1)
+}
+
+// RemoveExcessReplica deletes replicas of over-replicated chunk until it is left with its target number
+// of replicas, keeping replicas spread across as many failure domains as possible. Replicas held by
+// draining chunk servers are kept until chunk server is retired.
+func (rm *ReplicationMonitor) RemoveExcessReplica(chunkID uuid.UUID) error {
+	for {
+		chunkMetadata, err := rm.chunkMetadataStore.GetChunk(chunkID)
+		if err != nil {
+			return err
+		}
+
+		holders := rm.chunkServerMetaStore.WithoutDraining(chunkMetadata.ChunkServers)
+		if len(holders) <= chunkMetadata.TargetReplicas() {
+			return nil
+		}
+
+		var leaseHolderID uuid.UUID
+		leaseHolder, leaseHolderExists := rm.leaseStore.GetHolder(chunkID)
+		if leaseHolderExists && rm.leaseStore.HasLease(chunkID) {
+			leaseHolderID = leaseHolder.ChunkServerID
+		}
+
+		excess, found := rm.chunkServerMetaStore.SelectExcessReplica(holders, leaseHolderID)
+		if !found {
+			return nil
+		}
+
+		log.Infow("replication", "status", "removing excess replica", "chunkID", chunkID, "chunkServer", excess.Address)
+
+		// holder is removed before its replica is deleted so that chunk being converted or moved
+		// in the meantime never counts on it
+		err = rm.chunkMetadataStore.RemoveExcessHolder(excess.ID, chunkID)
+		if errors.Is(err, ErrChunkChangePending) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = deleteChunk(chunkID, excess)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rm *ReplicationMonitor) replicate(chunkMetadata *model.ChunkMetadata, numberOfReplicas int) error {
+	chunkID := chunkMetadata.ID
 	if len(chunkMetadata.ChunkServers) == 0 {
 		return ErrChunkHasNoHolders
 	}
 
+	// replica is copied from primary if chunk has one, no lease is granted for replication since
+	// new lease has to come with new chunk version. Lease might be held by chunk server that does
+	// not hold the chunk anymore.
+	replicateFrom := rm.chunkServerMetaStore.GetChunkServerMetadata(chunkMetadata.ChunkServers[0])
 	leaseHolder, leaseHolderExists := rm.leaseStore.GetHolder(chunkID)
-	if !leaseHolderExists {
-		chunkServerMetadata := rm.chunkServerMetaStore.GetChunkServerMetadata(chunkMetadata.ChunkServers[0])
-		leaseHolder = rm.leaseStore.GrantLease(chunkID, chunkServerMetadata)
+	if leaseHolderExists && utils.Contains(chunkMetadata.ChunkServers, leaseHolder.ChunkServerID) {
+		replicateFrom = rm.chunkServerMetaStore.GetChunkServerMetadata(leaseHolder.ChunkServerID)
+	}
+
+	if replicateFrom == nil {
+		return ErrChunkHolderNotFound
 	}
 
-	replicateFrom := rm.chunkServerMetaStore.GetChunkServerMetadata(leaseHolder.ChunkServerID)
-	numberOfReplicas := constants.REPLICATION_FACTOR - len(chunkMetadata.ChunkServers)
 	replicateTo := rm.chunkServerMetaStore.SelectChunkServers(numberOfReplicas, chunkMetadata.ChunkServers)
 
 	if len(replicateTo) == 0 {
 		return ErrNoChunkServersAvailable
 	}
 
+	replicateTo, release, err := rm.acquireClones(replicateFrom, replicateTo)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
 	log.Infow("replication", "status", "replicating chunk", "chunkID", chunkID, "chunkServers", replicateTo)
 
 	return replicateChunk(chunkID, replicateFrom, replicateTo)
 }
 
+// acquireClones reserves clone slot on source chunk server and on each target chunk server that has one free.
+// Targets without free slot are left out. Returned function releases reserved slots.
+func (rm *ReplicationMonitor) acquireClones(from *ChunkServerMetadata, to []ChunkServerMetadata) ([]ChunkServerMetadata, func(), error) {
+	rm.clonesLock.Lock()
+	defer rm.clonesLock.Unlock()
+
+	if rm.clones[from.ID] >= rm.clonesPerServer {
+		return nil, nil, errChunkServersBusy
+	}
+
+	targets := make([]ChunkServerMetadata, 0, len(to))
+	for _, t := range to {
+		if rm.clones[t.ID] < rm.clonesPerServer {
+			targets = append(targets, t)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, nil, errChunkServersBusy
+	}
+
+	reserved := []uuid.UUID{from.ID}
+	for _, t := range targets {
+		reserved = append(reserved, t.ID)
+	}
+
+	for _, id := range reserved {
+		rm.clones[id]++
+	}
+
+	release := func() {
+		rm.clonesLock.Lock()
+		defer rm.clonesLock.Unlock()
+
+		for _, id := range reserved {
+			rm.clones[id]--
+			if rm.clones[id] <= 0 {
+				delete(rm.clones, id)
+			}
+		}
+	}
+
+	return targets, release, nil
+}
+
 func replicateChunk(chunkID uuid.UUID, from *ChunkServerMetadata, to []ChunkServerMetadata) error {
 	targets := make([]csRpc.ChunkServer, 0, len(to))
 	for _, t := range to {
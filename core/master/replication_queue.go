@@ -0,0 +1,198 @@
+package master
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// replicationTask is chunk waiting in replication queue
+type replicationTask struct {
+	chunkID uuid.UUID
+	// replicas is number of replicas chunk had when it was queued, chunks with fewer replicas go first
+	replicas int
+	// deleted is set for chunks referenced only by deleted files, these go after all other chunks
+	deleted  bool
+	queuedAt time.Time
+	attempts int
+
+	index   int
+	running bool
+	// requeue is set when chunk is queued again while it is being replicated
+	requeue bool
+}
+
+func (t *replicationTask) before(other *replicationTask) bool {
+	if t.deleted != other.deleted {
+		return !t.deleted
+	}
+
+	if t.replicas != other.replicas {
+		return t.replicas < other.replicas
+	}
+
+	return t.queuedAt.Before(other.queuedAt)
+}
+
+// replicationHeap implements heap.Interface ordering tasks by their priority
+type replicationHeap []*replicationTask
+
+func (h replicationHeap) Len() int           { return len(h) }
+func (h replicationHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+
+func (h replicationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *replicationHeap) Push(x any) {
+	task := x.(*replicationTask)
+	task.index = len(*h)
+	*h = append(*h, task)
+}
+
+func (h *replicationHeap) Pop() any {
+	old := *h
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*h = old[:n-1]
+	return task
+}
+
+// ReplicationQueue holds chunks waiting for replication, the most endangered chunk is taken first.
+// Each chunk is held in queue at most once, whether it is waiting, backing off after failed
+// attempt or being replicated.
+type ReplicationQueue struct {
+	lock  sync.Mutex
+	heap  replicationHeap
+	tasks map[uuid.UUID]*replicationTask
+	ready chan struct{}
+}
+
+func NewReplicationQueue() *ReplicationQueue {
+	return &ReplicationQueue{
+		heap:  make(replicationHeap, 0),
+		tasks: make(map[uuid.UUID]*replicationTask),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Push queues chunk with given number of replicas. If chunk is already queued its priority is raised
+// in case it has lost more replicas since.
+func (q *ReplicationQueue) Push(chunkID uuid.UUID, replicas int, deleted bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	task, exists := q.tasks[chunkID]
+	if !exists {
+		task = &replicationTask{
+			chunkID:  chunkID,
+			replicas: replicas,
+			deleted:  deleted,
+			queuedAt: time.Now(),
+			index:    -1,
+		}
+
+		q.tasks[chunkID] = task
+		heap.Push(&q.heap, task)
+		q.signal()
+		return
+	}
+
+	if task.running {
+		task.requeue = true
+	}
+
+	if replicas < task.replicas || (task.deleted && !deleted) {
+		task.replicas = replicas
+		task.deleted = deleted
+		if task.index >= 0 {
+			heap.Fix(&q.heap, task.index)
+		}
+	}
+}
+
+// Pop blocks until chunk is available and returns it marked as running. Task must be
+// finished with Done or Retry.
+func (q *ReplicationQueue) Pop(ctx context.Context) (*replicationTask, error) {
+	for {
+		q.lock.Lock()
+		if q.heap.Len() > 0 {
+			task := heap.Pop(&q.heap).(*replicationTask)
+			task.running = true
+			task.requeue = false
+			if q.heap.Len() > 0 {
+				q.signal()
+			}
+
+			q.lock.Unlock()
+			return task, nil
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.ready:
+		}
+	}
+}
+
+// Done removes finished task from queue, unless chunk has been queued again while it was replicated
+func (q *ReplicationQueue) Done(task *replicationTask) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	task.running = false
+	if task.requeue {
+		task.requeue = false
+		task.attempts = 0
+		heap.Push(&q.heap, task)
+		q.signal()
+		return
+	}
+
+	delete(q.tasks, task.chunkID)
+}
+
+// Retry puts task back to queue after given delay, keeping its place in the queue
+func (q *ReplicationQueue) Retry(task *replicationTask, delay time.Duration) {
+	q.lock.Lock()
+	task.running = false
+	task.requeue = false
+	q.lock.Unlock()
+
+	time.AfterFunc(delay, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+
+		if task.index >= 0 || task.running {
+			return
+		}
+
+		heap.Push(&q.heap, task)
+		q.signal()
+	})
+}
+
+// Len returns number of chunks held in queue
+func (q *ReplicationQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.tasks)
+}
+
+// signal wakes up one waiting worker, it must be called with lock held
+func (q *ReplicationQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -11,13 +11,17 @@ import (
 const (
 	RpcCreateChunk           = "ChunkServerAPI.CreateChunk"
 	RpcGrantLease            = "ChunkServerAPI.GrantLease"
+	RpcRevokeLease           = "ChunkServerAPI.RevokeLease"
 	RpcIncrementChunkVersion = "ChunkServerAPI.IncrementChunkVersion"
 	RpcDeleteChunk           = "ChunkServerAPI.DeleteChunk"
+	RpcCloneChunk            = "ChunkServerAPI.CloneChunk"
+	RpcRebuildStripe         = "ChunkServerAPI.RebuildStripe"
 )
 
-func createNewChunk(id uuid.UUID, filePath string, size int, chunkVersion int, chunkServer *ChunkServerMetadata) error {
+func createNewChunk(id uuid.UUID, filePath string, index int, size int, chunkVersion int, chunkServer *ChunkServerMetadata) error {
 	args := csRpc.CreateChunkRequest{
 		ChunkID:      id,
+		ChunkIndex:   index,
 		ChunkSize:    size,
 		ChunkVersion: chunkVersion,
 		FilePath:     filePath,
@@ -28,15 +32,27 @@ func createNewChunk(id uuid.UUID, filePath string, size int, chunkVersion int, c
 }
 
 func sendLeaseGrant(chunkID uuid.UUID, lease *model.Lease, chunkServer *ChunkServerMetadata) error {
+	// chunk server counts lease duration by its own clock
 	args := csRpc.GrantLeaseArgs{
-		ChunkID:    chunkID,
-		ValidUntil: lease.ValidUntil,
+		ChunkID:  chunkID,
+		ValidFor: ChunkServerLeaseDuration(lease),
+		Epoch:    lease.Epoch,
 	}
 
 	reply := csRpc.GrantLeaseReply{}
 	return call(chunkServer, RpcGrantLease, args, &reply)
 }
 
+func sendLeaseRevoke(chunkID uuid.UUID, lease *model.Lease, chunkServer *ChunkServerMetadata) error {
+	args := csRpc.RevokeLeaseArgs{
+		ChunkID: chunkID,
+		Epoch:   lease.Epoch,
+	}
+
+	reply := csRpc.RevokeLeaseReply{}
+	return call(chunkServer, RpcRevokeLease, args, &reply)
+}
+
 func incrementChunkVersion(chunkID uuid.UUID, version int, chunkServer *ChunkServerMetadata) error {
 	args := csRpc.IncrementChunkVersionArgs{
 		ChunkID: chunkID,
@@ -47,6 +63,19 @@ func incrementChunkVersion(chunkID uuid.UUID, version int, chunkServer *ChunkSer
 	return call(chunkServer, RpcIncrementChunkVersion, args, &reply)
 }
 
+func cloneChunk(chunkID uuid.UUID, newChunk model.ChunkMetadata, chunkServer *ChunkServerMetadata) error {
+	args := csRpc.CloneChunkArgs{
+		ChunkID:    chunkID,
+		NewChunkID: newChunk.ID,
+		ChunkIndex: newChunk.Index,
+		Version:    newChunk.Version,
+		FilePath:   newChunk.FilePath,
+	}
+	reply := csRpc.CloneChunkReply{}
+
+	return call(chunkServer, RpcCloneChunk, args, &reply)
+}
+
 func deleteChunk(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) error {
 	args := csRpc.DeleteChunkRequest{
 		ChunkID: chunkID,
@@ -56,6 +85,29 @@ func deleteChunk(chunkID uuid.UUID, chunkServer *ChunkServerMetadata) error {
 	return call(chunkServer, RpcDeleteChunk, args, &reply)
 }
 
+// deleteStaleChunk deletes replica of the chunk only if it is older than given version
+func deleteStaleChunk(chunkID uuid.UUID, version int, chunkServer *ChunkServerMetadata) error {
+	args := csRpc.DeleteChunkRequest{
+		ChunkID: chunkID,
+		Version: version,
+	}
+	reply := csRpc.DeleteChunkReply{}
+
+	return call(chunkServer, RpcDeleteChunk, args, &reply)
+}
+
+// rebuildStripe instructs chunk server to rebuild missing members of erasure coded stripe and
+// returns number of bytes held by each stripe member
+func rebuildStripe(args csRpc.RebuildStripeArgs, chunkServer *ChunkServerMetadata) ([]int, error) {
+	reply := csRpc.RebuildStripeReply{}
+	err := call(chunkServer, RpcRebuildStripe, args, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Lengths, nil
+}
+
 func call(chunkServer *ChunkServerMetadata, method string, args interface{}, reply interface{}) error {
 	client, err := rpc.DialHTTP("tcp", chunkServer.Address)
 	if err != nil {
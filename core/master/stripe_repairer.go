@@ -0,0 +1,162 @@
+package master
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/model"
+	csRpc "github.com/pyropy/dfs/rpc/chunkserver"
+)
+
+// StripeRepairer rebuilds lost chunks of erasure coded stripes. Erasure coded chunks are kept without
+// replicas, so instead of being copied lost chunk is decoded from the rest of its stripe.
+type StripeRepairer struct {
+	chunkMetadataStore   *ChunkMetadataStore
+	chunkServerMetaStore *ChunkServerMetadataStore
+	fileStore            *FileMetadataStore
+
+	// lock serializes repair passes, so that stripe member is never rebuilt by two passes at once
+	lock sync.Mutex
+}
+
+func NewStripeRepairer(cm *ChunkMetadataStore, cs *ChunkServerMetadataStore, fs *FileMetadataStore) *StripeRepairer {
+	return &StripeRepairer{
+		chunkMetadataStore:   cm,
+		chunkServerMetaStore: cs,
+		fileStore:            fs,
+	}
+}
+
+// Start starts process that periodically checks stripes of all erasure coded files and repairs them
+func (sr *StripeRepairer) Start(ctx context.Context) {
+	ticker := time.NewTicker(60 * time.Second)
+	log.Info("starting stripe repairer")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sr.RepairStripes()
+		}
+	}
+}
+
+// RepairStripes repairs stripes of erasure coded files in the namespace and in trash that lost some of their chunks
+func (sr *StripeRepairer) RepairStripes() {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	// stripes are shared by snapshots of the file
+	checked := make(map[uuid.UUID]bool)
+	files := append(sr.fileStore.Files(), sr.fileStore.TrashedFiles()...)
+	for _, file := range files {
+		if !file.ErasureCoding.Enabled() {
+			continue
+		}
+
+		for _, stripe := range file.Stripes {
+			parityID := stripe.Chunks[file.ErasureCoding.DataShards]
+			if checked[parityID] {
+				continue
+			}
+
+			checked[parityID] = true
+			err := sr.RepairStripe(file, stripe)
+			if err != nil {
+				log.Errorw("stripe repair", "status", "failed to repair stripe", "path", file.Path, "parityChunkID", parityID, "error", err)
+			}
+		}
+	}
+}
+
+// RepairStripe rebuilds chunks of the stripe that have no holders on chunk servers not used by the stripe.
+// Stripe can be repaired as long as it has lost no more chunks than it has parity chunks. Chunks held only
+// by draining chunk servers are copied from them to new chunk servers as part of the same rebuild.
+func (sr *StripeRepairer) RepairStripe(file model.FileMetadata, stripe model.Stripe) error {
+	ec := file.ErasureCoding
+	members := make([]csRpc.StripeMember, len(stripe.Chunks))
+	used := make([]uuid.UUID, 0, len(stripe.Chunks))
+	lost := make([]int, 0)
+	moved := make([]int, 0)
+
+	for i, chunkID := range stripe.Chunks {
+		members[i] = csRpc.StripeMember{ChunkID: chunkID, Length: stripe.Lengths[i]}
+		if chunkID == uuid.Nil {
+			continue
+		}
+
+		chunk, err := sr.chunkMetadataStore.GetChunk(chunkID)
+		if err != nil {
+			return err
+		}
+
+		members[i].Version = chunk.Version
+		members[i].Index = chunk.Index
+
+		draining := false
+		for _, holderID := range chunk.ChunkServers {
+			holder := sr.chunkServerMetaStore.GetChunkServerMetadata(holderID)
+			if holder == nil || !holder.Active {
+				continue
+			}
+
+			used = append(used, holderID)
+			if members[i].Source == "" || draining {
+				members[i].Source = holder.Address
+				draining = holder.Draining
+			}
+		}
+
+		switch {
+		case members[i].Source == "":
+			lost = append(lost, i)
+		case draining:
+			moved = append(moved, i)
+		}
+	}
+
+	rebuilt := append(lost, moved...)
+	if len(rebuilt) == 0 {
+		return nil
+	}
+
+	if len(lost) > ec.ParityShards {
+		return ErrStripeUnrecoverable
+	}
+
+	targets := sr.chunkServerMetaStore.SelectChunkServers(len(rebuilt), used)
+	if len(targets) < len(rebuilt) {
+		return ErrNoChunkServersAvailable
+	}
+
+	for t, i := range rebuilt {
+		members[i].Target = targets[t].Address
+	}
+
+	log.Infow("stripe repair", "status", "rebuilding lost chunks", "path", file.Path, "lost", len(lost), "moved", len(moved))
+
+	args := csRpc.RebuildStripeArgs{
+		DataShards:   ec.DataShards,
+		ParityShards: ec.ParityShards,
+		ChunkSize:    file.ChunkSizeBytes(),
+		FilePath:     file.Path,
+		Members:      members,
+	}
+
+	_, err := rebuildStripe(args, &targets[0])
+	if err != nil {
+		return err
+	}
+
+	for t, i := range rebuilt {
+		err = sr.chunkMetadataStore.AddChunkHolder(stripe.Chunks[i], targets[t].ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/constants"
 )
 
 type Chunk struct {
@@ -11,10 +12,28 @@ type Chunk struct {
 	FilePath string // file path on disk
 	Checksum int
 	Index    int
+	Size     int // maximum chunk size in bytes
 }
 
 type ChunkMetadata struct {
 	Chunk
-	ChunkServers []uuid.UUID
-	Lease        uuid.UUID
+	ChunkServers      []uuid.UUID
+	Lease             uuid.UUID
+	ReplicationFactor int
+	// ErasureCoded is set for members of erasure coded stripes, they are stored without replicas
+	ErasureCoded bool
+}
+
+// TargetReplicas returns number of replicas chunk should be kept at. Chunks recorded
+// before replication factor was set per file are kept at default replication factor.
+func (c ChunkMetadata) TargetReplicas() int {
+	if c.ErasureCoded {
+		return 1
+	}
+
+	if c.ReplicationFactor == 0 {
+		return constants.REPLICATION_FACTOR
+	}
+
+	return c.ReplicationFactor
 }
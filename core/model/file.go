@@ -1,24 +1,155 @@
 package model
 
 import (
-	"github.com/google/uuid"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/pyropy/dfs/core/constants"
 )
 
+var ErrInvalidErasureCoding = errors.New("invalid erasure coding policy")
+
 type FileMetadata struct {
-	ID        uuid.UUID
+	ID                uuid.UUID
+	Path              string
+	Size              int
+	Chunks            []uuid.UUID
+	CreatedAt         time.Time
+	Deleted           bool
+	DeletedAt         time.Time
+	ReplicationFactor int
+	ChunkSize         int
+	// ErasureCoding is set for files whose chunks are stored as erasure coded stripes instead of replicas
+	ErasureCoding ErasureCoding
+	Stripes       []Stripe
+}
+
+// ErasureCoding is Reed-Solomon code with DataShards data chunks and ParityShards parity chunks
+// per stripe. Stripe survives loss of any ParityShards of its chunks.
+type ErasureCoding struct {
+	DataShards   int
+	ParityShards int
+}
+
+// ParseErasureCoding parses erasure coding policy written as RS-<data>-<parity>, e.g. RS-6-3
+func ParseErasureCoding(policy string) (ErasureCoding, error) {
+	var ec ErasureCoding
+	var rest string
+
+	n, _ := fmt.Sscanf(policy+" ", "RS-%d-%d%s", &ec.DataShards, &ec.ParityShards, &rest)
+	if n != 2 || !ec.Valid() {
+		return ErasureCoding{}, ErrInvalidErasureCoding
+	}
+
+	return ec, nil
+}
+
+func (e ErasureCoding) String() string {
+	if !e.Enabled() {
+		return ""
+	}
+
+	return fmt.Sprintf("RS-%d-%d", e.DataShards, e.ParityShards)
+}
+
+// Enabled reports whether erasure coding policy is set
+func (e ErasureCoding) Enabled() bool {
+	return e.DataShards > 0
+}
+
+// Valid reports whether policy has at least one data and one parity shard and fits into stripe width limit
+func (e ErasureCoding) Valid() bool {
+	return e.DataShards > 0 && e.ParityShards > 0 && e.StripeWidth() <= constants.MAX_STRIPE_WIDTH
+}
+
+// StripeWidth returns number of chunks in each stripe
+func (e ErasureCoding) StripeWidth() int {
+	return e.DataShards + e.ParityShards
+}
+
+// Stripe is group of data chunks with parity chunks computed over them
+type Stripe struct {
+	// Chunks holds data chunks followed by parity chunks. Last stripe of the file may have fewer
+	// data chunks, their place is held by uuid.Nil and they are read as zeros.
+	Chunks []uuid.UUID
+	// Lengths holds number of bytes stored in each chunk of the stripe
+	Lengths []int
+}
+
+// ParityChunks returns parity chunks of erasure coded file
+func (f FileMetadata) ParityChunks() []uuid.UUID {
+	chunks := make([]uuid.UUID, 0, len(f.Stripes)*f.ErasureCoding.ParityShards)
+	for _, stripe := range f.Stripes {
+		chunks = append(chunks, stripe.Chunks[f.ErasureCoding.DataShards:]...)
+	}
+
+	return chunks
+}
+
+// AllChunks returns data chunks of the file followed by its parity chunks
+func (f FileMetadata) AllChunks() []uuid.UUID {
+	return append(append([]uuid.UUID{}, f.Chunks...), f.ParityChunks()...)
+}
+
+// TargetReplicas returns number of replicas chunks of the file should be kept at. Files
+// recorded before replication factor was set per file are kept at default replication factor.
+func (f FileMetadata) TargetReplicas() int {
+	if f.ReplicationFactor == 0 {
+		return constants.REPLICATION_FACTOR
+	}
+
+	return f.ReplicationFactor
+}
+
+// ChunkSizeBytes returns size of the file chunks. Files recorded before chunk size
+// was set per file use chunk size that was used for all files at the time.
+func (f FileMetadata) ChunkSizeBytes() int {
+	if f.ChunkSize == 0 {
+		return constants.LEGACY_CHUNK_SIZE_BYTES
+	}
+
+	return f.ChunkSize
+}
+
+// ValidChunkSize reports whether chunk size is within limits and aligned to the smallest chunk size
+func ValidChunkSize(chunkSize int) bool {
+	return chunkSize >= constants.MIN_CHUNK_SIZE_BYTES && chunkSize <= constants.MAX_CHUNK_SIZE_BYTES &&
+		chunkSize%constants.MIN_CHUNK_SIZE_BYTES == 0
+}
+
+type DirectoryMetadata struct {
 	Path      string
-	Chunks    []uuid.UUID
-	Deleted   bool
-	DeletedAt time.Time
+	CreatedAt time.Time
+}
+
+// FileStatus describes file or directory found in the namespace
+type FileStatus struct {
+	Path              string
+	IsDir             bool
+	Size              int
+	NumChunks         int
+	CreatedAt         time.Time
+	ReplicationFactor int
+	ChunkSize         int
+	ErasureCoding     string
 }
 
 type FilePath = string
 
 func NewFileMetadata(path string) FileMetadata {
 	return FileMetadata{
-		ID:     uuid.New(),
-		Path:   path,
-		Chunks: []uuid.UUID{},
+		ID:        uuid.New(),
+		Path:      path,
+		Chunks:    []uuid.UUID{},
+		CreatedAt: time.Now(),
+	}
+}
+
+func NewDirectoryMetadata(path string) DirectoryMetadata {
+	return DirectoryMetadata{
+		Path:      path,
+		CreatedAt: time.Now(),
 	}
 }
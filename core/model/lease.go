@@ -9,6 +9,11 @@ type Lease struct {
 	ChunkID       uuid.UUID
 	ValidUntil    time.Time
 	ChunkServerID uuid.UUID
+	// Epoch is chunk version lease was granted for. Chunk version is incremented with every new lease
+	// granted over the chunk, so epochs of later leases are always higher.
+	Epoch int
+	// Revoked is set by master once it started revoking lease, revoked lease is never extended
+	Revoked bool
 }
 
 func (l *Lease) IsExpired() bool {
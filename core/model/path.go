@@ -0,0 +1,85 @@
+package model
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	PathSeparator     = "/"
+	RootPath          = "/"
+	MaxPathLength     = 4096
+	MaxPathNameLength = 255
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid path")
+)
+
+// NormalizePath validates given path and returns it in canonical form.
+// Path has to be absolute, duplicate and trailing separators are removed
+// while "." and ".." names are rejected.
+func NormalizePath(path string) (FilePath, error) {
+	if !strings.HasPrefix(path, PathSeparator) || len(path) > MaxPathLength {
+		return "", ErrInvalidPath
+	}
+
+	names := SplitPath(path)
+	for _, name := range names {
+		if name == "." || name == ".." || len(name) > MaxPathNameLength || strings.ContainsRune(name, 0) {
+			return "", ErrInvalidPath
+		}
+	}
+
+	return JoinPath(names...), nil
+}
+
+// SplitPath splits path to names of its components, root path has no components
+func SplitPath(path FilePath) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(path, PathSeparator) {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// JoinPath joins names to absolute path
+func JoinPath(names ...string) FilePath {
+	return RootPath + strings.Join(names, PathSeparator)
+}
+
+// ParentPath returns path of the parent directory, parent of the root is root itself
+func ParentPath(path FilePath) FilePath {
+	names := SplitPath(path)
+	if len(names) == 0 {
+		return RootPath
+	}
+
+	return JoinPath(names[:len(names)-1]...)
+}
+
+// BaseName returns last component of the path
+func BaseName(path FilePath) string {
+	names := SplitPath(path)
+	if len(names) == 0 {
+		return RootPath
+	}
+
+	return names[len(names)-1]
+}
+
+// ComparePaths compares paths component by component so that directory
+// is ordered right before its children
+func ComparePaths(a, b FilePath) int {
+	an, bn := SplitPath(a), SplitPath(b)
+	for i := 0; i < len(an) && i < len(bn); i++ {
+		if c := strings.Compare(an[i], bn[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(an) - len(bn)
+}
@@ -4,8 +4,6 @@ go 1.18
 
 require (
 	github.com/google/uuid v1.3.0
-	github.com/ipfs/go-datastore v0.5.0
-	github.com/ipfs/go-ds-leveldb v0.5.0
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/urfave/cli/v2 v2.25.3
 	go.uber.org/zap v1.24.0
@@ -13,10 +11,7 @@ require (
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
-	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
-	github.com/jbenet/goprocess v0.1.4 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
@@ -1,5 +1,7 @@
 package cache
 
+import "sync"
+
 type LRUNode struct {
 	Key int
 	Val []byte
@@ -9,6 +11,7 @@ type LRUNode struct {
 }
 
 type LRU struct {
+	lock     sync.Mutex
 	capacity int
 	cache    map[int]*LRUNode
 
@@ -31,6 +34,9 @@ func NewLRU(capacity int) *LRU {
 }
 
 func (l *LRU) Put(key int, value []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	node, exists := l.cache[key]
 	if exists {
 		l.deleteNode(node)
@@ -46,6 +52,9 @@ func (l *LRU) Put(key int, value []byte) {
 }
 
 func (l *LRU) Get(key int) ([]byte, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
 	node, exists := l.cache[key]
 	if !exists {
 		return []byte{}, exists
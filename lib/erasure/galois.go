@@ -0,0 +1,63 @@
+package erasure
+
+// Arithmetic in GF(2^8) built from primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+const fieldPolynomial = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fieldPolynomial
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func galMul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+func galInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// galExp returns a raised to the power of n
+func galExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulSliceXor adds c * in to out
+func mulSliceXor(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+
+	table := &mulTable[c]
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
@@ -0,0 +1,109 @@
+package erasure
+
+import "errors"
+
+var errSingularMatrix = errors.New("matrix is singular")
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+
+	return m
+}
+
+func identityMatrix(size int) matrix {
+	m := newMatrix(size, size)
+	for i := range m {
+		m[i][i] = 1
+	}
+
+	return m
+}
+
+// vandermonde returns matrix whose row r is 1, r, r^2, ... Any cols rows of it are linearly independent.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galExp(byte(r), c)
+		}
+	}
+
+	return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range result {
+		for c := range result[r] {
+			var value byte
+			for i := range other {
+				value ^= galMul(m[r][i], other[i][c])
+			}
+
+			result[r][c] = value
+		}
+	}
+
+	return result
+}
+
+// subMatrix returns copy of given rows of the matrix
+func (m matrix) subMatrix(rows []int) matrix {
+	result := make(matrix, len(rows))
+	for i, r := range rows {
+		result[i] = append([]byte{}, m[r]...)
+	}
+
+	return result
+}
+
+// invert returns inverse of square matrix using Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, 2*size)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		pivot := c
+		for pivot < size && work[pivot][c] == 0 {
+			pivot++
+		}
+
+		if pivot == size {
+			return nil, errSingularMatrix
+		}
+
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := galInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = galMul(work[c][i], scale)
+		}
+
+		for r := 0; r < size; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= galMul(factor, work[c][i])
+			}
+		}
+	}
+
+	result := make(matrix, size)
+	for r := range work {
+		result[r] = work[r][size:]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,170 @@
+package erasure
+
+import (
+	"errors"
+)
+
+// MaxShards is the largest number of shards code can have, bounded by the size of the field
+const MaxShards = 256
+
+var (
+	ErrInvalidShardCount = errors.New("invalid number of shards")
+	ErrShardSizeMismatch = errors.New("shards differ in size")
+	ErrTooFewShards      = errors.New("too few shards to reconstruct data")
+)
+
+// ReedSolomon is systematic Reed-Solomon code over GF(2^8). Data shards are stored as they are
+// and any dataShards out of dataShards+parityShards shards are enough to recover the rest.
+type ReedSolomon struct {
+	dataShards   int
+	parityShards int
+	// encoding holds identity matrix on top of parityShards rows computing parity
+	encoding matrix
+}
+
+func New(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > MaxShards {
+		return nil, ErrInvalidShardCount
+	}
+
+	total := dataShards + parityShards
+	v := vandermonde(total, dataShards)
+
+	top, err := v.subMatrix(indexes(dataShards)).invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoding:     v.multiply(top),
+	}, nil
+}
+
+// Encode computes parity shards from data shards. Shards holds data shards followed by
+// parity shards, missing parity shards are allocated.
+func (r *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != r.dataShards+r.parityShards {
+		return ErrInvalidShardCount
+	}
+
+	for _, shard := range shards[:r.dataShards] {
+		if shard == nil {
+			return ErrTooFewShards
+		}
+	}
+
+	size, err := shardSize(shards[:r.dataShards])
+	if err != nil {
+		return err
+	}
+
+	for p := r.dataShards; p < len(shards); p++ {
+		shards[p] = r.computeShard(r.encoding[p], shards[:r.dataShards], shards[p], size)
+	}
+
+	return nil
+}
+
+// Reconstruct recovers missing shards, marked as nil, from the ones present
+func (r *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != r.dataShards+r.parityShards {
+		return ErrInvalidShardCount
+	}
+
+	size, err := shardSize(shards)
+	if err != nil {
+		return err
+	}
+
+	present := make([]int, 0, r.dataShards)
+	missingData := false
+	for i, shard := range shards {
+		if shard != nil && len(present) < r.dataShards {
+			present = append(present, i)
+		}
+
+		if shard == nil && i < r.dataShards {
+			missingData = true
+		}
+	}
+
+	if len(present) < r.dataShards {
+		return ErrTooFewShards
+	}
+
+	if missingData {
+		decoding, err := r.encoding.subMatrix(present).invert()
+		if err != nil {
+			return err
+		}
+
+		inputs := make([][]byte, len(present))
+		for i, index := range present {
+			inputs[i] = shards[index]
+		}
+
+		for d := 0; d < r.dataShards; d++ {
+			if shards[d] == nil {
+				shards[d] = r.computeShard(decoding[d], inputs, nil, size)
+			}
+		}
+	}
+
+	for p := r.dataShards; p < len(shards); p++ {
+		if shards[p] == nil {
+			shards[p] = r.computeShard(r.encoding[p], shards[:r.dataShards], nil, size)
+		}
+	}
+
+	return nil
+}
+
+// computeShard returns linear combination of inputs with given coefficients written into out
+func (r *ReedSolomon) computeShard(coefficients []byte, inputs [][]byte, out []byte, size int) []byte {
+	if len(out) != size {
+		out = make([]byte, size)
+	} else {
+		for i := range out {
+			out[i] = 0
+		}
+	}
+
+	for i, input := range inputs {
+		mulSliceXor(coefficients[i], input, out)
+	}
+
+	return out
+}
+
+// shardSize returns size shared by all present shards
+func shardSize(shards [][]byte) (int, error) {
+	size := -1
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+
+		if size >= 0 && len(shard) != size {
+			return 0, ErrShardSizeMismatch
+		}
+
+		size = len(shard)
+	}
+
+	if size < 0 {
+		return 0, ErrTooFewShards
+	}
+
+	return size, nil
+}
+
+func indexes(n int) []int {
+	result := make([]int, n)
+	for i := range result {
+		result[i] = i
+	}
+
+	return result
+}
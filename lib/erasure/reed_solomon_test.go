@@ -0,0 +1,187 @@
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var codes = []struct {
+	dataShards   int
+	parityShards int
+}{
+	{1, 1},
+	{2, 1},
+	{3, 2},
+	{4, 2},
+	{6, 3},
+	{10, 4},
+}
+
+const testShardSize = 64
+
+// encodedShards returns random data shards followed by parity shards computed from them
+func encodedShards(t *testing.T, code *ReedSolomon, dataShards, parityShards int) [][]byte {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(int64(dataShards*MaxShards + parityShards)))
+	shards := make([][]byte, dataShards+parityShards)
+	for i := 0; i < dataShards; i++ {
+		shards[i] = make([]byte, testShardSize)
+		rng.Read(shards[i])
+	}
+
+	err := code.Encode(shards)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	return shards
+}
+
+// erasurePatterns returns all subsets of shard indexes with at most maxErased elements
+func erasurePatterns(totalShards, maxErased int) [][]int {
+	patterns := [][]int{{}}
+	var extend func(start int, pattern []int)
+	extend = func(start int, pattern []int) {
+		if len(pattern) == maxErased {
+			return
+		}
+
+		for i := start; i < totalShards; i++ {
+			next := append(append([]int{}, pattern...), i)
+			patterns = append(patterns, next)
+			extend(i+1, next)
+		}
+	}
+
+	extend(0, nil)
+	return patterns
+}
+
+func copyShards(shards [][]byte) [][]byte {
+	result := make([][]byte, len(shards))
+	for i, shard := range shards {
+		result[i] = append([]byte{}, shard...)
+	}
+
+	return result
+}
+
+func TestEncodeKeepsDataShards(t *testing.T) {
+	for _, c := range codes {
+		t.Run(fmt.Sprintf("%d+%d", c.dataShards, c.parityShards), func(t *testing.T) {
+			code, err := New(c.dataShards, c.parityShards)
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+
+			shards := encodedShards(t, code, c.dataShards, c.parityShards)
+			data := copyShards(shards[:c.dataShards])
+
+			err = code.Encode(shards)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			for i := range data {
+				if !bytes.Equal(shards[i], data[i]) {
+					t.Fatalf("data shard %d changed by encoding", i)
+				}
+			}
+
+			for p := c.dataShards; p < len(shards); p++ {
+				if len(shards[p]) != testShardSize {
+					t.Fatalf("parity shard %d has size %d, want %d", p, len(shards[p]), testShardSize)
+				}
+			}
+		})
+	}
+}
+
+func TestReconstructAllErasurePatterns(t *testing.T) {
+	for _, c := range codes {
+		t.Run(fmt.Sprintf("%d+%d", c.dataShards, c.parityShards), func(t *testing.T) {
+			code, err := New(c.dataShards, c.parityShards)
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+
+			shards := encodedShards(t, code, c.dataShards, c.parityShards)
+			for _, erased := range erasurePatterns(len(shards), c.parityShards) {
+				damaged := copyShards(shards)
+				for _, i := range erased {
+					damaged[i] = nil
+				}
+
+				err = code.Reconstruct(damaged)
+				if err != nil {
+					t.Fatalf("reconstruct with shards %v erased: %v", erased, err)
+				}
+
+				for i := range shards {
+					if !bytes.Equal(damaged[i], shards[i]) {
+						t.Fatalf("shard %d differs after reconstruction with shards %v erased", i, erased)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReconstructTooManyErasures(t *testing.T) {
+	for _, c := range codes {
+		t.Run(fmt.Sprintf("%d+%d", c.dataShards, c.parityShards), func(t *testing.T) {
+			code, err := New(c.dataShards, c.parityShards)
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+
+			shards := encodedShards(t, code, c.dataShards, c.parityShards)
+			for first := 0; first+c.parityShards < len(shards); first++ {
+				damaged := copyShards(shards)
+				for i := first; i <= first+c.parityShards; i++ {
+					damaged[i] = nil
+				}
+
+				err = code.Reconstruct(damaged)
+				if !errors.Is(err, ErrTooFewShards) {
+					t.Fatalf("reconstruct with %d shards erased from %d: got %v, want %v", c.parityShards+1, first, err, ErrTooFewShards)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidShards(t *testing.T) {
+	code, err := New(4, 2)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	_, err = New(0, 2)
+	if !errors.Is(err, ErrInvalidShardCount) {
+		t.Fatalf("new with no data shards: got %v, want %v", err, ErrInvalidShardCount)
+	}
+
+	err = code.Encode(make([][]byte, 5))
+	if !errors.Is(err, ErrInvalidShardCount) {
+		t.Fatalf("encode with wrong shard count: got %v, want %v", err, ErrInvalidShardCount)
+	}
+
+	shards := encodedShards(t, code, 4, 2)
+	shards[0] = nil
+	err = code.Encode(shards)
+	if !errors.Is(err, ErrTooFewShards) {
+		t.Fatalf("encode with missing data shard: got %v, want %v", err, ErrTooFewShards)
+	}
+
+	shards = encodedShards(t, code, 4, 2)
+	shards[1] = shards[1][:testShardSize-1]
+	err = code.Reconstruct(shards)
+	if !errors.Is(err, ErrShardSizeMismatch) {
+		t.Fatalf("reconstruct with shards of different size: got %v, want %v", err, ErrShardSizeMismatch)
+	}
+}
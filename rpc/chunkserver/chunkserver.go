@@ -1,8 +1,16 @@
 package chunkserver
 
 import (
-	"github.com/google/uuid"
+	"errors"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrChunkDoesNotExist    = errors.New("chunk does not exist")
+	ErrChunkVersionMismatch = errors.New("chunk version mismatch")
+	ErrChunkCorrupted       = errors.New("chunk corrupted")
 )
 
 type CreateChunkRequest struct {
@@ -20,13 +28,22 @@ type CreateChunkReply struct {
 }
 
 type GrantLeaseArgs struct {
-	ChunkID    uuid.UUID
-	ValidUntil time.Time
+	ChunkID  uuid.UUID
+	ValidFor time.Duration // counted from the moment chunk server receives the grant
+	Epoch    int
 }
 
 type GrantLeaseReply struct {
 }
 
+type RevokeLeaseArgs struct {
+	ChunkID uuid.UUID
+	Epoch   int // lease is kept if it has been granted with newer epoch
+}
+
+type RevokeLeaseReply struct {
+}
+
 type IncrementChunkVersionArgs struct {
 	Version int // used to validate
 	ChunkID uuid.UUID
@@ -67,6 +84,8 @@ type ApplyMigrationArgs struct {
 	CheckSum int
 	Offset   int
 	Version  int
+	Epoch    int  // lease epoch of primary sending mutation, not set for copies of chunk written to new chunk
+	Padding  bool // pad chunk with zeros from offset to the end instead of writing data
 }
 
 type ApplyMigrationReply struct {
@@ -83,18 +102,82 @@ type ReplicateChunkReply struct {
 
 type DeleteChunkRequest struct {
 	ChunkID uuid.UUID
+	Version int // if set, replica is deleted only if it is older than given version
 }
 
 type DeleteChunkReply struct {
 }
 
+type ReadChunkArgs struct {
+	ChunkID uuid.UUID
+	Offset  int
+	Length  int
+	Version int
+}
+
+type ReadChunkReply struct {
+	Data    []byte
+	Version int
+}
+
+type RecordAppendArgs struct {
+	ChunkID  uuid.UUID
+	CheckSum int
+	Version  int
+
+	ChunkServers []ChunkServer
+}
+
+type RecordAppendReply struct {
+	Offset    int
+	ChunkFull bool // record does not fit into chunk, chunk has been padded and append should be retried on next chunk
+}
+
+type CloneChunkArgs struct {
+	ChunkID    uuid.UUID
+	NewChunkID uuid.UUID
+	ChunkIndex int
+	Version    int
+	FilePath   string
+}
+
+type CloneChunkReply struct {
+}
+
+// StripeMember is data or parity chunk of erasure coded stripe
+type StripeMember struct {
+	ChunkID uuid.UUID // uuid.Nil stands for missing data chunk of the last stripe which is read as zeros
+	Version int
+	Index   int
+	Length  int    // number of bytes held by the chunk, -1 if chunk is read to its end
+	Source  string // address of chunk server holding the chunk, empty if chunk is lost
+	Target  string // address of chunk server chunk is rebuilt on, empty if chunk is not rebuilt
+}
+
+type RebuildStripeArgs struct {
+	DataShards   int
+	ParityShards int
+	ChunkSize    int
+	FilePath     string
+	Members      []StripeMember // data members followed by parity members
+}
+
+type RebuildStripeReply struct {
+	Lengths []int // number of bytes held by each stripe member
+}
+
 type IChunkServer interface {
 	CreateChunk(args *CreateChunkRequest, reply *CreateChunkReply) error
 	DeleteChunk(args *DeleteChunkRequest, reply *DeleteChunkReply) error
 	GrantLease(args *GrantLeaseArgs, reply *GrantLeaseReply) error
+	RevokeLease(args *RevokeLeaseArgs, reply *RevokeLeaseReply) error
 	IncrementChunkVersion(args *IncrementChunkVersionArgs, reply *IncrementChunkVersionReply) error
 	TransferData(args *TransferDataArgs, reply *TransferDataReply) error
 	WriteChunk(args *WriteChunkArgs, reply *WriteChunkReply) error
 	ApplyMigration(args *ApplyMigrationArgs, reply *ApplyMigrationReply) error
 	ReplicateChunk(args *ReplicateChunkArgs, reply *ReplicateChunkReply) error
+	ReadChunk(args *ReadChunkArgs, reply *ReadChunkReply) error
+	RecordAppend(args *RecordAppendArgs, reply *RecordAppendReply) error
+	CloneChunk(args *CloneChunkArgs, reply *CloneChunkReply) error
+	RebuildStripe(args *RebuildStripeArgs, reply *RebuildStripeReply) error
 }
@@ -1,11 +1,17 @@
 package master
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrChunkServerNotRegistered = errors.New("chunk server not registered")
+	ErrClusterIDMismatch        = errors.New("chunk server belongs to another cluster")
+)
+
 type Master interface {
 	// RegisterChunkServer ...
 	RegisterChunkServer(args RegisterArgs, reply RegisterReply) error
@@ -17,21 +23,60 @@ type Master interface {
 	RequestLeaseRenewal(args RequestLeaseRenewalArgs, reply RequestLeaseRenewalReply) error
 	// RequestWrite ...
 	RequestWrite(args RequestWriteArgs, reply RequestWriteReply) error
+	// GetFileInfo ...
+	GetFileInfo(args GetFileInfoArgs, reply GetFileInfoReply) error
+	// GetChunkLocations ...
+	GetChunkLocations(args GetChunkLocationsArgs, reply GetChunkLocationsReply) error
 	// ReportHealth ...
 	ReportHealth(args ReportHealthArgs, reply ReportHealthReply) error
+	// ReportBadChunk ...
+	ReportBadChunk(args ReportBadChunkArgs, reply ReportBadChunkReply) error
+	// Mkdir ...
+	Mkdir(args MkdirArgs, reply MkdirReply) error
+	// ListDirectory ...
+	ListDirectory(args ListDirectoryArgs, reply ListDirectoryReply) error
+	// Stat ...
+	Stat(args StatArgs, reply StatReply) error
+	// Undelete ...
+	Undelete(args UndeleteArgs, reply UndeleteReply) error
+	// ListTrash ...
+	ListTrash(args ListTrashArgs, reply ListTrashReply) error
+	// RequestRecordAppend ...
+	RequestRecordAppend(args RequestRecordAppendArgs, reply RequestRecordAppendReply) error
+	// AllocateChunk ...
+	AllocateChunk(args AllocateChunkArgs, reply AllocateChunkReply) error
+	// Snapshot ...
+	Snapshot(args SnapshotArgs, reply SnapshotReply) error
+	// Balance ...
+	Balance(args BalanceArgs, reply BalanceReply) error
+	// SetReplication ...
+	SetReplication(args SetReplicationArgs, reply SetReplicationReply) error
+	// SetErasureCoding ...
+	SetErasureCoding(args SetErasureCodingArgs, reply SetErasureCodingReply) error
+	// Decommission ...
+	Decommission(args DecommissionArgs, reply DecommissionReply) error
+	// DecommissionStatus ...
+	DecommissionStatus(args DecommissionStatusArgs, reply DecommissionStatusReply) error
 }
 
 type RegisterArgs struct {
-	Address string
+	Address       string
+	ChunkServerID uuid.UUID // empty if chunk server registers for the first time
+	ClusterID     uuid.UUID
+	Zone          string
+	Rack          string
 }
 
 type RegisterReply struct {
-	ID uuid.UUID
+	ID        uuid.UUID
+	ClusterID uuid.UUID
 }
 
 type CreateNewFileArgs struct {
-	Path string
-	Size int
+	Path              string
+	Size              int
+	ReplicationFactor int // default replication factor is used if not set
+	ChunkSize         int // cluster default chunk size is used if not set
 }
 
 type CreateNewFileReply struct {
@@ -45,12 +90,14 @@ type RequestLeaseRenewalArgs struct {
 }
 
 type RequestLeaseRenewalReply struct {
-	Granted    bool
-	ChunkID    uuid.UUID
-	ValidUntil time.Time
+	Granted  bool
+	ChunkID  uuid.UUID
+	ValidFor time.Duration // counted from the moment chunk server requested renewal
+	Epoch    int
 }
 
 type RequestWriteArgs struct {
+	Path    string
 	ChunkID uuid.UUID
 }
 
@@ -67,6 +114,66 @@ type RequestWriteReply struct {
 	ChunkServers         []ChunkServer
 }
 
+type RequestRecordAppendArgs struct {
+	Path string
+}
+
+type RequestRecordAppendReply struct {
+	RequestWriteReply
+	ChunkIndex int
+	ChunkSize  int
+}
+
+type AllocateChunkArgs struct {
+	Path       string
+	ChunkIndex int
+}
+
+type AllocateChunkReply struct {
+	ChunkID    uuid.UUID
+	ChunkIndex int
+}
+
+type ChunkLocation struct {
+	ChunkID      uuid.UUID
+	Index        int
+	Version      int
+	ChunkServers []ChunkServer
+}
+
+type GetFileInfoArgs struct {
+	Path string
+}
+
+type GetFileInfoReply struct {
+	ID        uuid.UUID
+	Path      string
+	Size      int
+	ChunkSize int
+	CreatedAt time.Time
+	Chunks    []ChunkLocation
+
+	// DataShards, ParityShards and Stripes are set for erasure coded files
+	DataShards   int
+	ParityShards int
+	Stripes      []StripeLocation
+}
+
+// StripeLocation holds locations of data chunks of erasure coded stripe followed by its parity chunks.
+// Missing data chunks of the last stripe are left empty and read as zeros.
+type StripeLocation struct {
+	Chunks  []ChunkLocation
+	Lengths []int // number of bytes held by each chunk
+}
+
+type GetChunkLocationsArgs struct {
+	ChunkIDs []uuid.UUID
+}
+
+type GetChunkLocationsReply struct {
+	Chunks []ChunkLocation
+}
+
 type Chunk struct {
 	ID      uuid.UUID
 	Version int
@@ -76,14 +183,164 @@ type Chunk struct {
 type ReportHealthArgs struct {
 	ChunkServerID uuid.UUID
 	Chunks        []Chunk
+	Usage         Usage
+}
+
+// Usage is disk usage of chunks path and load of chunk server
+type Usage struct {
+	TotalBytes     int64
+	FreeBytes      int64
+	ChunkCount     int
+	InFlightWrites int
 }
 
 type ReportHealthReply struct {
 }
 
+type ReportBadChunkArgs struct {
+	ChunkServerID uuid.UUID
+	ChunkID       uuid.UUID
+}
+
+type ReportBadChunkReply struct {
+}
+
 type DeleteFileArgs struct {
-	Path string
+	Path      string
+	Recursive bool
 }
 
 type DeleteFileReply struct {
 }
+
+type FileStatus struct {
+	Path              string
+	IsDir             bool
+	Size              int
+	NumChunks         int
+	CreatedAt         time.Time
+	ReplicationFactor int
+	ChunkSize         int
+	ErasureCoding     string
+}
+
+type MkdirArgs struct {
+	Path    string
+	Parents bool
+}
+
+type MkdirReply struct {
+}
+
+type ListDirectoryArgs struct {
+	Path       string
+	StartAfter string
+	Limit      int
+	Recursive  bool
+}
+
+type ListDirectoryReply struct {
+	Entries []FileStatus
+	HasMore bool
+}
+
+type StatArgs struct {
+	Path string
+}
+
+type StatReply struct {
+	FileStatus
+}
+
+type UndeleteArgs struct {
+	Path string
+	ID   uuid.UUID
+}
+
+type UndeleteReply struct {
+	Path string
+	ID   uuid.UUID
+}
+
+type TrashedFile struct {
+	ID        uuid.UUID
+	Path      string
+	Size      int
+	DeletedAt time.Time
+	ExpiresAt time.Time
+}
+
+type ListTrashArgs struct {
+}
+
+type ListTrashReply struct {
+	Files []TrashedFile
+}
+
+type SnapshotArgs struct {
+	SrcPath string
+	DstPath string
+}
+
+type SnapshotReply struct {
+}
+
+type BalanceAction int
+
+const (
+	BalanceStatus BalanceAction = iota
+	BalanceStart
+	BalanceStop
+)
+
+type BalanceArgs struct {
+	Action BalanceAction
+}
+
+type BalanceReply struct {
+	Running     bool
+	MovedChunks int // chunks moved since rebalancer has been started
+}
+
+type SetReplicationArgs struct {
+	Path              string
+	ReplicationFactor int
+}
+
+type SetReplicationReply struct {
+	Files int // number of files replication factor has been set for
+}
+
+type SetErasureCodingArgs struct {
+	Path   string
+	Policy string // e.g. RS-6-3
+}
+
+type SetErasureCodingReply struct {
+}
+
+type DecommissionProgress struct {
+	ChunkServerID  uuid.UUID
+	Address        string
+	Active         bool
+	Draining       bool
+	Decommissioned bool
+	Chunks         int // chunks held by chunk server
+	PendingChunks  int // chunks that would be left without enough replicas without chunk server
+}
+
+type DecommissionArgs struct {
+	ChunkServerID uuid.UUID
+}
+
+type DecommissionReply struct {
+	Progress DecommissionProgress
+}
+
+type DecommissionStatusArgs struct {
+	ChunkServerID uuid.UUID // all chunk servers are returned if not set
+}
+
+type DecommissionStatusReply struct {
+	ChunkServers []DecommissionProgress
+}